@@ -0,0 +1,180 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// ANSI colors by name, for -color and the [colors] section of
+// the config file
+var colorCodes = map[string]string{
+	"black":   "30",
+	"red":     "31",
+	"green":   "32",
+	"yellow":  "33",
+	"blue":    "34",
+	"magenta": "35",
+	"cyan":    "36",
+	"white":   "37",
+	"bold":    "1",
+	"dim":     "2",
+}
+
+// the config file's [colors] section sets colors for tags:
+//
+//	[colors]
+//	review = magenta
+//	urgent = red
+//
+// and a tag's color goes for the tags under it, too
+const colorSection = "colors"
+
+var tagColors = map[string]string{}
+
+// setTagColors picks up the tag colors from the config
+func setTagColors(path string, entries []configEntry) {
+	for _, e := range entries {
+		if e.section != colorSection {
+			continue
+		}
+
+		codes := []string{}
+		for _, name := range strings.Fields(e.value) {
+			code, found := colorCodes[name]
+			if !found {
+				eprintf("%s:%d: no such color %q", path, e.line, name)
+				continue
+			}
+
+			codes = append(codes, code)
+		}
+
+		tagColors[e.key] = strings.Join(codes, ";")
+	}
+}
+
+// colorful reports whether to color what goes to f: always,
+// never, or (auto) if it's a terminal (or the pager) and nobody's said not to
+func colorful(f *os.File) bool {
+	switch flagColor {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+
+	return os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb" && (isTerminal(f) || paging && f == os.Stdout)
+}
+
+// paint wraps s in an ANSI color, if on
+func paint(on bool, code, s string) string {
+	if !on || code == "" || s == "" {
+		return s
+	}
+
+	return "\033[" + code + "m" + s + "\033[0m"
+}
+
+// pathColor is the color for a path, going by what's there:
+// directories are blue, symlinks cyan, executables green, and
+// missing files red
+func pathColor(path string) string {
+	fi, err := os.Lstat(path)
+
+	switch {
+	case err != nil:
+		return colorCodes["red"]
+	case fi.IsDir():
+		return "1;" + colorCodes["blue"]
+	case fi.Mode()&os.ModeSymlink != 0:
+		return colorCodes["cyan"]
+	case fi.Mode()&0111 != 0:
+		return colorCodes["green"]
+	}
+
+	return ""
+}
+
+// tagColor is the color for a tag: its own, or its closest
+// parent's, from the config, or yellow
+func tagColor(tag string) string {
+	for t := tag; t != ""; {
+		if code, found := tagColors[t]; found {
+			return code
+		}
+
+		i := strings.LastIndex(t, "/")
+		if i < 0 {
+			break
+		}
+
+		t = t[:i]
+	}
+
+	return colorCodes["yellow"]
+}
+
+// statusColor is the color for a mark's status
+func statusColor(status string) string {
+	switch status {
+	case "failed":
+		return colorCodes["red"]
+	case "done":
+		return colorCodes["green"]
+	}
+
+	return ""
+}
+
+// paintTags renders tags, each in its color
+func paintTags(on bool, tags []string) string {
+	painted := []string{}
+	for _, t := range tags {
+		painted = append(painted, paint(on, tagColor(t), t))
+	}
+
+	return "[" + strings.Join(painted, " ") + "]"
+}
+
+// a cell in printColumns: its text, and how it looks colored
+type cell struct {
+	text, painted string
+}
+
+func plainCell(text string) cell {
+	return cell{text, text}
+}
+
+// printColumns lines up rows of cells like tabwriter would,
+// going by their uncolored widths
+func printColumns(rows [][]cell) {
+	widths := []int{}
+
+	for _, row := range rows {
+		for i, c := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+
+			if n := len([]rune(c.text)); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+
+	out := &strings.Builder{}
+
+	for _, row := range rows {
+		out.Reset()
+
+		for i, c := range row {
+			out.WriteString(c.painted)
+
+			if i < len(row)-1 {
+				out.WriteString(strings.Repeat(" ", widths[i]-len([]rune(c.text))+2))
+			}
+		}
+
+		os.Stdout.WriteString(out.String() + "\n")
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// flags whose values are files, and flags with only a few values
+var (
+	fileFlags   = []string{"staging", "cd", "report"}
+	choiceFlags = map[string][]string{
+		"color":  {"always", "never", "auto"},
+		"format": {"text", "json"},
+		"sort":   {"name", "size", "mtime", "ext"},
+		"by":     {"name", "size", "mtime", "ext", "count"},
+		"type":   {"f", "d", "l"},
+	}
+)
+
+// markFlags is the names of the flags, split into the ones that
+// are just switches and the ones that take a value
+func markFlags() (switches, valued []string) {
+	flag.VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			switches = append(switches, f.Name)
+		} else {
+			valued = append(valued, f.Name)
+		}
+	})
+
+	return switches, valued
+}
+
+// dashed puts a dash in front of each name
+func dashed(names []string) []string {
+	ret := []string{}
+	for _, n := range names {
+		ret = append(ret, "-"+n)
+	}
+
+	return ret
+}
+
+// Completion writes a completion script for shell: bash, zsh or
+// fish. Tags and staged paths come from asking mark, as you type.
+func Completion(out io.Writer, shell string) error {
+	switch shell {
+	case "bash":
+		bashCompletion(out)
+	case "zsh":
+		zshCompletion(out)
+	case "fish":
+		fishCompletion(out)
+	default:
+		return fmt.Errorf("no completion for %q; try bash, zsh or fish", shell)
+	}
+
+	return nil
+}
+
+func bashCompletion(out io.Writer) {
+	switches, valued := markFlags()
+
+	choices := ""
+	for _, name := range sortedKeys(choiceFlags) {
+		choices += fmt.Sprintf("\t-%s) COMPREPLY=($(compgen -W %s -- \"$cur\")); return ;;\n", name, staging.ShellQuote(strings.Join(choiceFlags[name], "\n")))
+	}
+
+	fmt.Fprintf(out, `# bash completion for mark; load it with
+#   source <(mark completion bash)
+
+_mark() {
+	local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}"
+	local cmd="" at=0 i
+	local IFS=$'\n'
+
+	# the command is the first word that isn't a flag or a flag's value
+	for ((i = 1; i < COMP_CWORD; i++)); do
+		case "${COMP_WORDS[i]}" in
+		%s) ((i++)) ;;
+		-*) ;;
+		*) cmd="${COMP_WORDS[i]}"; at=$i; break ;;
+		esac
+	done
+
+	case "$prev" in
+	%s) COMPREPLY=($(compgen -f -- "$cur")); return ;;
+	-tag) COMPREPLY=($(compgen -W "$(mark tags 2>/dev/null | cut -d' ' -f2-)" -- "$cur")); return ;;
+%s	%s) return ;;
+	esac
+
+	if [[ "$cur" == -* ]]; then
+		COMPREPLY=($(compgen -W %s -- "$cur"))
+		return
+	fi
+
+	if [ -z "$cmd" ]; then
+		COMPREPLY=($(compgen -W %s -- "$cur"))
+		return
+	fi
+
+	case "$cmd" in
+	tag|untag|tag-rename|tag-rm)
+		if ((COMP_CWORD == at + 1)); then
+			COMPREPLY=($(compgen -W "$(mark tags 2>/dev/null | cut -d' ' -f2-)" -- "$cur"))
+		else
+			COMPREPLY=($(compgen -W "$(mark list 2>/dev/null)" -- "$cur"))
+		fi ;;
+	remove|set|path)
+		COMPREPLY=($(compgen -W "$(mark list 2>/dev/null; mark tags 2>/dev/null | cut -d' ' -f2- | sed 's/^/@/')" -- "$cur")) ;;
+	*)
+		COMPREPLY=($(compgen -f -- "$cur")) ;;
+	esac
+}
+
+complete -o filenames -F _mark mark
+`,
+		strings.Join(dashed(valued), "|"),
+		strings.Join(dashed(fileFlags), "|"),
+		choices,
+		strings.Join(dashed(valued), "|"),
+		staging.ShellQuote(strings.Join(dashed(append(switches, valued...)), "\n")),
+		staging.ShellQuote(strings.Join(commandNames(), "\n")))
+}
+
+func zshCompletion(out io.Writer) {
+	switches, valued := markFlags()
+
+	choices := ""
+	for _, name := range sortedKeys(choiceFlags) {
+		choices += fmt.Sprintf("\t-%s) compadd -- %s; return ;;\n", name, strings.Join(choiceFlags[name], " "))
+	}
+
+	commands := []string{}
+	for _, c := range commandList() {
+		commands = append(commands, fmt.Sprintf("\t\t%s", staging.ShellQuote(c.name+":"+c.about)))
+	}
+
+	fmt.Fprintf(out, `#compdef mark
+# zsh completion for mark; load it with
+#   source <(mark completion zsh)
+
+_mark() {
+	local cmd="" at=0 i
+	local -a commands
+
+	commands=(
+%s
+	)
+
+	# the command is the first word that isn't a flag or a flag's value
+	for ((i = 2; i < CURRENT; i++)); do
+		case "${words[i]}" in
+		%s) ((i++)) ;;
+		-*) ;;
+		*) cmd="${words[i]}"; at=$i; break ;;
+		esac
+	done
+
+	case "${words[CURRENT-1]}" in
+	%s) _files; return ;;
+	-tag) compadd -- ${(f)"$(mark tags 2>/dev/null | cut -d' ' -f2-)"}; return ;;
+%s	%s) return ;;
+	esac
+
+	if [[ "$PREFIX" == -* ]]; then
+		compadd -- %s
+		return
+	fi
+
+	if [[ -z "$cmd" ]]; then
+		_describe command commands
+		return
+	fi
+
+	case "$cmd" in
+	tag|untag|tag-rename|tag-rm)
+		if ((CURRENT == at + 1)); then
+			compadd -- ${(f)"$(mark tags 2>/dev/null | cut -d' ' -f2-)"}
+		else
+			compadd -- ${(f)"$(mark list 2>/dev/null)"}
+		fi ;;
+	remove|set|path)
+		compadd -- ${(f)"$(mark list 2>/dev/null)"}
+		compadd -P @ -- ${(f)"$(mark tags 2>/dev/null | cut -d' ' -f2-)"} ;;
+	*)
+		_files ;;
+	esac
+}
+
+compdef _mark mark
+`,
+		strings.Join(commands, "\n"),
+		strings.Join(dashed(valued), "|"),
+		strings.Join(dashed(fileFlags), "|"),
+		choices,
+		strings.Join(dashed(valued), "|"),
+		strings.Join(dashed(append(switches, valued...)), " "))
+}
+
+func fishCompletion(out io.Writer) {
+	fmt.Fprintf(out, `# fish completion for mark; load it with
+#   mark completion fish | source
+
+function __mark_tags
+	mark tags 2>/dev/null | cut -d' ' -f2-
+end
+
+complete -c mark -f
+`)
+
+	for _, c := range commandList() {
+		fmt.Fprintf(out, "complete -c mark -n __fish_use_subcommand -a %s -d %s\n", c.name, staging.ShellQuote(c.about))
+	}
+
+	files := map[string]bool{}
+	for _, name := range fileFlags {
+		files[name] = true
+	}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		line := fmt.Sprintf("complete -c mark -o %s -d %s", staging.ShellQuote(f.Name), staging.ShellQuote(f.Usage))
+
+		switch {
+		case files[f.Name]:
+			line += " -r -F"
+		case f.Name == "tag":
+			line += " -x -a '(__mark_tags)'"
+		case choiceFlags[f.Name] != nil:
+			line += fmt.Sprintf(" -x -a %s", staging.ShellQuote(strings.Join(choiceFlags[f.Name], " ")))
+		default:
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); !ok || !b.IsBoolFlag() {
+				line += " -x"
+			}
+		}
+
+		fmt.Fprintln(out, line)
+	})
+
+	fmt.Fprintf(out, `complete -c mark -n '__fish_seen_subcommand_from tag untag tag-rename tag-rm' -a '(__mark_tags)'
+complete -c mark -n '__fish_seen_subcommand_from tag untag remove set path' -a '(mark list 2>/dev/null)'
+complete -c mark -n '__fish_seen_subcommand_from remove set path' -a '(__mark_tags | sed "s/^/@/")'
+complete -c mark -n '__fish_seen_subcommand_from %s' -F
+`, strings.Join(fileCompletionCommands(), " "))
+}
+
+// fileCompletionCommands is the commands that take files, for fish
+func fileCompletionCommands() []string {
+	names := []string{"exec", "capture", "tagif", "select", "script", "retry"}
+	for name := range fileCommands {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the config file sets defaults for flags, one per line, by the
+// flag's name:
+//
+//	# always keep marks around after exec
+//	retain = true
+//	j = 4
+//	shell = "bash"
+//
+// Anything given on the command line overrides it, even for flags
+// like -exclude that add up when they're given more than once.
+//
+// Sections name presets for "mark run": the command to exec, and
+// flags for just that command.
+//
+//	[backup]
+//	exec = "rsync -a _ user@host:backups/"
+//	tag = photos
+//	j = 4
+//
+// except for [colors], which colors tags (see colorSection).
+type configEntry struct {
+	// the [section] it's in, or "" for the defaults at the top
+	section string
+
+	key, value string
+	line       int
+}
+
+// configPath is $MARK_CONFIG, or $XDG_CONFIG_HOME/mark/config,
+// or ~/.config/mark/config
+func configPath() string {
+	if path := os.Getenv("MARK_CONFIG"); path != "" {
+		return expandHome(path)
+	}
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "mark", "config")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".config", "mark", "config")
+}
+
+// readConfig parses the config file, if there is one
+func readConfig(path string) ([]configEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	entries := []configEntry{}
+	section := ""
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+			continue
+		case line[0] == '[' && line[len(line)-1] == ']':
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, val, found := strings.Cut(line, "=")
+		if !found {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+
+		val = strings.TrimSpace(val)
+		if strings.HasPrefix(val, `"`) {
+			if val, err = strconv.Unquote(val); err != nil {
+				return nil, fmt.Errorf("%s:%d: bad quoting", path, n)
+			}
+		}
+
+		entries = append(entries, configEntry{
+			section: section,
+			key:     strings.TrimSpace(key),
+			value:   val,
+			line:    n,
+		})
+	}
+
+	return entries, scanner.Err()
+}
+
+// the key in a preset's section for the command it runs
+const presetCommand = "exec"
+
+// preset returns the command for the preset called name
+func preset(entries []configEntry, name string) (string, bool) {
+	for _, e := range entries {
+		if e.section == name && e.key == presetCommand {
+			return e.value, true
+		}
+	}
+
+	return "", false
+}
+
+// presets lists the presets in the config, in order
+func presets(entries []configEntry) []string {
+	names := []string{}
+	seen := map[string]bool{}
+
+	for _, e := range entries {
+		if e.section != "" && e.key == presetCommand && !seen[e.section] {
+			names = append(names, e.section)
+			seen[e.section] = true
+		}
+	}
+
+	return names
+}
+
+// a flag.Value that adds to itself each time it's set, like
+// -exclude, and has to be told that what it has now is from the
+// config, to start over the next time
+type configurable interface {
+	configured()
+}
+
+// applyConfig sets flags from config entries in section, except
+// for the ones in set, which the command line set
+func applyConfig(path, section string, entries []configEntry, set map[string]bool) {
+	applied := []configurable{}
+
+	// after the whole section, so that it can give a flag twice
+	defer func() {
+		for _, c := range applied {
+			c.configured()
+		}
+	}()
+
+	for _, e := range entries {
+		if e.section != section || section != "" && e.key == presetCommand || set[e.key] {
+			continue
+		}
+
+		if flag.Lookup(e.key) == nil {
+			eprintf("%s:%d: no such flag %q", path, e.line, e.key)
+			continue
+		}
+
+		if err := flag.Set(e.key, e.value); err != nil {
+			eprintf("%s:%d: %s: %v", path, e.line, e.key, err)
+		} else if c, is := flag.Lookup(e.key).Value.(configurable); is {
+			applied = append(applied, c)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// the commands a running daemon does for mark (see viaDaemon)
+var daemonCommands = map[string]bool{
+	"": true, "status": true, "list": true, "add": true, "+": true,
+	"remove": true, "tag": true, "untag": true, "exec": true,
+}
+
+// a daemonRequest is a mark command line, run as if it were run
+// in dir, with env
+type daemonRequest struct {
+	Args []string `json:"args"`
+	Dir  string   `json:"dir"`
+	Env  []string `json:"env"`
+}
+
+// and the daemon answers with what it writes, as it writes it,
+// ending with what it exits with
+type daemonMessage struct {
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+	Exit   *int   `json:"exit,omitempty"`
+}
+
+// daemon keeps the staging area loaded and runs commands on it
+// for other marks of yours, over a unix socket (see daemonSocket);
+// anyone else's are hung up on. Each connection sends one
+// daemonRequest, as a JSON object, and gets back a daemonMessage
+// per chunk of output, then one with the exit code. Commands run one at a time, with
+// the staging area locked, and if something else changes the
+// staging file, the daemon reads it again.
+func daemon(s *StagingArea, config []configEntry) {
+	sock := daemonSocket(s.Path)
+
+	// the socket's where no one else can get at it
+	hardfail(os.MkdirAll(filepath.Dir(sock), 0700))
+	hardfail(os.Chmod(filepath.Dir(sock), 0700))
+
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		eprintf("there's already a daemon for %s", s.Path)
+		exit(exitFailed)
+	}
+
+	// left over from a daemon that didn't get to clean up
+	os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	hardfail(err)
+	hardfail(os.Chmod(sock, 0600))
+
+	d := &daemonState{stage: s, config: config}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		l.Close()
+	}()
+
+	go d.watch()
+
+	eprintf("serving %s on %s", s.Path, sock)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			break
+		}
+
+		if !peerIsUs(conn) {
+			conn.Close()
+			continue
+		}
+
+		go d.serve(conn)
+	}
+
+	os.Remove(sock)
+}
+
+// daemonSocket is where the daemon for the staging file at path
+// listens: in a directory of ours only we can get into, named for
+// the staging file (it can't go next to it, where with -local,
+// say, others may be able to get at it)
+func daemonSocket(path string) string {
+	return filepath.Join(stateDir(), "daemon", stateName(path)+".sock")
+}
+
+type daemonState struct {
+	// held while a command runs, or the staging area is reread
+	lock sync.Mutex
+
+	stage  *StagingArea
+	config []configEntry
+}
+
+// watch rereads the staging file when it's changed, every second
+func (d *daemonState) watch() {
+	for range time.Tick(time.Second) {
+		d.lock.Lock()
+		d.reload()
+		d.lock.Unlock()
+	}
+}
+
+// reload rereads the staging file if it isn't what the daemon
+// last read or wrote
+func (d *daemonState) reload() {
+	if d.stage.Unchanged() != staging.ErrChanged {
+		return
+	}
+
+	s, err := GetStagingArea(d.stage.Path)
+	if !ok(err) {
+		return
+	}
+
+	d.stage = s
+}
+
+func (d *daemonState) serve(conn net.Conn) {
+	defer conn.Close()
+
+	req := daemonRequest{}
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	enc := json.NewEncoder(conn)
+	sendLock := sync.Mutex{}
+
+	send := func(m daemonMessage) {
+		sendLock.Lock()
+		defer sendLock.Unlock()
+
+		enc.Encode(m)
+	}
+
+	code := d.run(req, send)
+	send(daemonMessage{Exit: &code})
+}
+
+// run runs a request's command, with everything it writes to
+// stdout and stderr sent back
+func (d *daemonState) run(req daemonRequest, send func(daemonMessage)) int {
+	env := os.Environ()
+	wd, _ := os.Getwd()
+
+	defer func() {
+		setEnv(env)
+		os.Chdir(wd)
+	}()
+
+	setEnv(req.Env)
+
+	if err := os.Chdir(req.Dir); err != nil {
+		send(daemonMessage{Stderr: err.Error() + "\n"})
+		return exitFailed
+	}
+
+	code, err := capture(
+		func(b string) { send(daemonMessage{Stdout: b}) },
+		func(b string) { send(daemonMessage{Stderr: b}) },
+		func() int {
+			return d.do(func(s *StagingArea) int {
+				return shellCommand(s, d.config, req.Args)
+			})
+		})
+
+	if err != nil {
+		send(daemonMessage{Stderr: err.Error() + "\n"})
+		return exitFailed
+	}
+
+	return code
+}
+
+// do runs fn on the staging area, locked, returning what it
+// exits with; like in the shell, exiting just ends fn, and its
+// flags are put back after
+func (d *daemonState) do(fn func(s *StagingArea) int) (code int) {
+	restore := saveFlags()
+	defer restore()
+
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.Usage = func() {}
+	exit = func(code int) { panic(shellExit(code)) }
+
+	defer func() { exit = os.Exit }()
+
+	unlock, err := Lock(d.stage.Path, true)
+	if err != nil {
+		eprintf("%s", err)
+		return exitStaging
+	}
+
+	defer unlock()
+
+	d.reload()
+
+	defer func() {
+		if r := recover(); r != nil {
+			exited, isExit := r.(shellExit)
+			if !isExit {
+				panic(r)
+			}
+
+			code = int(exited)
+		}
+	}()
+
+	return fn(d.stage)
+}
+
+// capture runs fn with what it writes to stdout and stderr going
+// to those functions instead, as it's written
+func capture(stdout, stderr func(string), fn func() int) (int, error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outR.Close()
+		outW.Close()
+		return 0, err
+	}
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+
+	go relay(outR, &wg, stdout)
+	go relay(errR, &wg, stderr)
+
+	saved, savedErr := os.Stdout, os.Stderr
+
+	os.Stdout, os.Stderr = outW, errW
+	code := fn()
+	os.Stdout, os.Stderr = saved, savedErr
+
+	outW.Close()
+	errW.Close()
+	wg.Wait()
+
+	return code, nil
+}
+
+// relay sends what's read from r, as it comes, until it's closed
+func relay(r *os.File, wg *sync.WaitGroup, send func(string)) {
+	defer wg.Done()
+	defer r.Close()
+
+	buf := make([]byte, 32*1024)
+
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			send(string(buf[:n]))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setEnv replaces the environment with env
+func setEnv(env []string) {
+	os.Clearenv()
+
+	for _, kv := range env {
+		if k, v, found := cutEnv(kv); found {
+			os.Setenv(k, v)
+		}
+	}
+}
+
+// cutEnv splits KEY=value; on Windows, there are variables like
+// "=C:" whose names start with =
+func cutEnv(kv string) (string, string, bool) {
+	for i := 1; i < len(kv); i++ {
+		if kv[i] == '=' {
+			return kv[:i], kv[i+1:], true
+		}
+	}
+
+	return "", "", false
+}
+
+// forwardable is whether a running daemon can do this command:
+// it's one of daemonCommands, it doesn't need our terminal or
+// stdin, and it won't keep the daemon busy for good
+func forwardable(command string, args []string) bool {
+	if flagNoDaemon || flagInteractive || flagWatch || !daemonCommands[command] {
+		return false
+	}
+
+	for _, arg := range args {
+		if arg == "-" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// viaDaemon runs this mark's command line with the daemon for the
+// staging file at path, if one's running, returning what to exit
+// with; it reports false if there's no daemon to do it
+func viaDaemon(path string, args []string) (int, bool) {
+	conn, err := net.Dial("unix", daemonSocket(path))
+	if err != nil {
+		return 0, false
+	}
+
+	defer conn.Close()
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return 0, false
+	}
+
+	// the daemon's output is never a terminal, but ours might be
+	if flagColor == "auto" && colorful(os.Stdout) {
+		args = append([]string{"-color", "always"}, args...)
+	}
+
+	req := daemonRequest{Args: args, Dir: dir, Env: os.Environ()}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return 0, false
+	}
+
+	dec := json.NewDecoder(conn)
+
+	for {
+		m := daemonMessage{}
+		if err := dec.Decode(&m); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = errors.New("it hung up")
+			}
+
+			eprintf("lost the daemon: %s", err)
+			return exitFailed, true
+		}
+
+		os.Stdout.WriteString(m.Stdout)
+		os.Stderr.WriteString(m.Stderr)
+
+		if m.Exit != nil {
+			return *m.Exit, true
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// peerIsUs reports whether conn's other end is a process of ours
+func peerIsUs(conn net.Conn) bool {
+	uc, found := conn.(*net.UnixConn)
+	if !found {
+		return false
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+
+	return err == nil && credErr == nil && int(cred.Uid) == os.Getuid()
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// returned by Edit when the user gives up on a broken edit
+var errAbandoned = errors.New("edit abandoned")
+
+// edit opens the staging file in $VISUAL or $EDITOR (or vi), then
+// checks what comes back, offering to go back in if it's broken,
+// and writes it out again with its paths canonicalized
+func edit(s *StagingArea) error {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return err
+	}
+
+	ext := ".txt"
+	if s.JSON {
+		ext = ".json"
+	}
+
+	f, err := ioutil.TempFile("", "mark-edit-*"+ext)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		if err := runEditor(tmp); err != nil {
+			return err
+		}
+
+		edited, err := ioutil.ReadFile(tmp)
+		if err != nil {
+			return err
+		}
+
+		if bytes.Equal(edited, data) {
+			eprintf("no changes")
+			return nil
+		}
+
+		problems := staging.Lint(edited, editedPath)
+		if len(problems) == 0 {
+			return replace(s, edited)
+		}
+
+		for _, p := range problems {
+			eprintf("%s", p)
+		}
+
+		answer, err := ask("edit again? [Y/n] ")
+		if err != nil || strings.HasPrefix(strings.ToLower(answer), "n") {
+			eprintf("staging file left as it was")
+			return errAbandoned
+		}
+	}
+}
+
+// runEditor opens path in the user's editor
+func runEditor(path string) error {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// the editor can have arguments of its own, like "code -w"
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		cmd.Stdin = tty
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s: %w", editor, err)
+	}
+
+	return nil
+}
+
+// replace swaps in the marks from an edited staging file
+func replace(s *StagingArea, data []byte) error {
+	edited, err := staging.Parse(s.Path, data)
+	if err != nil {
+		return err
+	}
+
+	s.Marks, s.LastExec, s.Globs = edited.Marks, edited.LastExec, edited.Globs
+
+	for i := range s.Marks {
+		s.Marks[i].Stage = s
+		s.Marks[i].Path = editedPath(s.Marks[i].Path)
+	}
+
+	rewrite(s)
+
+	return nil
+}
+
+// editedPath is where a path typed into the staging file by
+// hand really points
+func editedPath(path string) string {
+	if abs, err := filepath.Abs(expandHome(path)); err == nil {
+		path = abs
+	}
+
+	return staging.CanonicalPath(path)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// execOptions is how the flags say to run commands, with their
+// output going through p (see progress)
+func execOptions(p *progress) *staging.Options {
+	var runner staging.Runner
+
+	switch {
+	case flagSandbox:
+		// it'd be a sandbox around docker or ssh, which is no use
+		if flagDocker != "" || flagHosts != "" || flagRemote {
+			usage("-sandbox is for commands run here, not with -docker, -hosts or -remote")
+		}
+
+		runner = sandbox{}
+	case flagDocker != "":
+		if flagMount != "file" && flagMount != "dir" {
+			usage("-mount is file or dir, not %q", flagMount)
+		}
+
+		runner = staging.Docker{Image: flagDocker, Dir: flagMount == "dir", ReadOnly: flagReadOnly}
+	case flagHosts != "":
+		runner = &staging.Hosts{Hosts: hostList(), Command: strings.Fields(flagSSH), Shared: flagShared}
+	case flagRemote:
+		runner = staging.SSH{Host: flagHost, Command: strings.Fields(flagSSH)}
+	}
+
+	if flagSudo || flagUser != "" {
+		// sudo can't get out of a sandbox, and in a container,
+		// who's root is another matter
+		if flagSandbox || flagDocker != "" {
+			usage("-sudo and -user don't go with -sandbox or -docker")
+		}
+
+		if runner == nil && !flagDryRun {
+			sudoValidate()
+		}
+
+		runner = staging.Sudo{User: flagUser, Runner: runner}
+	}
+
+	return &staging.Options{
+		Runner:    runner,
+		Shell:     flagShell,
+		NoShell:   flagNoShell,
+		Jobs:      flagJobs,
+		Batch:     flagBatch,
+		BatchSize: flagBatchSize,
+		List:      flagList,
+		NullDelim: flagNullDelim,
+		Stdin:     flagStdin,
+		Chdir:     flagChdir,
+		Halt:      flagHalt,
+		Retries:   flagRetries,
+		Backoff:   flagBackoff,
+		Timeout:   flagTimeout,
+		Prefix:    flagPrefixOutput,
+		Quickfix:  flagQuickfix,
+		Print:     flagPrintCommand,
+		DryRun:    flagDryRun,
+		Stdout:    p.wrap(os.Stdout),
+		Stderr:    p.wrap(os.Stderr),
+	}
+}
+
+// whether sudo has been given its password
+var sudoReady = false
+
+// sudoValidate has sudo ask for its password, if it wants one,
+// once and before anything runs, rather than from each command
+// (and several at once, with -j)
+func sudoValidate() {
+	if sudoReady || !isTerminal(os.Stdin) {
+		return
+	}
+
+	cmd := exec.Command("sudo", "-v")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		eprintf("sudo: %s", err)
+		exit(exitFailed)
+	}
+
+	sudoReady = true
+}
+
+// hostList is the hosts -hosts names
+func hostList() []string {
+	hosts := []string{}
+
+	for _, host := range strings.Split(flagHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if len(hosts) == 0 {
+		usage("-hosts names no hosts")
+	}
+
+	return hosts
+}
+
+// execute runs a command across todo (see StagingArea.Exec),
+// with everything mark does around that: the hooks, the progress
+// line, -i, -report (and report, if it's set, gets the same
+// lines), and stopping on SIGINT
+func execute(s *StagingArea, args []string, todo []*Mark, report io.Writer) (completed int, rerr error) {
+	if err := runHook(s, os.Stderr, "pre-exec", args, []string{"MARK_TOTAL=" + strconv.Itoa(len(todo))}); err != nil {
+		eprintf("%s; not running anything", err)
+		return 0, err
+	}
+
+	defer func() {
+		execHook(s, args, todo, completed, rerr)
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	p := newProgress(len(todo))
+	defer p.Finish()
+
+	if flagReport != "" && !flagDryRun {
+		f, err := os.Create(flagReport)
+		hardfail(err)
+
+		defer f.Close()
+
+		if report != nil {
+			report = io.MultiWriter(f, report)
+		} else {
+			report = f
+		}
+	}
+
+	opts := execOptions(p)
+	opts.Interrupt = sigs
+
+	if flagInteractive {
+		opts.Confirm = confirm
+	}
+
+	opts.Done = func(job *staging.Job) {
+		for _, m := range job.Marks {
+			if m.Status != "pending" {
+				markHook(s, opts.Stderr, args, m)
+			}
+		}
+
+		p.Advance(len(job.Marks))
+
+		if report != nil {
+			writeReport(report, job)
+		}
+
+		if job.Err != nil {
+			red := colorCodes["red"]
+
+			if len(job.Marks) == 1 {
+				fmt.Fprintln(opts.Stderr, paint(colorful(os.Stderr), red, fmt.Sprintf("%s: %s", job.Marks[0].Path, job.Err)))
+			} else {
+				fmt.Fprintln(opts.Stderr, paint(colorful(os.Stderr), red, fmt.Sprintf("batch of %d starting at %s: %s", len(job.Marks), job.Marks[0].Path, job.Err)))
+			}
+		}
+	}
+
+	return s.Exec(args, todo, opts)
+}
+
+// runOrder puts marks in the order exec runs them: as staged, or
+// backwards with -reverse, or any old way with -shuffle. The
+// staging area itself stays as it is.
+func runOrder(marks []*Mark) []*Mark {
+	ordered := append([]*Mark{}, marks...)
+
+	switch {
+	case flagShuffle:
+		rand.Shuffle(len(ordered), func(i, j int) {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		})
+	case flagReverse:
+		for i, j := 0, len(ordered)-1; i < j; i, j = i+1, j-1 {
+			ordered[i], ordered[j] = ordered[j], ordered[i]
+		}
+	}
+
+	return ordered
+}
+
+// the terminal, for asking questions when stdin is busy
+var tty *bufio.Reader
+
+// ask prints a question and reads the answer from the terminal
+func ask(format string, args ...interface{}) (string, error) {
+	if tty == nil {
+		f, err := os.Open("/dev/tty")
+		if err != nil {
+			f = os.Stdin
+		}
+
+		tty = bufio.NewReader(f)
+	}
+
+	fmt.Fprintf(os.Stderr, format, args...)
+
+	line, err := tty.ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// confirm asks whether to run a job, returning 'y', 'n' (the
+// default), 'a' (yes to all) or 'q' (quit)
+func confirm(job *staging.Job) byte {
+	what := job.Marks[0].Path
+	if len(job.Marks) > 1 {
+		what = fmt.Sprintf("%d files", len(job.Marks))
+	}
+
+	line, err := ask("run %q on %s? [y/N/a/q] ", strings.Join(job.Inv.Args, " "), what)
+	if err != nil {
+		return 'q'
+	}
+
+	switch strings.ToLower(line) {
+	case "y", "yes":
+		return 'y'
+	case "a", "all":
+		return 'a'
+	case "q", "quit":
+		return 'q'
+	}
+
+	return 'n'
+}
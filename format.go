@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// printJSON writes v to stdout as a line of JSON, for -json
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	hardfail(enc.Encode(v))
+}
+
+// a mark in -json listings, with its number and whether its file
+// is there
+type jsonListed struct {
+	Index  int  `json:"index"`
+	Exists bool `json:"exists"`
+	staging.JSONMark
+}
+
+// listing is marks as they're listed with -json, numbered by
+// index
+func listing(marks []*Mark, index map[*Mark]int) []jsonListed {
+	list := []jsonListed{}
+
+	for _, m := range marks {
+		_, err := os.Lstat(m.Path)
+		list = append(list, jsonListed{index[m], err == nil, m.JSON()})
+	}
+
+	return list
+}
+
+// a tag in -json listings
+type jsonTag struct {
+	Tag   string `json:"tag"`
+	Count int    `json:"count"`
+}
+
+// a named staging area in -json listings
+type jsonArea struct {
+	Name    string `json:"name"`
+	Marks   int    `json:"marks"`
+	Current bool   `json:"current"`
+}
+
+// the -json summary of an exec
+type jsonSummary struct {
+	Completed   int      `json:"completed"`
+	Total       int      `json:"total"`
+	Failed      []string `json:"failed"`
+	Interrupted bool     `json:"interrupted,omitempty"`
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs a git command, returning what it prints
+func git(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %s", strings.Join(args, " "), strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// gitRoot is the top of the git repository we're in
+func gitRoot() (string, error) {
+	out, err := git("", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitPaths runs a git command that lists paths relative to the
+// top of the repository (NUL-delimited, with -z) and returns
+// them as full paths
+func gitPaths(args ...string) ([]string, error) {
+	root, err := gitRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := git(root, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, p := range strings.Split(string(out), "\x00") {
+		if p != "" {
+			paths = append(paths, filepath.Join(root, p))
+		}
+	}
+
+	return paths, nil
+}
+
+// gitStatusPaths returns the files git says are modified (but
+// not staged), staged, or untracked, as asked for. Deleted files
+// are left out, since there's nothing there to run anything on.
+func gitStatusPaths(modified, staged, untracked bool) ([]string, error) {
+	queries := [][]string{}
+
+	if modified {
+		queries = append(queries, []string{"diff", "--name-only", "-z", "--diff-filter=d"})
+	}
+
+	if staged {
+		queries = append(queries, []string{"diff", "--cached", "--name-only", "-z", "--diff-filter=d"})
+	}
+
+	if untracked {
+		queries = append(queries, []string{"ls-files", "--others", "--exclude-standard", "-z"})
+	}
+
+	paths := []string{}
+
+	for _, q := range queries {
+		found, err := gitPaths(q...)
+		if err != nil {
+			return nil, err
+		}
+
+		paths = append(paths, found...)
+	}
+
+	return paths, nil
+}
+
+// gitDiffPaths returns the files changed in a range of
+// revisions, like "main..HEAD" (or "main...HEAD", from where the
+// branch started), leaving out ones deleted along the way
+func gitDiffPaths(revs string) ([]string, error) {
+	return gitPaths("diff", "--name-only", "-z", "--diff-filter=d", revs, "--")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"regexp"
+)
+
+// how much of a file to look at for a NUL before deciding it's
+// binary, like grep does
+const binarySniff = 8192
+
+// grepPaths returns the files under roots (walked as for -r)
+// whose contents match the regexp pat, skipping binary files
+func grepPaths(pat string, roots []string) ([]string, error) {
+	// patterns match within lines, ripgrep-style
+	flags := "(?m)"
+	if flagIgnoreCase {
+		flags = "(?mi)"
+	}
+
+	re, err := regexp.Compile(flags + pat)
+	if err != nil {
+		return nil, err
+	}
+
+	hits := []string{}
+
+	for _, root := range roots {
+		files := []string{root}
+
+		if fi, err := os.Stat(root); err == nil && fi.IsDir() {
+			if files, err = walk(root); err != nil {
+				return nil, err
+			}
+		}
+
+		for _, path := range files {
+			if grepFile(re, path) {
+				hits = append(hits, path)
+			}
+		}
+	}
+
+	return hits, nil
+}
+
+// grepFile reports whether a (non-binary) file's contents match
+func grepFile(re *regexp.Regexp, path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() {
+		return false
+	}
+
+	head := make([]byte, binarySniff)
+	n, _ := io.ReadFull(f, head)
+	if bytes.IndexByte(head[:n], 0) >= 0 {
+		return false
+	}
+
+	rest, err := io.ReadAll(f)
+	if err != nil {
+		return false
+	}
+
+	return re.Match(append(head[:n], rest...))
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// old versions of a staging file are kept in their own directory
+// under stateDir/history, named for when they were replaced
+const historyTime = "20060102T150405.000000000"
+
+var errNoHistory = errors.New("nothing to undo")
+
+// historyDir is where the old versions of the staging file at
+// path go, named like its daemon's socket (see stateName)
+func historyDir(path string) string {
+	return filepath.Join(stateDir(), "history", stateName(path))
+}
+
+// history returns the saved versions of the staging file at
+// path, oldest first
+func history(path string) []string {
+	dir := historyDir(path)
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+
+	ret := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ret = append(ret, filepath.Join(dir, e.Name()))
+		}
+	}
+
+	sort.Strings(ret)
+
+	return ret
+}
+
+// saveHistory keeps a copy of the staging file at path before
+// it's replaced, and throws away all but the last keep copies
+func saveHistory(path string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	dir := historyDir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	saved := filepath.Join(dir, time.Now().UTC().Format(historyTime))
+
+	err = staging.WriteAtomic(saved, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	old := history(path)
+	for len(old) > keep {
+		os.Remove(old[0])
+		old = old[1:]
+	}
+
+	return nil
+}
+
+// Undo puts back the last version of the staging file at path
+// from before it was rewritten, returning when that was. Each
+// undo goes one version further back.
+func Undo(path string) (time.Time, error) {
+	old := history(path)
+	if len(old) == 0 {
+		return time.Time{}, errNoHistory
+	}
+
+	last := old[len(old)-1]
+
+	data, err := ioutil.ReadFile(last)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	err = staging.WriteAtomic(path, func(out io.Writer) error {
+		_, err := out.Write(data)
+		return err
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if err := os.Remove(last); err != nil {
+		return time.Time{}, fmt.Errorf("restored, but couldn't remove %s: %w", last, err)
+	}
+
+	when, _ := time.Parse(historyTime, filepath.Base(last))
+
+	return when, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// hooks run around an exec: pre-exec before anything runs (if it
+// fails, nothing does), post-mark after each mark, and post-exec
+// at the end. A hook is the -pre-exec (and so on) flag, so it can
+// go in the config file or a preset, or else a program with its
+// name in hooksDir.
+func hook(name string) (run string, found bool) {
+	switch name {
+	case "pre-exec":
+		run = flagPreExec
+	case "post-mark":
+		run = flagPostMark
+	case "post-exec":
+		run = flagPostExec
+	}
+
+	if run != "" {
+		return run, true
+	}
+
+	path := filepath.Join(hooksDir(), name)
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Mode()&0111 != 0 {
+		return staging.ShellQuote(path), true
+	}
+
+	return "", false
+}
+
+// hooksDir is the hooks directory next to the config file
+func hooksDir() string {
+	return filepath.Join(filepath.Dir(configPath()), "hooks")
+}
+
+// runHook runs a hook, if there is one, with env (and the name of
+// the hook, the staging file and the command) added to its
+// environment, and its output going to out
+func runHook(s *StagingArea, out io.Writer, name string, args []string, env []string) error {
+	run, found := hook(name)
+	if !found || flagDryRun {
+		return nil
+	}
+
+	shell := flagShell
+	if flagNoShell {
+		shell = "sh"
+	}
+
+	cmd := exec.Command(shell, "-c", run)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.Env = append(os.Environ(),
+		"MARK_HOOK="+name,
+		"MARK_STAGING="+s.Path,
+		"MARK_COMMAND="+strings.Join(args, " "))
+	cmd.Env = append(cmd.Env, env...)
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook: %w", name, err)
+	}
+
+	return nil
+}
+
+// markHook runs the post-mark hook for a mark that just ran
+func markHook(s *StagingArea, out io.Writer, args []string, m *Mark) {
+	env := append(m.Env(), "MARK_STATUS="+m.Status, "MARK_EXIT="+strconv.Itoa(m.Exit))
+	ok(runHook(s, out, "post-mark", args, env))
+}
+
+// execHook runs the post-exec hook, with how the exec went
+func execHook(s *StagingArea, args []string, todo []*Mark, completed int, err error) {
+	failed := 0
+	for _, m := range todo {
+		if m.Ran && m.Status == "failed" {
+			failed++
+		}
+	}
+
+	interrupted := "0"
+	if err == staging.ErrInterrupted {
+		interrupted = "1"
+	}
+
+	ok(runHook(s, os.Stderr, "post-exec", args, []string{
+		"MARK_TOTAL=" + strconv.Itoa(len(todo)),
+		"MARK_COMPLETED=" + strconv.Itoa(completed),
+		"MARK_FAILED=" + strconv.Itoa(failed),
+		"MARK_INTERRUPTED=" + interrupted,
+	}))
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// a line from a .gitignore-style file
+type ignoreRule struct {
+	// the directory the rule's file is in; anchored patterns
+	// are relative to it
+	base string
+
+	// the pattern, split on slashes, for staging.MatchSegments
+	pats []string
+
+	negate  bool
+	dirOnly bool
+}
+
+// the rules in effect for a directory, lowest precedence first
+type ignoreRules []ignoreRule
+
+// parseIgnore reads gitignore syntax: blank lines and "#"
+// comments are skipped, "!" re-includes, a trailing slash
+// matches only directories, a pattern with a slash anywhere else
+// is anchored to base, and one without matches at any depth
+func parseIgnore(base string, r io.Reader) ignoreRules {
+	rules := ignoreRules{}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		rule := ignoreRule{base: base}
+
+		if line[0] == '!' {
+			rule.negate = true
+			line = line[1:]
+		} else if line[0] == '\\' {
+			line = line[1:]
+		}
+
+		if strings.HasSuffix(line, "/") {
+			rule.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+
+		if line == "" {
+			continue
+		}
+
+		anchored := strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+
+		if !anchored {
+			line = "**/" + line
+		}
+
+		rule.pats = strings.Split(line, "/")
+		rules = append(rules, rule)
+	}
+
+	return rules
+}
+
+// readIgnoreFile reads the rules in an ignore file, if it's there
+func readIgnoreFile(path string) ignoreRules {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+
+	defer f.Close()
+
+	return parseIgnore(filepath.Dir(path), f)
+}
+
+// ignored reports whether the rules leave out path; as with git,
+// the last rule to match it decides
+func (rules ignoreRules) ignored(path string, isDir bool) bool {
+	ignored := false
+
+	for _, rule := range rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+
+		rel, err := filepath.Rel(rule.base, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+
+		// like git, a pattern that doesn't parse doesn't match
+		if hit, err := staging.MatchSegments(rule.pats, strings.Split(filepath.ToSlash(rel), "/")); hit && err == nil {
+			ignored = !rule.negate
+		}
+	}
+
+	return ignored
+}
+
+// gitTop finds the top of the git checkout dir is in, if it's in
+// one
+func gitTop(dir string) (string, bool) {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return dir, true
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false
+		}
+
+		dir = parent
+	}
+}
+
+// globalGitIgnore is the user's excludes file: core.excludesFile,
+// or git's default for it
+func globalGitIgnore() string {
+	if out, err := git("", "config", "--path", "--get", "core.excludesFile"); err == nil {
+		if path := strings.TrimSpace(string(out)); path != "" {
+			return expandHome(path)
+		}
+	}
+
+	if dir := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "git", "ignore")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".config", "git", "ignore")
+}
+
+// gitIgnoresAbove returns the git ignore rules that apply to the
+// directory dir from outside it: the global excludes, the
+// checkout's .git/info/exclude, and the .gitignore files in the
+// directories between the top of the checkout and dir
+func gitIgnoresAbove(dir string) ignoreRules {
+	top, found := gitTop(dir)
+	if !found {
+		return nil
+	}
+
+	rules := ignoreRules{}
+
+	for _, r := range readIgnoreFile(globalGitIgnore()) {
+		r.base = top
+		rules = append(rules, r)
+	}
+
+	for _, r := range readIgnoreFile(filepath.Join(top, ".git", "info", "exclude")) {
+		r.base = top
+		rules = append(rules, r)
+	}
+
+	// from the top down
+	above := []string{}
+	for at := dir; at != top; {
+		at = filepath.Dir(at)
+		above = append([]string{at}, above...)
+	}
+
+	for _, at := range above {
+		rules = append(rules, readIgnoreFile(filepath.Join(at, ".gitignore"))...)
+	}
+
+	return rules
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	tests := []struct {
+		rules string
+		path  string
+		isDir bool
+		want  bool
+	}{
+		// without a slash, at any depth
+		{"*.log", "/proj/a.log", false, true},
+		{"*.log", "/proj/sub/deep/a.log", false, true},
+		{"*.log", "/proj/a.txt", false, false},
+		{"tmp", "/proj/sub/tmp", true, true},
+
+		// with one, anchored to where the file is
+		{"/build", "/proj/build", true, true},
+		{"/build", "/proj/sub/build", true, false},
+		{"docs/*.md", "/proj/docs/a.md", false, true},
+		{"docs/*.md", "/proj/sub/docs/a.md", false, false},
+		{"docs/**/*.md", "/proj/docs/x/y/a.md", false, true},
+		{"**/cache", "/proj/a/b/cache", true, true},
+
+		// a trailing slash is only for directories
+		{"build/", "/proj/build", true, true},
+		{"build/", "/proj/build", false, false},
+		{"build/", "/proj/sub/build", true, true},
+
+		// the last rule to match decides
+		{"*.log\n!keep.log", "/proj/keep.log", false, false},
+		{"*.log\n!keep.log", "/proj/other.log", false, true},
+		{"!keep.log\n*.log", "/proj/keep.log", false, true},
+
+		// comments, blank lines, escapes
+		{"# a.txt\n\n", "/proj/a.txt", false, false},
+		{`\#notes`, "/proj/#notes", false, true},
+		{`\!important`, "/proj/!important", false, true},
+		{"a.txt   ", "/proj/a.txt", false, true},
+
+		// nothing outside where the file is
+		{"*.log", "/elsewhere/a.log", false, false},
+		{"*", "/proj", true, false},
+	}
+
+	for _, tt := range tests {
+		rules := parseIgnore("/proj", strings.NewReader(tt.rules))
+
+		if got := rules.ignored(tt.path, tt.isDir); got != tt.want {
+			t.Errorf("%q: ignored(%s, dir=%v) = %v, want %v", tt.rules, tt.path, tt.isDir, got, tt.want)
+		}
+	}
+}
+
+// writeTree makes the files named under dir, with what's in them
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, data := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWalkIgnores(t *testing.T) {
+	dir := t.TempDir()
+
+	writeTree(t, dir, map[string]string{
+		markIgnore:                "*.log\nbuild/\n",
+		"a.txt":                   "",
+		"a.log":                   "",
+		"build/out.txt":           "",
+		"sub/" + markIgnore:       "!keep.log\n/local.txt\n",
+		"sub/keep.log":            "",
+		"sub/drop.log":            "",
+		"sub/local.txt":           "",
+		"sub/deeper/local.txt":    "",
+		"sub/deeper/keep.log":     "",
+		"other/secret.key":        "",
+		"other/notes/secret.key":  "",
+		"other/notes/readme.md":   "",
+		"other/notes/readme.copy": "",
+	})
+
+	defer func(excludes []string) { flagExclude = excludes }(flagExclude)
+
+	tests := []struct {
+		excludes []string
+		want     []string
+	}{
+		{
+			want: []string{
+				markIgnore,
+				"a.txt",
+				"other/notes/readme.copy",
+				"other/notes/readme.md",
+				"other/notes/secret.key",
+				"other/secret.key",
+				"sub/" + markIgnore,
+				"sub/deeper/keep.log",
+				"sub/deeper/local.txt",
+				"sub/keep.log",
+			},
+		},
+		{
+			// and a .markignore can't bring back what these
+			// leave out
+			excludes: []string{"*.key", "*.copy", "keep.log", markIgnore},
+			want: []string{
+				"a.txt",
+				"other/notes/readme.md",
+				"sub/deeper/local.txt",
+			},
+		},
+		{
+			excludes: []string{"/other/"},
+			want: []string{
+				markIgnore,
+				"a.txt",
+				"sub/" + markIgnore,
+				"sub/deeper/keep.log",
+				"sub/deeper/local.txt",
+				"sub/keep.log",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		flagExclude = tt.excludes
+
+		found, err := walk(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, path := range found {
+			rel, _ := filepath.Rel(dir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+
+		sort.Strings(got)
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("with -exclude %q, walk found:\n%q\nwant:\n%q", tt.excludes, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// a job is an exec -bg running (or that ran) in the background,
+// as its journal records it: <id>.json in jobsDir, with its
+// output in <id>.log
+type job struct {
+	ID      int        `json:"id"`
+	PID     int        `json:"pid,omitempty"`
+	Args    []string   `json:"args"`
+	Dir     string     `json:"dir"`
+	Staging string     `json:"staging"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	Exit    *int       `json:"exit,omitempty"`
+}
+
+// the job this mark is, if it's running in the background
+var thisJob *job
+
+func jobsDir() string {
+	return filepath.Join(stateDir(), "jobs")
+}
+
+func jobPath(id int, ext string) string {
+	return filepath.Join(jobsDir(), strconv.Itoa(id)+ext)
+}
+
+// State is how the job is doing: running, done, canceled,
+// failed (exit N), or gone, if it died without saying how it went
+func (j *job) State() string {
+	switch {
+	case j.Exit != nil && *j.Exit == exitOK:
+		return "done"
+	case j.Exit != nil && *j.Exit == exitInterrupted:
+		return "canceled"
+	case j.Exit != nil:
+		return fmt.Sprintf("failed (exit %d)", *j.Exit)
+	case j.PID != 0 && processAlive(j.PID):
+		return "running"
+	case j.PID == 0 && time.Since(j.Started) < 10*time.Second:
+		// not quite started yet
+		return "running"
+	}
+
+	return "gone"
+}
+
+func (j *job) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return staging.WriteAtomic(jobPath(j.ID, ".json"), func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+}
+
+// claim saves a new job under the first ID from j.ID up that
+// isn't taken, so two marks starting jobs at once don't both get
+// the same one
+func (j *job) claim() error {
+	for {
+		f, err := os.OpenFile(jobPath(j.ID, ".json"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			j.ID++
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		f.Close()
+
+		return j.save()
+	}
+}
+
+func readJob(id int) (*job, error) {
+	data, err := os.ReadFile(jobPath(id, ".json"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no job %d (see \"mark jobs\")", id)
+	} else if err != nil {
+		return nil, err
+	}
+
+	j := &job{}
+	return j, json.Unmarshal(data, j)
+}
+
+// allJobs is every job in the journal, oldest first
+func allJobs() ([]*job, error) {
+	entries, err := os.ReadDir(jobsDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret := []*job{}
+
+	for _, e := range entries {
+		id, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+
+		// claimed, but not saved yet (see claim)
+		if fi, err := e.Info(); err == nil && fi.Size() == 0 {
+			continue
+		}
+
+		if j, err := readJob(id); ok(err) {
+			ret = append(ret, j)
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].ID < ret[j].ID })
+
+	return ret, nil
+}
+
+// pickJob is the job args name, or with none, the latest
+func pickJob(args []string) *job {
+	if len(args) > 1 {
+		usage("which job?")
+	}
+
+	if len(args) == 1 {
+		id, err := strconv.Atoi(strings.TrimPrefix(args[0], "%"))
+		if err != nil {
+			usage("bad job %q", args[0])
+		}
+
+		j, err := readJob(id)
+		if err != nil {
+			eprintf("%s", err)
+			exit(exitFailed)
+		}
+
+		return j
+	}
+
+	all, err := allJobs()
+	hardfail(err)
+
+	if len(all) == 0 {
+		eprintf("no jobs")
+		exit(exitFailed)
+	}
+
+	return all[len(all)-1]
+}
+
+// background starts this mark over again as a job, detached,
+// with output to its log, and says how to keep track of it
+func background() {
+	hardfail(os.MkdirAll(jobsDir(), 0700))
+
+	all, err := allJobs()
+	hardfail(err)
+
+	j := &job{ID: 1, Args: os.Args[1:], Staging: flagStagingPath, Started: time.Now()}
+	if len(all) > 0 {
+		j.ID = all[len(all)-1].ID + 1
+	}
+
+	j.Dir, err = os.Getwd()
+	hardfail(err)
+
+	hardfail(j.claim())
+
+	log, err := os.Create(jobPath(j.ID, ".log"))
+	hardfail(err)
+
+	defer log.Close()
+
+	self, err := os.Executable()
+	hardfail(err)
+
+	cmd := exec.Command(self, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = log, log
+	cmd.Env = append(os.Environ(), "MARK_JOB="+strconv.Itoa(j.ID), "MARK_STAGING="+flagStagingPath)
+	cmd.SysProcAttr = detached()
+
+	hardfail(cmd.Start())
+
+	fmt.Printf("job %d started (\"mark logs %d\" for its output, \"mark wait %d\" to wait for it)\n", j.ID, j.ID, j.ID)
+}
+
+// startJob is for a mark started by background: it notes that
+// it's running, and arranges to note how it went when it exits.
+// If it can't, it doesn't run at all: as anything but a job, it
+// would start itself in the background over again.
+func startJob(id string) {
+	n, err := strconv.Atoi(id)
+	if err != nil {
+		hardfail(fmt.Errorf("bad job %q", id))
+	}
+
+	j, err := readJob(n)
+	hardfail(err)
+
+	j.PID = os.Getpid()
+	ok(j.save())
+
+	thisJob = j
+
+	exit = func(code int) {
+		endJob(code)
+		os.Exit(code)
+	}
+}
+
+// endJob records how this job went, if it's a job
+func endJob(code int) {
+	if thisJob == nil {
+		return
+	}
+
+	now := time.Now()
+	thisJob.Ended, thisJob.Exit = &now, &code
+	ok(thisJob.save())
+
+	thisJob = nil
+}
+
+// jobs lists the jobs in the journal
+func jobs() {
+	all, err := allJobs()
+	hardfail(err)
+
+	if flagJSON {
+		type jsonJob struct {
+			*job
+			State string `json:"state"`
+		}
+
+		list := []jsonJob{}
+		for _, j := range all {
+			list = append(list, jsonJob{j, j.State()})
+		}
+
+		printJSON(list)
+		return
+	}
+
+	for _, j := range all {
+		fmt.Printf("%d. %s [%s] mark %s\n", j.ID, j.Started.Local().Format("2006-01-02 15:04"), j.State(), strings.Join(j.Args, " "))
+	}
+}
+
+// logs prints a job's output so far; with -watch, it keeps
+// printing it as it comes, until the job's over
+func logs(j *job) {
+	f, err := os.Open(jobPath(j.ID, ".log"))
+	hardfail(err)
+
+	defer f.Close()
+
+	for {
+		// whatever it wrote before it was over still gets printed
+		running := flagWatch && j.State() == "running"
+
+		_, err := io.Copy(os.Stdout, f)
+		hardfail(err)
+
+		if !running {
+			return
+		}
+
+		time.Sleep(250 * time.Millisecond)
+
+		j, err = readJob(j.ID)
+		hardfail(err)
+	}
+}
+
+// waitJob waits for a job to finish, and exits as it did
+func waitJob(j *job) {
+	for j.State() == "running" {
+		time.Sleep(250 * time.Millisecond)
+
+		var err error
+
+		j, err = readJob(j.ID)
+		hardfail(err)
+	}
+
+	if j.Exit == nil {
+		eprintf("job %d is gone", j.ID)
+		exit(exitFailed)
+	}
+
+	exit(*j.Exit)
+}
+
+// cancel interrupts a job, as ^C would: it starts nothing more,
+// and lets what's running finish; a second cancel kills that
+func cancel(j *job) {
+	if j.State() != "running" || j.PID == 0 {
+		eprintf("job %d isn't running", j.ID)
+		exit(exitFailed)
+	}
+
+	hardfail(interruptProcess(j.PID))
+}
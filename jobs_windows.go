@@ -0,0 +1,44 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// DETACHED_PROCESS, which syscall doesn't have
+const detachedProcess = 0x00000008
+
+// detached is how a job starts: without a console, so it's free
+// of the one we're in
+func detached() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP | detachedProcess}
+}
+
+// processAlive reports whether there's a process pid
+func processAlive(pid int) bool {
+	h, err := syscall.OpenProcess(syscall.PROCESS_QUERY_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+
+	defer syscall.CloseHandle(h)
+
+	var code uint32
+	if err := syscall.GetExitCodeProcess(h, &code); err != nil {
+		return false
+	}
+
+	// STILL_ACTIVE
+	return code == 259
+}
+
+// interruptProcess stops pid; there's no sending a ^C to a
+// detached process here, so it's killed outright
+func interruptProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+
+	return p.Kill()
+}
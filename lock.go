@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrLockHeld is returned by Lock when another mark has the
+// staging area
+var ErrLockHeld = errors.New("staging area is in use by another mark (-wait to wait for it, -nolock to go ahead anyway)")
+
+// the lock files this mark holds, so that taking one again (exec
+// -watch in the shell, say) doesn't wait on itself forever
+var (
+	held     = map[string]bool{}
+	heldLock sync.Mutex
+)
+
+// Lock keeps other marks from changing the staging file at
+// path until this one exits, or calls unlock. The lock is on a
+// file alongside it, since Rewrite replaces the staging file
+// rather than writing into it.
+func Lock(path string, wait bool) (unlock func(), err error) {
+	lock := sidecar(path, ".lock")
+
+	heldLock.Lock()
+	defer heldLock.Unlock()
+
+	if held[lock] {
+		return func() {}, nil
+	}
+
+	f, err := os.OpenFile(lock, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// held (and the file left open) until we exit, or unlock
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	held[lock] = true
+
+	return func() {
+		heldLock.Lock()
+		defer heldLock.Unlock()
+
+		delete(held, lock)
+		f.Close()
+	}, nil
+}
+
+// sidecar is the hidden file next to the staging file at path
+// that mark keeps something in: the lock, so /proj/.mark-staging's
+// is /proj/.mark-staging.lock. (What others mustn't get at, the
+// daemon's socket and mark serve's token, goes in stateDir; see
+// daemonSocket and serveToken.)
+func sidecar(path, ext string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	return filepath.Join(filepath.Dir(path), "."+strings.TrimPrefix(filepath.Base(path), ".")+ext)
+}
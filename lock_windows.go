@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// no flock here; concurrent marks are on their own
+func lockFile(f *os.File, wait bool) error {
+	return nil
+}
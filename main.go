@@ -5,15 +5,19 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
-	"path"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/tqbf/mark/staging"
 )
 
 var (
@@ -32,25 +36,379 @@ var (
 	// -dry, print but don't execute commands
 	flagDryRun = false
 
-	// -tag foo, apply commands only to files tagged "foo"
+	// -noshell, run commands directly rather than with sh -c
+	flagNoShell = false
+
+	// -shell zsh, run commands with zsh -c rather than sh -c
+	// ($MARK_SHELL works too); "-shell none" is -noshell
+	flagShell = "sh"
+
+	// -cd, run each command in the directory of its file
+	flagChdir = false
+
+	// -invert, "select" keeps (and "tagif" tags) the files the
+	// command fails on
+	flagInvert = false
+
+	// -stdin, feed each file to its command's stdin
+	flagStdin = false
+
+	// -H (or -prefix), prefix each line of output with the
+	// path of the file it came from
+	flagPrefixOutput = false
+
+	// -report results.jsonl, write a JSON line per mark exec'd
+	flagReport = ""
+
+	// -q, don't show exec progress
+	flagQuiet = false
+
+	// -i, ask before running each command
+	flagInteractive = false
+
+	// -j 4, run up to 4 commands at once
+	flagJobs = 1
+
+	// -all, exec runs one command with every path in place of _
+	flagBatch = false
+
+	// -n 100, with -all, at most 100 paths per command
+	flagBatchSize = 0
+
+	// -timeout 30s, kill commands that run longer than 30s
+	flagTimeout time.Duration
+
+	// -halt, stop exec at the first command that fails
+	flagHalt = false
+
+	// -retries 3, try failed commands up to 3 more times
+	flagRetries = 0
+
+	// -backoff 1s, wait 1s before the first retry, doubling
+	// for each one after
+	flagBackoff = time.Second
+
+	// -keep-failed, after a partly failed exec, clear the
+	// marks that succeeded and keep the rest
+	flagKeepFailed = false
+
+	// -tagfailed, tag marks whose command failed "failed"
+	flagTagFailed = false
+
+	// -list, exec runs one command with every path on its stdin
+	flagList = false
+
+	// -by count, sort listings by count (or name)
+	flagSortBy = ""
+
+	// -0, paths read from stdin are NUL-delimited (find -print0),
+	// as are the paths written to a -list command
+	flagNullDelim = false
+
+	// -tag foo, apply commands only to files tagged "foo"; or
+	// -tag 'photos and not (done or skip)'; or with several,
+	// -tag photos -tag '!done', files matching all of them
 	flagTagMatch = ""
 
+	// -only failed, apply commands only to files whose last
+	// run failed (or pending, or done)
+	flagOnlyStatus = ""
+
+	// -match '*.go', apply commands only to files matching a pattern
+	flagPathMatch = ""
+
+	// -re, patterns are regexps against the full path, not globs
+	flagRegexp = false
+
+	// -l, long listings: status shows what's known about each
+	// file (size, mtime, attributes, when it was added), in
+	// columns
+	flagLong = false
+
+	// -remove, pick chooses marks to remove rather than files
+	// to add
+	flagPickRemove = false
+
+	// -pre-exec, -post-mark and -post-exec, commands to run
+	// before an exec, after each mark and after the exec (see
+	// hook)
+	flagPreExec  = ""
+	flagPostMark = ""
+	flagPostExec = ""
+
+	// -notify, say when an exec is done, on the desktop or (with
+	// -webhook) by posting a JSON summary to a URL
+	flagNotify  = false
+	flagWebhook = ""
+
+	// -no-pager, don't send long status listings through $PAGER
+	flagNoPager = false
+
+	// -sort size, status lists marks in this order (name, size,
+	// mtime or ext; -reverse for backwards), keeping their numbers
+	flagStatusSort = ""
+
+	// -wait, if another mark has the staging area, wait for it
+	// rather than giving up
+	flagWait = false
+
+	// -nolock, don't lock the staging area at all
+	flagNoLock = false
+
+	// -quickfix, list marks and exec output as quickfix entries,
+	// file:line:col: message
+	flagQuickfix = false
+
+	// -nodaemon, do it here even if a daemon is running
+	flagNoDaemon = false
+
+	// -bg, exec as a job in the background (see jobs)
+	flagBackground = false
+
+	// -watch, exec on each mark again whenever it changes
+	flagWatch = false
+
+	// -poll, how often watch (and exec -watch) look for changes
+	flagPoll = time.Second
+
+	// -autotag, the tag watch gives the files it adds
+	flagAutoTag = ""
+
+	// -remote, exec marks on remote hosts (host:/path) there
+	flagRemote = false
+
+	// -host, add paths as remote ones on this host, and with
+	// -remote, exec the marks that aren't remote there too
+	flagHost = ""
+
+	// -ssh, how -remote gets to a host
+	flagSSH = "ssh -o BatchMode=yes"
+
+	// -hosts a,b,c, farm exec out to these hosts, over ssh
+	flagHosts = ""
+
+	// -shared, with -hosts, files are already there at the
+	// same paths, so there's no copying them over
+	flagShared = false
+
+	// -docker image, exec in containers from this image
+	flagDocker = ""
+
+	// -mount, with -docker, what of each mark's to mount in:
+	// "file" or "dir"
+	flagMount = "file"
+
+	// -ro, with -docker, mount marks read-only
+	flagReadOnly = false
+
+	// -sandbox, exec commands that can only write where their
+	// marks are, and can't use the network
+	flagSandbox = false
+
+	// -sudo, exec commands as root, with sudo
+	flagSudo = false
+
+	// -user, exec commands as this user, with sudo
+	flagUser = ""
+
+	// -listen, where "mark serve" serves
+	flagListen = "127.0.0.1:7777"
+
+	// -force, rewrite the staging file even if it changed
+	// since we read it
+	flagForce = false
+
+	// -history 20, how many old versions of the staging file
+	// to keep for "undo"
+	flagHistory = 20
+
+	// -local, use the project's .mark-staging, found by looking
+	// up from the current directory ($MARK_LOCAL sets the default)
+	flagLocal = false
+
+	// -r, add adds what's in directories rather than the
+	// directories themselves
+	flagRecursive = false
+
+	// -gitignore, recursive adds skip what git would ignore
+	flagGitignore = false
+
+	// -exclude '*.tmp', recursive adds skip what matches (in
+	// gitignore syntax, relative to what's being added); repeat
+	// for more
+	flagExclude = []string{}
+
+	// -grep 'TODO', add adds the files under the directories
+	// it's given (or here) whose contents match the regexp
+	flagGrep = ""
+
+	// -ignore-case, -grep matches regardless of case
+	flagIgnoreCase = false
+
+	// -type f, what recursive adds stage: f (plain files), d
+	// (directories), l (symlinks), or several, like "fl"; by
+	// default, anything but directories
+	flagType = ""
+
+	// -ext jpg,png, recursive adds stage only files ending in
+	// one of these
+	flagExt = ""
+
+	// -glob 'IMG_*', recursive adds stage only files whose names
+	// match (it'd be -name, but that's taken)
+	flagGlob = ""
+
+	// -newer 2d, -older 2024-01-01, recursive adds stage only
+	// files modified since (or before) then
+	flagNewer = ""
+	flagOlder = ""
+
+	// -min-size 10M, -max-size 1G, recursive adds stage only
+	// files at least (or at most) that big
+	flagMinSize = ""
+	flagMaxSize = ""
+
+	// -maxdepth 2, recursive adds go only this many directories
+	// down (1 is just what's in the directory)
+	flagMaxDepth = -1
+
+	// -follow, recursive adds follow symlinks to directories
+	flagFollow = false
+
+	// -resolve, add stages files by their real paths, with
+	// symlinks resolved, so nothing gets staged twice
+	flagResolve = false
+
+	// -reverse, exec runs commands on the last mark first
+	flagReverse = false
+
+	// -shuffle, exec runs commands on marks in random order
+	flagShuffle = false
+
+	// -json, listings (status, tags, areas) and exec's summary
+	// are JSON on stdout
+	flagJSON = false
+
+	// -print0, list ends paths with NULs, for xargs -0
+	flagPrint0 = false
+
+	// -tree, status shows marks as a tree of their directories
+	flagTree = false
+
+	// -color always, color status and exec output: always,
+	// never, or auto (when it's going to a terminal)
+	flagColor = "auto"
+
+	// -git-modified, -git-staged, -git-untracked, add adds the
+	// files in the current git repository that are
+	flagGitModified  = false
+	flagGitStaged    = false
+	flagGitUntracked = false
+
+	// -git-diff main..HEAD, add adds the files changed between
+	// those revisions
+	flagGitDiff = ""
+
 	// -staging ~/.other-staging, use different staging area
-	flagStagingPath = "~/.mark-staging"
+	// (the default's in stateDir)
+	flagStagingPath = ""
+
+	// -format json, store the staging area as a JSON document
+	// rather than lines ("text"); by default, keep whichever the
+	// file is already in
+	flagFormat = ""
+
+	// -name photos, use the named staging area "photos" in areaDir
+	flagAreaName = ""
+
+	// where named staging areas live (under stateDir)
+	areaDir = ""
 
 	availableCommands = `Available commands:
-  add <files>
-  exec (like, exec cp _ .)
+  add <files> (-r for what's in directories; --grep <regexp> [dirs]; or - to read them from stdin, or --git-modified, --git-staged, --git-untracked, --git-diff <rev1>..<rev2>; host:/path, or -host, for files elsewhere)
+  exec (like, exec cp _ .; -watch to run again on files as they change; -bg to run as a job; -remote to run on the hosts of host:/path marks, over ssh; -hosts a,b,c to spread the work over them; -docker <image> to run in containers; -sandbox to fence them in; -sudo or -user <name> to run as someone else)
   tag <tag> (files)
-  remove (files)
+  untag <tag> (files)
+  tag-rename <old> <new>
+  tag-rm <tag>
+  remove (files, or @tag, or #index)
+  set <key>=<value> (files) (use it as _.attr.key)
+  capture <key> <cmd> (save the command's output as _.attr.key)
+  tagif <tag> <cmd> (tag files the command succeeds on)
+  select <cmd> (keep only files the command succeeds on)
+  run <preset> (exec a command from the config file)
+  script (like exec, but print a shell script to run later)
+  retry (re-run the last exec on marks that failed)
+  resume (finish an interrupted exec)
+  verify (check for files changed since they were added)
+  dedupe [tag] (drop marks for files with the same contents as an earlier one, or tag them dup:<hash>)
+  sort (-by name, size, mtime or ext; -r or -reverse to reverse)
+  move <from> <to> (move a mark, by index, to run earlier or later)
+  prune (drop marks for files that are gone)
+  refresh [root] (find moved files by their contents)
+  export (write the staging area to stdout, as JSON)
+  import [file] (add marks from an export, or stdin)
+  merge <staging file> (add in the marks from another staging area)
+  intersect <file> (keep only marks also in a staging file or path list)
+  subtract <file> (drop marks that are in a staging file or path list)
+  undo (put the staging area back how it was before the last change)
+  list (just the paths, for $(mark list); -print0 for xargs -0; -quickfix for an editor)
+  path <n> (just the nth path, counting from 0, of the marks selected)
+  stats (how many marks, how much data, by extension and tag)
+  status (-l for details in columns, -tree for a tree, -sort name, size, mtime or ext)
+  tags (list tags, with how many files have each)
+  edit (open the staging file in $EDITOR, and check it over afterwards)
+  pick [root] (choose files under root to add, with fzf if it's there; -remove to choose marks to drop)
+  completion bash|zsh|fish (print a script for tab completion)
+  shell (a prompt to run one command after another, with tab completion)
+  jobs (list exec -bg jobs, running and done)
+  logs [job] (print a job's output, or the latest one's; -watch to follow it)
+  wait [job] (wait for a job to finish, and exit as it did)
+  cancel [job] (stop a job, like ^C would; again to kill what it's running)
+  watch [dirs] (add new files under dirs, or staged directories, as they show up; -autotag to tag them)
+  daemon (keep the staging area loaded, and do add, remove, tag, untag, exec, status and list for other marks)
+  serve (answer HTTP requests to list, add, remove, tag and exec marks, on -listen, for clients with the token it writes)
+  ui (pick through marks full-screen to remove, tag, untag or exec them)
+  areas
   -help
+
+In a command to exec, _ is the path wherever it isn't part of a word, as
+in "s/_/-/g" and "tr _ -" too: write __ for a plain _ there. (_.base,
+_.dir, _.stem, _.ext, _.n, _.total and _.attr.<key> are the rest.)
+
+Any other command runs mark-<command> from the PATH, if there is one.
+
+Exits 0 if all went well, 1 if commands failed, 2 for bad usage, 3 for staging area trouble.
 `
 )
 
+// what mark exits with, so scripts can tell what happened: 1
+// when commands exec ran failed (or anything else went wrong),
+// 2 for bad usage (flags, arguments, patterns), 3 when the
+// staging area can't be read, written or locked, and 130 when
+// an exec is interrupted
+const (
+	exitOK          = 0
+	exitFailed      = 1
+	exitUsage       = 2
+	exitStaging     = 3
+	exitInterrupted = 130
+)
+
+// exit is os.Exit, except in "mark shell", where it just ends
+// the command
+var exit = os.Exit
+
 func eprintf(format string, args ...interface{}) {
 	fmt.Fprintf(os.Stderr, format+"\n", args...)
 }
 
+// usage complains about how mark was run, and exits
+func usage(format string, args ...interface{}) {
+	eprintf(format, args...)
+	exit(exitUsage)
+}
+
 func ok(err error) bool {
 	if err != nil {
 		eprintf("unexpected error: %s", err)
@@ -62,395 +420,1535 @@ func ok(err error) bool {
 func hardfail(err error) {
 	if err != nil {
 		eprintf("untenable error: %s", err)
-		os.Exit(1)
+		exit(exitCode(err))
 	}
 }
 
-type Mark struct {
-	Path string
-	Tags []string
-
-	Stage *StagingArea
-}
-
-type StagingArea struct {
-	Marks []Mark
-	path  string
-}
-
-func (s *StagingArea) Output(out []byte) {
-	// for now, but something smarter when parallel
-	os.Stdout.Write(out)
+// stagingError is a problem with the staging file itself
+type stagingError struct {
+	err error
 }
 
-// the crap we write at the top of every staging file
-func prefix(out io.Writer) {
-	cmd := strings.Trim(
-		filepath.Base(os.Args[0])+
-			" "+
-			strings.Join(os.Args[1:], " "), " ")
-
-	fmt.Fprintf(out, `
-# this file was automatically created by "%s"
-# you can edit it and mark will still work properly, but
-# mark will happily overwrite it as well.
+func (e *stagingError) Error() string { return e.err.Error() }
+func (e *stagingError) Unwrap() error { return e.err }
 
-`, strings.Trim(cmd, " "))
+// stagingErr marks err, if there is one, as a stagingError
+func stagingErr(err error) error {
+	if err == nil {
+		return nil
+	}
 
+	return &stagingError{err}
 }
 
-// create an empty staging file
-func createStaging(path string) (*StagingArea, error) {
-	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
-	if err != nil {
-		return nil, err
+// exitCode is what mark exits with after err
+func exitCode(err error) int {
+	var se *stagingError
+
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, staging.ErrInterrupted):
+		return exitInterrupted
+	case errors.Is(err, staging.ErrBadPattern):
+		return exitUsage
+	case errors.Is(err, staging.ErrStagingMissing),
+		errors.Is(err, staging.ErrChanged),
+		errors.Is(err, ErrLockHeld),
+		errors.As(err, &se):
+		return exitStaging
 	}
 
-	prefix(f)
-
-	f.Close()
-
-	return &StagingArea{path: path}, nil
+	return exitFailed
 }
 
+// mark's staging areas are the staging package's
+type (
+	StagingArea = staging.Area
+	Mark        = staging.Mark
+)
+
 // GetStagingArea reads and parses the staging file, or creates and returns
 // a new one if none exists
 func GetStagingArea(path string) (*StagingArea, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if os.IsNotExist(err) && flagCreateStaging {
-			return createStaging(path)
-		} else {
-			hardfail(err)
-		}
+	stage, err := staging.Load(path)
+	if errors.Is(err, staging.ErrStagingMissing) && flagCreateStaging {
+		stage, err = staging.Create(path, flagFormat == "json")
 	}
 
-	defer f.Close()
+	return stage, stagingErr(err)
+}
 
-	reader := bufio.NewReader(f)
+// rewrite dumps the current parsed staging area back to disk
+func rewrite(s *StagingArea) {
+	switch flagFormat {
+	case "json":
+		s.JSON = true
+	case "text":
+		s.JSON = false
+	}
 
-	ret := &StagingArea{path: path}
+	if !flagForce {
+		err := s.Unchanged()
+		if err == staging.ErrChanged {
+			err = fmt.Errorf("%w (another mark, or an editor?); not overwriting it (-force to anyway)", err)
+		}
 
-	for {
-		if line, eof := reader.ReadString('\n'); eof != nil {
-			break
-		} else if line[0] == '\n' || line[0] == ' ' || line[0] == '#' {
-			continue
-		} else {
-			toks := strings.Fields(line)
+		hardfail(err)
+	}
 
-			ret.Marks = append(ret.Marks, Mark{
-				Stage: ret,
-				Path:  toks[0],
-				Tags:  toks[1:],
-			})
-		}
+	if !ok(saveHistory(s.Path, flagHistory)) {
+		eprintf("couldn't save the old staging file; \"undo\" won't get it back")
 	}
 
-	return ret, nil
+	hardfail(stagingErr(s.Save()))
 }
 
-// Remove removes all files from the staging area whose
-// basename matches the glob pattern
-// BUG(tqbf): this sucks, do something better than basename
-func (s *StagingArea) Remove(glob string) int {
-	newMarks := []Mark{}
-	killed := 0
-
-	for _, m := range s.Marks {
-		hit, _ := filepath.Match(glob, path.Base(m.Path))
-		if !hit {
-			newMarks = append(newMarks, m)
-		} else {
-			killed++
-		}
+// add adds a path to the staging area, reporting whether it's new
+func add(stage *StagingArea, path string) bool {
+	added, err := stage.Add(path)
+	ok(err)
+
+	return added
+}
+
+// selectMarks is the marks that -tag, -path and -status select
+// (see StagingArea.Select)
+func selectMarks(stage *StagingArea) []*Mark {
+	marks, err := stage.Select(flagTagMatch, flagPathMatch, flagOnlyStatus)
+	if err != nil {
+		eprintf("%s", err)
+		exit(exitCode(err))
 	}
 
-	s.Marks = newMarks
+	return marks
+}
+
+// matching is the marks matching pat (see StagingArea.Matching)
+func matching(stage *StagingArea, pat string) []*Mark {
+	marks, err := stage.Matching(pat)
+	if err != nil {
+		eprintf("%s", err)
+		exit(exitCode(err))
+	}
 
-	return killed
+	return marks
 }
 
-// Add adds a path to the staging area. If -preserve isn't
-// set, adding a directory that is a parent to other files
-// already in the staging area replaces those files with the
-// directory itself.
-// BUG(tqbf): make directory walks work
-func (s *StagingArea) Add(path string) bool {
-	path, err := filepath.Abs(path)
-	if !ok(err) {
-		return false
+// readPaths reads newline-delimited paths (as from find or fd)
+// from r, skipping blank lines; with -0, paths are delimited by
+// NULs instead and taken verbatim
+func readPaths(r io.Reader) []string {
+	delim := byte('\n')
+	if flagNullDelim {
+		delim = 0
 	}
 
-	newDir := strings.HasSuffix(path, "/")
-	kill := map[int]bool{}
+	paths := []string{}
 
-	for i, m := range s.Marks {
-		// same as staged path, do nothing
-		if m.Path == path {
-			return false
-		}
+	reader := bufio.NewReader(r)
 
-		oldDir := strings.HasSuffix(m.Path, "/")
+	for {
+		line, err := reader.ReadString(delim)
+		line = strings.TrimSuffix(line, string(delim))
 
-		// file already referenced by staged dir, do nothing
-		if oldDir && strings.HasPrefix(path, m.Path) {
-			return false
+		if !flagNullDelim {
+			line = strings.TrimRight(line, "\r")
 		}
 
-		// path contained under new directory, no longer
-		// need specific mark
-		if newDir && strings.HasPrefix(m.Path, path) {
-			if !flagPreserveSubdirs {
-				kill[i] = true
-			}
+		if line != "" {
+			paths = append(paths, line)
 		}
-	}
-
-	newMark := []Mark{}
 
-	for i, m := range s.Marks {
-		if !kill[i] {
-			newMark = append(newMark, m)
+		if err == io.EOF {
+			break
 		}
-	}
 
-	newMark = append(newMark, Mark{
-		Stage: s,
-		Path:  path,
-	})
+		hardfail(err)
+	}
 
-	s.Marks = newMark
+	return paths
+}
 
-	return true
+// expandHome replaces ~ in a path with $HOME
+func expandHome(p string) string {
+	return strings.Replace(p, "~", os.Getenv("HOME"), -1)
 }
 
-// Exec executes a command for a mark (unless -dry is set, in which
-// case just print the command)
-func (m *Mark) Exec(args []string) (err error) {
-	nargs := []string{}
+// areaPath returns the staging file for a named staging area,
+// creating the directory that holds them if need be
+func areaPath(name string) string {
+	if name == "" || strings.ContainsAny(name, "/\\") || name[0] == '.' {
+		usage("bad staging area name: %q", name)
+	}
+
+	dir := expandHome(areaDir)
+	hardfail(os.MkdirAll(dir, 0700))
 
-	for _, arg := range args {
-		switch arg {
-		case "_":
-			nargs = append(nargs, m.Path)
+	return filepath.Join(dir, name)
+}
 
-		case "_.base":
-			nargs = append(nargs, path.Base(m.Path))
+// the per-project staging file -local looks for
+const localStaging = ".mark-staging"
 
-		case "_.dir":
-			nargs = append(nargs, path.Dir(m.Path))
+// localStagingPath finds the project's staging file, the way git
+// finds .git: the closest .mark-staging in the current directory
+// or above it. If there isn't one, it'll be in the current
+// directory.
+func localStagingPath() string {
+	cwd, err := os.Getwd()
+	hardfail(err)
 
-		default:
-			nargs = append(nargs, arg)
+	for dir := cwd; ; {
+		path := filepath.Join(dir, localStaging)
+		if _, err := os.Stat(path); err == nil {
+			return path
 		}
-	}
-
-	args = nargs
 
-	if flagDryRun || flagPrintCommand {
-		fmt.Printf("sh -c %s\n", strings.Join(args, " "))
-		if flagDryRun {
-			return nil
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
 		}
+
+		dir = parent
 	}
 
-	cmd := exec.Command("sh", "-c", strings.Join(args, " "))
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return err
+	return filepath.Join(cwd, localStaging)
+}
+
+// areas lists the named staging areas and how many marks
+// each holds; the one in use is starred
+func areas() {
+	entries, err := ioutil.ReadDir(expandHome(areaDir))
+	if err != nil && !os.IsNotExist(err) {
+		hardfail(err)
 	}
 
-	m.Stage.Output(out)
+	list := []jsonArea{}
 
-	return nil
-}
+	for _, e := range entries {
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
 
-// Rewrite dumps the current parsed staging area back to disk
-func (s *StagingArea) Rewrite() {
-	f, err := ioutil.TempFile("", "mark")
-	hardfail(err)
+		path := filepath.Join(expandHome(areaDir), e.Name())
 
-	prefix(f)
+		stage, err := GetStagingArea(path)
+		if !ok(err) {
+			continue
+		}
 
-	for _, m := range s.Marks {
-		io.WriteString(f, m.Path)
+		if flagJSON {
+			list = append(list, jsonArea{e.Name(), len(stage.Marks), path == flagStagingPath})
+			continue
+		}
 
-		for _, t := range m.Tags {
-			io.WriteString(f, " "+t)
+		cur := " "
+		if path == flagStagingPath {
+			cur = "*"
 		}
 
-		io.WriteString(f, "\n")
+		fmt.Printf("%s %s (%d)\n", cur, e.Name(), len(stage.Marks))
 	}
 
-	fn := f.Name()
-	f.Close()
-
-	hardfail(os.Rename(fn, s.path))
+	if flagJSON {
+		printJSON(list)
+	}
 }
 
-// Exec executes the command "args" across all files in the
-// staging area; if tag is nonempty, only files matching tag
-// are acted on
-func (s *StagingArea) Exec(args []string, tag string) (completed int, rerr error) {
-	for _, m := range s.Marks {
-		if tag != "" {
-			f := false
-			for _, t := range m.Tags {
-				if t == tag {
-					f = true
-					break
-				}
-			}
+// tags lists every tag in the staging area and how many marks
+// have it, by name, or with -by count, most used first
+func tags(stage *StagingArea) {
+	counts := map[string]int{}
+	names := []string{}
 
-			if !f {
-				continue
+	for _, m := range stage.Marks {
+		for _, t := range m.Tags {
+			if counts[t] == 0 {
+				names = append(names, t)
 			}
-		}
 
-		err := m.Exec(args)
-		if !ok(err) {
-			rerr = err
-		} else {
-			completed += 1
+			counts[t]++
 		}
 	}
 
-	return completed, rerr
-}
+	sort.Slice(names, func(i, j int) bool {
+		if flagSortBy == "count" && counts[names[i]] != counts[names[j]] {
+			return counts[names[i]] > counts[names[j]]
+		}
 
-// Tag adds a tag to all files in the staging area whose
-// basenmae matches pat. If "pat" is empty, all files are
-// tagged, which might make sense if you're going to build
-// up staging area incrementally.
-// BUG(tqbf): again with this stupid basename stuff
-func (m *Mark) Tag(pat, tag string) bool {
-	hit, _ := filepath.Match(pat, path.Base(m.Path))
-	if pat == "" || hit {
-		for _, t := range m.Tags {
-			if t == tag {
-				return false
-			}
+		return names[i] < names[j]
+	})
+
+	if flagJSON {
+		list := []jsonTag{}
+		for _, t := range names {
+			list = append(list, jsonTag{t, counts[t]})
 		}
 
-		m.Tags = append(m.Tags, tag)
-		return true
+		printJSON(list)
+		return
 	}
 
-	return false
+	for _, t := range names {
+		fmt.Printf("%d %s\n", counts[t], t)
+	}
 }
 
 func status(stage *StagingArea) {
 	eprintf(availableCommands)
 
-	for i, m := range stage.Marks {
-		fmt.Printf("%d. %s %v\n", i, m.Path, m.Tags)
+	// listed in some other order, they keep their numbers
+	index := map[*Mark]int{}
+	order := []*Mark{}
+
+	for i := range stage.Marks {
+		index[&stage.Marks[i]] = i
+		order = append(order, &stage.Marks[i])
 	}
 
-}
+	if flagStatusSort != "" {
+		before, err := staging.OrderBy(flagStatusSort, flagReverse)
+		hardfail(err)
 
-func main() {
-	flag.BoolVar(&flagCreateStaging, "create", flagCreateStaging, "allow mark to create staging area")
-	flag.BoolVar(&flagPreserveSubdirs, "preserve", flagPreserveSubdirs, "preserve subdirectories underneath newly added directory")
-	flag.BoolVar(&flagRetainMark, "retain", flagRetainMark, "retain mark after execution")
-	flag.BoolVar(&flagPrintCommand, "v", flagPrintCommand, "print commands before running")
-	flag.BoolVar(&flagDryRun, "dry", flagDryRun, "print commands before running and don't run")
-	flag.StringVar(&flagTagMatch, "tag", flagTagMatch, "match based on specified tag, not paths")
-	flag.StringVar(&flagStagingPath, "staging", flagStagingPath, fmt.Sprintf("staging file (default: %s)", flagStagingPath))
+		sort.SliceStable(order, func(i, j int) bool {
+			return before(order[i], order[j])
+		})
+	}
 
-	flag.Parse()
+	defer startPager()()
 
-	flagStagingPath = strings.Replace(flagStagingPath, "~", os.Getenv("HOME"), -1)
+	if flagJSON {
+		printJSON(listing(order, index))
+		return
+	}
 
-	stage, err := GetStagingArea(flagStagingPath)
-	hardfail(err)
+	if flagLong {
+		statusLong(order, index)
+		return
+	}
 
-	if len(flag.Args()) == 0 {
-		status(stage)
+	if flagTree {
+		statusTree(order, index)
 		return
 	}
 
-	switch flag.Arg(0) {
-	case "+":
-		fallthrough
-	case "add":
-		added := 0
+	on := colorful(os.Stdout)
 
-		paths := flag.Args()[1:]
+	for _, m := range order {
+		fmt.Printf("%d. %s %s", index[m], paint(on, pathColor(m.Path), m.Path), paintTags(on, m.Tags))
 
-		for _, path := range paths {
-			if stage.Add(path) {
-				added++
-			}
+		for _, k := range m.AttrKeys() {
+			fmt.Printf(" %s=%q", k, m.Attrs[k])
 		}
 
-		if added > 0 {
-			stage.Rewrite()
+		if state := describeStatus(m); state != "" {
+			fmt.Printf(" %s", paint(on, statusColor(m.Status), state))
 		}
 
-	case "remove":
-		removed := 0
+		fmt.Printf("\n")
+	}
 
-		paths := flag.Args()[1:]
+}
 
-		if len(paths) == 0 {
-			removed = len(stage.Marks)
-			stage.Marks = []Mark{}
-		} else {
-			for _, path := range paths {
-				removed += stage.Remove(path)
+// quickfixAbout is what list -quickfix says about a mark: its
+// tags and status, or just that it's marked
+func quickfixAbout(m *Mark) string {
+	about := describeStatus(m)
+	if len(m.Tags) > 0 {
+		about = strings.TrimSpace("[" + strings.Join(m.Tags, " ") + "] " + about)
+	}
+
+	if about == "" {
+		return "marked"
+	}
+
+	return about
+}
+
+// describeStatus is how a mark's status reads in a listing
+func describeStatus(m *Mark) string {
+	switch {
+	case m.Status == "":
+		return ""
+	case m.When.IsZero():
+		return m.Status
+	default:
+		return fmt.Sprintf("%s (exit %d, %s)", m.Status, m.Exit, m.When.Local().Format("2006-01-02 15:04"))
+	}
+}
+
+// statusLong is status -l: like ls -l, with what's known about
+// the files lined up in columns
+func statusLong(order []*Mark, index map[*Mark]int) {
+	const when = "2006-01-02 15:04"
+
+	on := colorful(os.Stdout)
+
+	rows := [][]cell{{
+		plainCell("#"), plainCell("SIZE"), plainCell("MODIFIED"), plainCell("PATH"),
+		plainCell("TAGS"), plainCell("ATTRS"), plainCell("STATUS"), plainCell("ADDED"),
+	}}
+
+	for _, m := range order {
+		size, modified := "gone", "-"
+
+		if m.Host() != "" {
+			size = "remote"
+		} else if fi, err := os.Stat(m.Path); err == nil {
+			size, modified = humanSize(fi.Size()), fi.ModTime().Local().Format(when)
+
+			if fi.IsDir() {
+				size = "dir"
 			}
 		}
 
-		if removed > 0 {
-			stage.Rewrite()
+		attrs := []string{}
+		for _, k := range m.AttrKeys() {
+			attrs = append(attrs, k+"="+staging.QuoteToken(m.Attrs[k]))
 		}
 
-	case "tag":
-		paths := flag.Args()[1:]
-		if len(paths) == 0 {
-			eprintf("mark tag <tag> (filenames)")
-			return
+		added := "-"
+		if !m.Added.IsZero() {
+			added = fmt.Sprintf("%s by %s in %s", m.Added.Local().Format(when), m.AddedBy, m.AddedFrom)
 		}
 
-		tag := paths[0]
-		paths = paths[1:]
-
-		if len(paths) == 0 {
-			for i, _ := range stage.Marks {
-				stage.Marks[i].Tag("", tag)
-			}
-		} else {
-			for _, path := range paths {
-				for i, _ := range stage.Marks {
-					stage.Marks[i].Tag(path, tag)
-				}
+		tags := plainCell("-")
+		if len(m.Tags) > 0 {
+			painted := []string{}
+			for _, t := range m.Tags {
+				painted = append(painted, paint(on, tagColor(t), t))
 			}
+
+			tags = cell{strings.Join(m.Tags, ","), strings.Join(painted, ",")}
 		}
 
-		stage.Rewrite()
+		state := orDash(describeStatus(m))
+
+		rows = append(rows, []cell{
+			plainCell(strconv.Itoa(index[m])),
+			plainCell(size),
+			plainCell(modified),
+			{m.Path, paint(on, pathColor(m.Path), m.Path)},
+			tags,
+			plainCell(orDash(strings.Join(attrs, " "))),
+			{state, paint(on, statusColor(m.Status), state)},
+			plainCell(added),
+		})
+	}
 
-	case "exec":
-		added := 0
+	printColumns(rows)
+}
 
-		args := flag.Args()[1:]
+// orDash fills in an empty column
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
 
-		added, err := stage.Exec(args, flagTagMatch)
-		fmt.Printf("%d of %d completed\n", added, len(stage.Marks))
+	return s
+}
 
-		if !flagRetainMark && flagTagMatch == "" && !flagDryRun {
-			stage.Marks = []Mark{}
-			stage.Rewrite()
-		}
+// execMarks runs a command on marks and cleans up after, exiting
+// nonzero if anything failed
+func execMarks(stage *StagingArea, args []string, marks []*Mark) {
+	summary, err := runExec(stage, args, marks, nil)
 
-		if err != nil {
-			os.Exit(1)
-		}
+	// with -quickfix, the output is all for the editor
+	if flagJSON {
+		printJSON(summary)
+	} else if !flagQuickfix {
+		fmt.Printf("%d of %d completed\n", summary.Completed, summary.Total)
+	}
 
-		return
+	if err == staging.ErrInterrupted {
+		eprintf("\"mark resume\" to pick up where this left off")
+	}
 
-	default:
-		eprintf(availableCommands)
-		return
+	if err != nil {
+		exit(exitCode(err))
+	}
+}
+
+// runExec runs a command on marks (see execute), then tags what
+// failed, with -tagfailed, and clears what's done (see execMarks)
+func runExec(stage *StagingArea, args []string, marks []*Mark, report io.Writer) (jsonSummary, error) {
+	completed, err := execute(stage, args, runOrder(marks), report)
+
+	summary := jsonSummary{
+		Completed:   completed,
+		Total:       len(marks),
+		Failed:      []string{},
+		Interrupted: err == staging.ErrInterrupted,
+	}
+
+	for _, m := range marks {
+		if m.Ran && m.Status == "failed" {
+			summary.Failed = append(summary.Failed, m.Path)
+		}
+	}
+
+	if flagNotify && !flagDryRun {
+		ok(notify(stage, args, summary))
+	}
+
+	if !flagDryRun {
+		if flagTagFailed {
+			for i, m := range stage.Marks {
+				if m.Ran && m.Status == "failed" {
+					stage.Marks[i].Tag("failed")
+				}
+			}
+		}
+
+		// the staging area is only cleared if everything went
+		// through; otherwise it all stays put (or with
+		// -keep-failed, just what failed or never ran), so you
+		// can fix whatever went wrong and retry
+		if !flagRetainMark && flagTagMatch == "" && flagPathMatch == "" && flagOnlyStatus == "" {
+			if err == nil && completed == len(marks) || flagKeepFailed {
+				stage.Marks = stage.Unfinished()
+			} else {
+				eprintf("not everything completed; keeping all marks")
+			}
+		}
+
+		rewrite(stage)
+	}
+
+	return summary, err
+}
+
+// the flags the command line (or in the shell, the line) set, as
+// opposed to the config
+var cmdlineFlags map[string]bool
+
+// parseCommandLine parses the flags in argv, returning the command,
+// its arguments, and the names of the flags argv set (so the config
+// can fill in the rest without undoing them)
+func parseCommandLine(argv []string) (string, []string, map[string]bool) {
+	if flag.CommandLine.Parse(argv) != nil {
+		exit(exitUsage)
+	}
+
+	// flags can follow the command too, as in
+	// "mark exec -all tar cf out.tar _", except that with a
+	// plugin, they're the plugin's
+	command := flag.Arg(0)
+	args := flag.Args()
+
+	if _, isPlugin := plugin(command); isPlugin {
+		args = args[1:]
+	} else if command != "" {
+		if flag.CommandLine.Parse(args[1:]) != nil {
+			exit(exitUsage)
+		}
+
+		args = flag.Args()
+	}
+
+	// nothing can have been set before argv was parsed, for
+	// this to be just argv's (see resetFlags)
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	cmdlineFlags = set
+
+	return command, args, set
+}
+
+func main() {
+	// a command on its way into the sandbox (see sandboxed)
+	if dirs, found := os.LookupEnv("MARK_SANDBOX"); found {
+		sandboxExec(dirs, os.Args[1:])
+	}
+
+	if sh := os.Getenv("MARK_SHELL"); sh != "" {
+		flagShell = sh
+	}
+
+	areaDir = filepath.Join(stateDir(), "areas")
+	flagStagingPath = defaultStagingPath()
+
+	if local := os.Getenv("MARK_LOCAL"); local != "" && local != "0" {
+		flagLocal = true
+	}
+
+	flag.BoolVar(&flagCreateStaging, "create", flagCreateStaging, "allow mark to create staging area")
+	flag.BoolVar(&flagPreserveSubdirs, "preserve", flagPreserveSubdirs, "preserve subdirectories underneath newly added directory")
+	flag.BoolVar(&flagRetainMark, "retain", flagRetainMark, "retain mark after execution")
+	flag.BoolVar(&flagPrintCommand, "v", flagPrintCommand, "print commands before running")
+	flag.BoolVar(&flagDryRun, "dry", flagDryRun, "print commands before running and don't run")
+	flag.BoolVar(&flagNoShell, "noshell", flagNoShell, "run commands directly, not with sh -c")
+	flag.StringVar(&flagShell, "shell", flagShell, "shell to run commands with, or \"none\" ($MARK_SHELL sets the default)")
+	flag.BoolVar(&flagChdir, "cd", flagChdir, "run each command in its file's directory")
+	flag.BoolVar(&flagInvert, "invert", flagInvert, "select keeps (and tagif tags) files the command fails on")
+	flag.BoolVar(&flagStdin, "stdin", flagStdin, "feed each file to its command's stdin")
+	flag.BoolVar(&flagPrefixOutput, "H", flagPrefixOutput, "prefix output lines with the file they came from")
+	flag.BoolVar(&flagPrefixOutput, "prefix", flagPrefixOutput, "same as -H")
+	flag.StringVar(&flagReport, "report", flagReport, "write a JSON report line for each file exec'd to this file")
+	flag.BoolVar(&flagQuiet, "q", flagQuiet, "don't show progress during exec")
+	flag.BoolVar(&flagInteractive, "i", flagInteractive, "ask before running each command")
+	flag.IntVar(&flagJobs, "j", flagJobs, "number of commands to run in parallel")
+	flag.BoolVar(&flagBatch, "all", flagBatch, "exec one command for all files at once, xargs-style")
+	flag.IntVar(&flagBatchSize, "n", flagBatchSize, "with -all, maximum files per command")
+	flag.DurationVar(&flagTimeout, "timeout", flagTimeout, "kill commands that run longer than this")
+	flag.BoolVar(&flagHalt, "halt", flagHalt, "stop at the first command that fails")
+	flag.IntVar(&flagRetries, "retries", flagRetries, "number of times to retry failed commands")
+	flag.DurationVar(&flagBackoff, "backoff", flagBackoff, "delay before first retry, doubled for each retry after")
+	flag.BoolVar(&flagKeepFailed, "keep-failed", flagKeepFailed, "after a partly failed exec, clear only the marks that succeeded")
+	flag.BoolVar(&flagTagFailed, "tagfailed", flagTagFailed, "tag marks whose command failed \"failed\"")
+	flag.StringVar(&flagSortBy, "by", flagSortBy, "sort listings by this (tags: name or count; sort: name, size, mtime or ext)")
+	flag.BoolVar(&flagList, "list", flagList, "exec one command with all files listed on its stdin")
+	flag.BoolVar(&flagNullDelim, "0", flagNullDelim, "paths on stdin (for add -, or to -list commands) are NUL-delimited")
+	flag.Var(tagFlag{&flagTagMatch, new(bool)}, "tag", "match based on specified tag (or and/or/not expression), not paths; repeat to require several")
+	flag.StringVar(&flagOnlyStatus, "only", flagOnlyStatus, "exec only on files with this status (pending, done, failed)")
+	flag.StringVar(&flagPathMatch, "match", flagPathMatch, "exec only on files matching pattern")
+	flag.BoolVar(&flagRegexp, "re", flagRegexp, "patterns are regexps against the full path")
+	flag.BoolVar(&flagPickRemove, "remove", flagPickRemove, "pick marks to remove, instead of files to add")
+	flag.StringVar(&flagPreExec, "pre-exec", flagPreExec, "run this before an exec; if it fails, the exec doesn't happen")
+	flag.StringVar(&flagPostMark, "post-mark", flagPostMark, "run this after each mark an exec runs on, with $MARK_PATH, $MARK_STATUS and $MARK_EXIT")
+	flag.StringVar(&flagPostExec, "post-exec", flagPostExec, "run this after an exec, with $MARK_COMPLETED, $MARK_FAILED and $MARK_TOTAL")
+	flag.BoolVar(&flagNotify, "notify", flagNotify, "when an exec finishes, say so with a desktop notification, or to -webhook")
+	flag.StringVar(&flagWebhook, "webhook", flagWebhook, "with -notify, post a JSON summary of the exec to this URL")
+	flag.BoolVar(&flagNoPager, "no-pager", flagNoPager, "don't page long status output through $PAGER")
+	flag.BoolVar(&flagLong, "l", flagLong, "long listing (status shows sizes, times, attributes and where files were added from)")
+	flag.StringVar(&flagStatusSort, "sort", flagStatusSort, "status lists marks by name, size, mtime or ext")
+	flag.BoolVar(&flagWait, "wait", flagWait, "wait for other marks using the staging area to finish")
+	flag.BoolVar(&flagNoLock, "nolock", flagNoLock, "don't lock the staging area")
+	flag.BoolVar(&flagQuickfix, "quickfix", flagQuickfix, "list marks, and exec output, as file:line:col: message, for vim's and emacs's quickfix")
+	flag.BoolVar(&flagBackground, "bg", flagBackground, "exec in the background, as a job (see \"mark jobs\")")
+	flag.BoolVar(&flagWatch, "watch", flagWatch, "exec keeps running, on each file again when it changes (and logs follows a job's output)")
+	flag.DurationVar(&flagPoll, "poll", flagPoll, "how often watch and exec -watch look for changes")
+	flag.StringVar(&flagAutoTag, "autotag", flagAutoTag, "tag the files watch adds with this")
+	flag.BoolVar(&flagRemote, "remote", flagRemote, "exec remote marks (host:/path) on their hosts, over ssh")
+	flag.StringVar(&flagHost, "host", flagHost, "add paths as being on this host; with -remote, exec marks that aren't remote there")
+	flag.StringVar(&flagSSH, "ssh", flagSSH, "the ssh command -remote uses")
+	flag.StringVar(&flagHosts, "hosts", flagHosts, "exec on these hosts (comma separated), over ssh, each command on the least busy")
+	flag.BoolVar(&flagShared, "shared", flagShared, "with -hosts, files are already on the hosts (NFS, say), so don't rsync them over")
+	flag.StringVar(&flagDocker, "docker", flagDocker, "exec each command in a container from this image, as you, with its files mounted in")
+	flag.StringVar(&flagMount, "mount", flagMount, "with -docker, mount each mark's file, or the dir it's in")
+	flag.BoolVar(&flagReadOnly, "ro", flagReadOnly, "with -docker, mount files read-only")
+	flag.BoolVar(&flagSandbox, "sandbox", flagSandbox, "exec commands without the network, able to write only in their files' directories")
+	flag.BoolVar(&flagSudo, "sudo", flagSudo, "exec commands as root, with sudo")
+	flag.StringVar(&flagUser, "user", flagUser, "exec commands as this user, with sudo")
+	flag.StringVar(&flagListen, "listen", flagListen, "address for \"mark serve\" to listen on")
+	flag.BoolVar(&flagNoDaemon, "nodaemon", flagNoDaemon, "don't hand commands to a running \"mark daemon\"")
+	flag.BoolVar(&flagForce, "force", flagForce, "overwrite the staging file even if it changed while mark was working")
+	flag.IntVar(&flagHistory, "history", flagHistory, "old versions of the staging file to keep for undo (0 for none)")
+	flag.BoolVar(&flagLocal, "local", flagLocal, "use the closest .mark-staging in or above the current directory ($MARK_LOCAL sets the default)")
+	flag.BoolVar(&flagRecursive, "r", flagRecursive, "add the files in directories, not the directories")
+	flag.BoolVar(&flagGitignore, "gitignore", flagGitignore, "with -r, skip files .gitignore (and git's excludes) would")
+	flag.Var(listFlag{&flagExclude, new(bool)}, "exclude", "with -r, skip files matching this gitignore-style pattern; repeat for more")
+	flag.StringVar(&flagGrep, "grep", flagGrep, "add files under the given directories (or here) whose contents match this regexp")
+	flag.BoolVar(&flagIgnoreCase, "ignore-case", flagIgnoreCase, "-grep ignores case")
+	flag.StringVar(&flagType, "type", flagType, "with -r, stage only these: f (files), d (directories), l (symlinks), or several")
+	flag.StringVar(&flagExt, "ext", flagExt, "with -r, stage only files with these extensions (comma separated)")
+	flag.StringVar(&flagGlob, "glob", flagGlob, "with -r, stage only files whose names match this glob")
+	flag.StringVar(&flagNewer, "newer", flagNewer, "with -r, stage only files modified since this long ago (2d, 36h) or this date")
+	flag.StringVar(&flagOlder, "older", flagOlder, "with -r, stage only files last modified before this long ago or this date")
+	flag.StringVar(&flagMinSize, "min-size", flagMinSize, "with -r, stage only files at least this big (10K, 10M, 1G)")
+	flag.StringVar(&flagMaxSize, "max-size", flagMaxSize, "with -r, stage only files at most this big")
+	flag.IntVar(&flagMaxDepth, "maxdepth", flagMaxDepth, "with -r, go at most this many directories down (1 is just what's in the directory; -1 for no limit)")
+	flag.BoolVar(&flagFollow, "follow", flagFollow, "with -r, follow symlinks to directories")
+	flag.BoolVar(&flagResolve, "resolve", flagResolve, "add files by their real paths, symlinks resolved, so each is staged once")
+	flag.BoolVar(&flagReverse, "reverse", flagReverse, "exec on marks last to first (and sort backwards)")
+	flag.BoolVar(&flagShuffle, "shuffle", flagShuffle, "exec on marks in random order")
+	flag.BoolVar(&flagJSON, "json", flagJSON, "print listings and exec summaries as JSON")
+	flag.BoolVar(&flagPrint0, "print0", flagPrint0, "list ends paths with NULs rather than newlines")
+	flag.BoolVar(&flagTree, "tree", flagTree, "status shows marks as a tree of their directories")
+	flag.StringVar(&flagColor, "color", flagColor, "color output: always, never or auto ($NO_COLOR turns auto off)")
+	flag.BoolVar(&flagGitModified, "git-modified", flagGitModified, "add files git says are modified")
+	flag.BoolVar(&flagGitStaged, "git-staged", flagGitStaged, "add files staged in git")
+	flag.BoolVar(&flagGitUntracked, "git-untracked", flagGitUntracked, "add files git isn't tracking (and isn't ignoring)")
+	flag.StringVar(&flagGitDiff, "git-diff", flagGitDiff, "add files changed in a range of git revisions (rev1..rev2)")
+	flag.StringVar(&flagStagingPath, "staging", flagStagingPath, "staging file")
+	flag.StringVar(&flagFormat, "format", flagFormat, "store the staging file as \"text\" or \"json\"")
+	flag.StringVar(&flagAreaName, "name", flagAreaName, fmt.Sprintf("use named staging area (kept in %s)", areaDir))
+
+	config, err := readConfig(configPath())
+	if !ok(err) {
+		config = nil
+	}
+
+	setTagColors(configPath(), config)
+
+	// exec -bg starts mark over again, as a job (see background)
+	if id := os.Getenv("MARK_JOB"); id != "" {
+		os.Unsetenv("MARK_JOB")
+		startJob(id)
+	}
+
+	command, args, set := parseCommandLine(os.Args[1:])
+
+	// the config's flags, and a preset's, go under the command
+	// line's
+	applyConfig(configPath(), "", config, set)
+
+	if command == "run" && len(args) > 0 {
+		applyConfig(configPath(), args[0], config, set)
+	}
+
+	// plugins get the staging area this way, so when they run
+	// mark it uses the same one
+	if path := os.Getenv("MARK_STAGING"); path != "" && !set["staging"] {
+		flag.Set("staging", path)
+	}
+
+	if flagShell == "none" {
+		flagNoShell = true
+	}
+
+	if flagColor != "auto" && flagColor != "always" && flagColor != "never" {
+		usage("-color is \"always\", \"never\" or \"auto\"")
+	}
+
+	if flagFormat != "" && flagFormat != "text" && flagFormat != "json" {
+		usage("-format is \"text\" or \"json\"")
+	}
+
+	// a recursive add never stages the directory itself, so
+	// there'd be nothing
+	if flagMaxDepth == 0 {
+		usage("-maxdepth is 1 (just what's in the directory) or more, or -1 for no limit")
+	}
+
+	// an explicit -staging or -name beats -local
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "staging" || f.Name == "name"
+	})
+
+	migrateLegacy()
+
+	flagStagingPath = expandHome(flagStagingPath)
+
+	if flagAreaName != "" {
+		flagStagingPath = areaPath(flagAreaName)
+	} else if flagLocal && !explicit {
+		flagStagingPath = localStagingPath()
+	}
+
+	if command == "areas" {
+		areas()
+		return
+	}
+
+	switch command {
+	case "jobs":
+		jobs()
+		return
+	case "logs":
+		logs(pickJob(args))
+		return
+	case "wait":
+		waitJob(pickJob(args))
+		return
+	case "cancel":
+		cancel(pickJob(args))
+		return
+	}
+
+	// the job itself is the one that runs it
+	if flagBackground && thisJob == nil && (command == "exec" || command == "run" || command == "retry" || command == "resume") {
+		background()
+		return
+	}
+
+	if path, found := plugin(command); found {
+		runPlugin(path, args)
+		return
+	}
+
+	if command == "completion" {
+		if len(args) != 1 {
+			usage("mark completion bash|zsh|fish")
+		}
+
+		hardfail(Completion(os.Stdout, args[0]))
+		return
+	}
+
+	// if there's a daemon, it has the staging area loaded
+	// already
+	if forwardable(command, args) {
+		if code, done := viaDaemon(flagStagingPath, os.Args[1:]); done {
+			exit(code)
+			return
+		}
+	}
+
+	// commands that change the staging area hold it until
+	// they're done, so two marks can't clobber each other (but
+	// the daemon, serve and watch only hold it while they're
+	// doing something)
+	readOnly := map[string]bool{"daemon": true, "serve": true, "watch": true, "": true, "status": true, "tags": true, "verify": true, "script": true, "export": true, "list": true, "path": true, "stats": true}
+
+	// exec -watch, too, since it can go on for hours
+	if !flagNoLock && !readOnly[command] && !(command == "exec" && flagWatch) {
+		_, err := Lock(flagStagingPath, flagWait)
+		hardfail(stagingErr(err))
+	}
+
+	stage, err := GetStagingArea(flagStagingPath)
+	hardfail(err)
+
+	// converting from one format to the other
+	if flagFormat != "" && stage.JSON != (flagFormat == "json") {
+		rewrite(stage)
+	}
+
+	dispatch(stage, config, command, args)
+	endJob(exitOK)
+}
+
+// dispatch runs a command on the staging area
+func dispatch(stage *StagingArea, config []configEntry, command string, args []string) {
+	// flags can change from one command to the next, in the shell
+	stage.Preserve, stage.Resolve, stage.Regexp = flagPreserveSubdirs, flagResolve, flagRegexp
+
+	if command == "" || command == "status" {
+		status(stage)
+		return
+	}
+
+	switch command {
+	case "+":
+		fallthrough
+	case "add":
+		added := 0
+
+		paths := []string{}
+
+		// with -grep, what's given is where to look
+		if flagGrep != "" {
+			roots := args
+			if len(roots) == 0 {
+				roots = []string{"."}
+			}
+
+			found, err := grepPaths(flagGrep, roots)
+			hardfail(err)
+
+			args = nil
+			paths = append(paths, found...)
+		}
+
+		for _, path := range args {
+			if path == "-" {
+				paths = append(paths, readPaths(os.Stdin)...)
+			} else if flagHost != "" {
+				// there's nothing here to glob or walk
+				if !strings.HasPrefix(path, "/") {
+					usage("with -host, paths have to be absolute: %s", path)
+				}
+
+				paths = append(paths, staging.RemotePath(flagHost, path))
+			} else if host, _ := staging.SplitRemote(path); host != "" {
+				paths = append(paths, path)
+			} else if _, err := os.Lstat(path); err != nil && staging.HasGlob(path) {
+				// mark does its own globbing, "**" and all
+				found, err := staging.ExpandGlob(path)
+				hardfail(err)
+
+				if len(found) == 0 {
+					eprintf("nothing matches %s", path)
+				} else if abs, err := filepath.Abs(path); err == nil {
+					stage.AddGlob(abs)
+				}
+
+				paths = append(paths, found...)
+			} else if fi, err := os.Stat(path); flagRecursive && err == nil && fi.IsDir() {
+				found, err := walk(path)
+				hardfail(err)
+
+				paths = append(paths, found...)
+			} else {
+				paths = append(paths, path)
+			}
+		}
+
+		if flagGitModified || flagGitStaged || flagGitUntracked {
+			found, err := gitStatusPaths(flagGitModified, flagGitStaged, flagGitUntracked)
+			hardfail(err)
+
+			paths = append(paths, found...)
+		}
+
+		if flagGitDiff != "" {
+			found, err := gitDiffPaths(flagGitDiff)
+			hardfail(err)
+
+			paths = append(paths, found...)
+		}
+
+		for _, path := range paths {
+			if add(stage, path) {
+				added++
+			}
+		}
+
+		if added > 0 {
+			rewrite(stage)
+		}
+
+	case "remove":
+		removed := 0
+
+		paths := args
+
+		if len(paths) == 0 && (flagTagMatch != "" || flagPathMatch != "" || flagOnlyStatus != "") {
+			removed = stage.Drop(selectMarks(stage))
+		} else if len(paths) == 0 {
+			removed = len(stage.Marks)
+			stage.Marks = []Mark{}
+		} else {
+			// figure out everything to remove first, so #index
+			// doesn't shift underneath us
+			kill := []*Mark{}
+			for _, path := range paths {
+				kill = append(kill, matching(stage, path)...)
+			}
+
+			removed = stage.Drop(kill)
+		}
+
+		if removed > 0 {
+			rewrite(stage)
+		}
+
+	case "tag":
+		paths := args
+		if len(paths) == 0 {
+			eprintf("mark tag <tag> (filenames)")
+			return
+		}
+
+		tag := paths[0]
+		paths = paths[1:]
+
+		if len(paths) == 0 {
+			for i, _ := range stage.Marks {
+				stage.Marks[i].Tag(tag)
+			}
+		} else {
+			for _, path := range paths {
+				for _, m := range matching(stage, path) {
+					m.Tag(tag)
+				}
+			}
+		}
+
+		rewrite(stage)
+
+	case "untag":
+		paths := args
+		if len(paths) == 0 {
+			eprintf("mark untag <tag> (filenames)")
+			return
+		}
+
+		tag := paths[0]
+		paths = paths[1:]
+
+		untagged := 0
+
+		if len(paths) == 0 {
+			for i := range stage.Marks {
+				if stage.Marks[i].Untag(tag) {
+					untagged++
+				}
+			}
+		} else {
+			for _, path := range paths {
+				for _, m := range matching(stage, path) {
+					if m.Untag(tag) {
+						untagged++
+					}
+				}
+			}
+		}
+
+		if untagged > 0 {
+			rewrite(stage)
+		}
+
+	case "tag-rename":
+		if len(args) != 2 {
+			eprintf("mark tag-rename <old> <new>")
+			return
+		}
+
+		renamed := 0
+
+		for i := range stage.Marks {
+			m := &stage.Marks[i]
+
+			if m.RenameTag(args[0], args[1]) {
+				renamed++
+			}
+		}
+
+		fmt.Printf("renamed %s to %s on %d files\n", args[0], args[1], renamed)
+
+		if renamed > 0 {
+			rewrite(stage)
+		}
+
+	case "tag-rm":
+		if len(args) != 1 {
+			eprintf("mark tag-rm <tag>")
+			return
+		}
+
+		removed := 0
+
+		for i := range stage.Marks {
+			if stage.Marks[i].Untag(args[0]) {
+				removed++
+			}
+		}
+
+		fmt.Printf("removed %s from %d files\n", args[0], removed)
+
+		if removed > 0 {
+			rewrite(stage)
+		}
+
+	case "exec":
+		if flagWatch {
+			if flagPoll <= 0 {
+				usage("-poll has to be more than 0")
+			}
+
+			watchExec(stage, args)
+			return
+		}
+
+		marks := selectMarks(stage)
+		stage.LastExec = args
+
+		execMarks(stage, args, marks)
+
+	case "run":
+		if len(args) == 0 {
+			for _, name := range presets(config) {
+				cmd, _ := preset(config, name)
+				fmt.Printf("%s: %s\n", name, cmd)
+			}
+
+			return
+		}
+
+		cmd, found := preset(config, args[0])
+		if !found {
+			usage("no preset %q in %s", args[0], configPath())
+		}
+
+		// anything after the preset's name goes on the end
+		run := []string{cmd}
+		if flagNoShell {
+			run = strings.Fields(cmd)
+		}
+
+		run = append(run, args[1:]...)
+
+		marks := selectMarks(stage)
+		stage.LastExec = run
+
+		execMarks(stage, run, marks)
+
+	case "set":
+		sets := map[string]string{}
+
+		for len(args) > 0 && strings.Contains(args[0], "=") {
+			key, val, _ := strings.Cut(args[0], "=")
+			if !staging.ValidAttrKey(key) {
+				usage("bad attribute name: %q", key)
+			}
+
+			sets[key] = val
+			args = args[1:]
+		}
+
+		if len(sets) == 0 {
+			eprintf("mark set <key>=<value> (filenames)")
+			return
+		}
+
+		hits := map[*Mark]bool{}
+		for _, pat := range args {
+			for _, m := range matching(stage, pat) {
+				hits[m] = true
+			}
+		}
+
+		changed := 0
+
+		for i := range stage.Marks {
+			m := &stage.Marks[i]
+
+			if len(args) > 0 && !hits[m] {
+				continue
+			}
+
+			for key, val := range sets {
+				// "key=" with no value clears it
+				if val == "" {
+					delete(m.Attrs, key)
+				} else {
+					m.SetAttr(key, val)
+				}
+			}
+
+			changed++
+		}
+
+		if changed > 0 {
+			rewrite(stage)
+		}
+
+	case "capture":
+		if len(args) < 2 {
+			eprintf("mark capture <key> <command>")
+			return
+		}
+
+		key := args[0]
+		if !staging.ValidAttrKey(key) {
+			usage("bad attribute name: %q", key)
+		}
+
+		marks := selectMarks(stage)
+		outs := stage.Capture(args[1:], marks, execOptions(nil))
+
+		if flagDryRun {
+			return
+		}
+
+		for m, out := range outs {
+			m.SetAttr(key, out)
+		}
+
+		fmt.Printf("captured %s for %d of %d\n", key, len(outs), len(marks))
+
+		rewrite(stage)
+
+	case "tagif":
+		if len(args) < 2 {
+			eprintf("mark tagif <tag> <command>")
+			return
+		}
+
+		tag := args[0]
+
+		marks := selectMarks(stage)
+		hits := stage.Probe(args[1:], marks, execOptions(nil))
+
+		if flagDryRun {
+			return
+		}
+
+		tagged := 0
+		for _, m := range marks {
+			if hits[m] != flagInvert && m.Tag(tag) {
+				tagged++
+			}
+		}
+
+		fmt.Printf("tagged %d of %d %s\n", tagged, len(marks), tag)
+
+		if tagged > 0 {
+			rewrite(stage)
+		}
+
+	case "verify":
+		bad := 0
+
+		for _, m := range stage.Marks {
+			what, err := m.Verify()
+			if !ok(err) {
+				what = "unreadable"
+			}
+
+			if what != "" && what != "unstamped" {
+				fmt.Printf("%s %s\n", what, m.Path)
+				bad++
+			}
+		}
+
+		if bad > 0 {
+			exit(exitFailed)
+		}
+
+	case "dedupe":
+		tagging := len(args) > 0 && args[0] == "tag"
+
+		groups := stage.Duplicates(selectMarks(stage), flagJobs)
+
+		index := map[*Mark]int{}
+		for i := range stage.Marks {
+			index[&stage.Marks[i]] = i
+		}
+
+		// in staging order, so it's the same every time
+		hashes := []string{}
+		for hash := range groups {
+			hashes = append(hashes, hash)
+		}
+
+		sort.Slice(hashes, func(i, j int) bool {
+			return index[groups[hashes[i]][0]] < index[groups[hashes[j]][0]]
+		})
+
+		dups := []*Mark{}
+
+		for _, hash := range hashes {
+			group := groups[hash]
+
+			for _, m := range group {
+				if tagging {
+					m.Tag("dup:" + hash[:8])
+				} else if m != group[0] {
+					fmt.Printf("%s (same as %s)\n", m.Path, group[0].Path)
+					dups = append(dups, m)
+				}
+			}
+		}
+
+		if tagging {
+			fmt.Printf("%d groups of duplicates\n", len(groups))
+		} else {
+			stage.Drop(dups)
+		}
+
+		if len(groups) > 0 && !flagDryRun {
+			rewrite(stage)
+		}
+
+	case "sort":
+		// "sort -r" is reverse, but r = true in the config is
+		// about adds
+		hardfail(stage.Sort(flagSortBy, flagReverse || flagRecursive && cmdlineFlags["r"]))
+		rewrite(stage)
+
+	case "move":
+		if len(args) != 2 {
+			eprintf("mark move <from index> <to index>")
+			return
+		}
+
+		hardfail(stage.Move(args[0], args[1]))
+		rewrite(stage)
+
+	case "list":
+		end := "\n"
+		if flagPrint0 {
+			end = "\x00"
+		}
+
+		out := bufio.NewWriter(os.Stdout)
+		for _, m := range selectMarks(stage) {
+			if flagQuickfix {
+				fmt.Fprintf(out, "%s:1:1: %s\n", m.Path, quickfixAbout(m))
+			} else {
+				out.WriteString(m.Path + end)
+			}
+		}
+
+		out.Flush()
+
+	case "path":
+		if len(args) != 1 {
+			usage("mark path <n>")
+		}
+
+		marks := selectMarks(stage)
+
+		n, last, err := staging.ParseIndexRange(strings.TrimPrefix(args[0], "#"), len(marks))
+		switch {
+		case err != nil:
+		case n != last:
+			err = fmt.Errorf("that's more than one")
+		case n < 0 || n >= len(marks):
+			err = fmt.Errorf("there are only %d", len(marks))
+		}
+
+		if err != nil {
+			usage("no mark %s: %s", args[0], err)
+		}
+
+		fmt.Println(marks[n].Path)
+
+	case "stats":
+		st := stats(selectMarks(stage))
+
+		if flagJSON {
+			printJSON(st)
+		} else {
+			printStats(st)
+		}
+
+	case "prune":
+		gone := []*Mark{}
+
+		for i := range stage.Marks {
+			// there's no telling from here
+			if stage.Marks[i].Host() != "" {
+				continue
+			}
+
+			if _, err := os.Lstat(stage.Marks[i].Path); os.IsNotExist(err) {
+				fmt.Printf("%s\n", stage.Marks[i].Path)
+				gone = append(gone, &stage.Marks[i])
+			}
+		}
+
+		if stage.Drop(gone) > 0 {
+			rewrite(stage)
+		}
+
+	case "refresh":
+		root := ""
+		if len(args) > 0 {
+			root, _ = filepath.Abs(args[0])
+		}
+
+		found := stage.Refresh(root)
+
+		for i := range stage.Marks {
+			if from, moved := found[&stage.Marks[i]]; moved {
+				fmt.Printf("%s -> %s\n", from, stage.Marks[i].Path)
+			}
+		}
+
+		if len(found) > 0 {
+			rewrite(stage)
+		}
+
+	case "undo":
+		when, err := Undo(flagStagingPath)
+		hardfail(err)
+
+		fmt.Printf("staging area is back to how it was before %s\n", when.Local().Format("2006-01-02 15:04:05"))
+
+	case "export":
+		hardfail(stage.Export(os.Stdout))
+
+	case "import":
+		from := "-"
+		if len(args) > 0 {
+			from = args[0]
+		}
+
+		other, err := readStaging(from)
+		hardfail(err)
+
+		fmt.Printf("%d new marks\n", stage.Merge(other))
+		rewrite(stage)
+
+	case "merge":
+		if len(args) == 0 {
+			eprintf("mark merge <staging file>")
+			return
+		}
+
+		for _, path := range args {
+			other, err := readStaging(path)
+			hardfail(err)
+
+			fmt.Printf("%s: %d new marks\n", path, stage.Merge(other))
+		}
+
+		rewrite(stage)
+
+	case "intersect", "subtract":
+		if len(args) != 1 {
+			eprintf("mark %s <staging file or path list>", command)
+			return
+		}
+
+		set, err := pathSet(args[0])
+		hardfail(err)
+
+		fmt.Printf("%d marks dropped\n", stage.Filter(set, command == "intersect"))
+		rewrite(stage)
+
+	case "pick":
+		if flagPickRemove {
+			paths := []string{}
+			for _, m := range stage.Marks {
+				paths = append(paths, m.Path)
+			}
+
+			picked, err := pick(paths, "remove> ")
+			hardfail(err)
+
+			kill := []*Mark{}
+			for _, path := range picked {
+				for i := range stage.Marks {
+					if stage.Marks[i].Path == path {
+						kill = append(kill, &stage.Marks[i])
+					}
+				}
+			}
+
+			if stage.Drop(kill) > 0 {
+				rewrite(stage)
+			}
+
+			return
+		}
+
+		root := "."
+		if len(args) > 0 {
+			root = args[0]
+		}
+
+		found, err := walk(root)
+		hardfail(err)
+
+		// shorter to look at relative to root
+		abs, err := filepath.Abs(root)
+		hardfail(err)
+
+		items := []string{}
+		for _, path := range found {
+			if rel, err := filepath.Rel(abs, path); err == nil {
+				path = rel
+			}
+
+			items = append(items, path)
+		}
+
+		picked, err := pick(items, "add> ")
+		hardfail(err)
+
+		added := 0
+		for _, path := range picked {
+			if add(stage, filepath.Join(abs, path)) {
+				added++
+			}
+		}
+
+		if added > 0 {
+			rewrite(stage)
+		}
+
+	case "edit":
+		err := edit(stage)
+		if err == errAbandoned {
+			exit(exitFailed)
+		}
+
+		hardfail(err)
+
+	case "watch":
+		if flagPoll <= 0 {
+			usage("-poll has to be more than 0")
+		}
+
+		if len(args) == 0 {
+			dirs := 0
+			for _, m := range stage.Marks {
+				if fi, err := os.Stat(m.Path); err == nil && fi.IsDir() {
+					dirs++
+				}
+			}
+
+			if dirs == 0 {
+				usage("mark watch <directories> (or stage some directories to watch)")
+			}
+		}
+
+		watch(stage, args)
+
+	case "daemon":
+		daemon(stage, config)
+
+	case "serve":
+		serve(stage, config)
+
+	case "shell":
+		shell(stage, config)
+
+	case "ui":
+		hardfail(runUI(stage))
+
+	case "tags":
+		tags(stage)
+
+	case "select":
+		if len(args) == 0 {
+			eprintf("mark select <command>")
+			return
+		}
+
+		marks := selectMarks(stage)
+		hits := stage.Probe(args, marks, execOptions(nil))
+
+		if flagDryRun {
+			return
+		}
+
+		drop := []*Mark{}
+		for _, m := range marks {
+			if hits[m] == flagInvert {
+				drop = append(drop, m)
+			}
+		}
+
+		fmt.Printf("kept %d of %d\n", len(marks)-len(drop), len(marks))
+
+		if stage.Drop(drop) > 0 {
+			rewrite(stage)
+		}
+
+	case "script":
+		flagDryRun = true
+
+		fmt.Printf("#!/bin/sh\n\n")
+
+		_, err := execute(stage, args, selectMarks(stage), nil)
+		hardfail(err)
+
+	case "resume":
+		if len(stage.LastExec) == 0 {
+			eprintf("nothing to resume")
+			exit(exitFailed)
+		}
+
+		marks := []*Mark{}
+		for _, m := range selectMarks(stage) {
+			if m.Status == "pending" {
+				marks = append(marks, m)
+			}
+		}
+
+		execMarks(stage, stage.LastExec, marks)
+
+	case "retry":
+		if len(args) == 0 {
+			args = stage.LastExec
+		}
+
+		if len(args) == 0 {
+			eprintf("nothing to retry")
+			exit(exitFailed)
+		}
+
+		marks := []*Mark{}
+		for _, m := range selectMarks(stage) {
+			if m.Status == "failed" {
+				marks = append(marks, m)
+			}
+		}
+
+		execMarks(stage, args, marks)
+
+	default:
+		usage(availableCommands)
 	}
 }
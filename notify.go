@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// what -webhook gets: the exec summary, and what ran
+type jsonNotice struct {
+	jsonSummary
+
+	Command []string `json:"command"`
+	Staging string   `json:"staging"`
+}
+
+// notify tells someone who's stepped away how an exec went: by
+// posting the summary to -webhook, if there is one, and otherwise
+// with a desktop notification
+func notify(s *StagingArea, args []string, summary jsonSummary) error {
+	if flagWebhook != "" {
+		return postNotice(flagWebhook, jsonNotice{summary, args, s.Path})
+	}
+
+	title := "mark: done"
+	switch {
+	case summary.Interrupted:
+		title = "mark: interrupted"
+	case len(summary.Failed) > 0:
+		title = "mark: failed"
+	}
+
+	msg := fmt.Sprintf("%d of %d completed: %s", summary.Completed, summary.Total, strings.Join(args, " "))
+	if n := len(summary.Failed); n > 0 {
+		msg += fmt.Sprintf(" (%d failed)", n)
+	}
+
+	return desktopNotice(title, msg)
+}
+
+func postNotice(url string, notice jsonNotice) error {
+	body, err := json.Marshal(notice)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", res.Status)
+	}
+
+	return nil
+}
+
+// desktopNotice pops up a notification, with osascript on a Mac
+// and notify-send everywhere else
+func desktopNotice(title, msg string) error {
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "darwin" {
+		script := fmt.Sprintf("display notification %s with title %s", appleQuote(msg), appleQuote(title))
+		cmd = exec.Command("osascript", "-e", script)
+	} else {
+		cmd = exec.Command("notify-send", title, msg)
+	}
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v %s", cmd.Args[0], err, bytes.TrimSpace(out))
+	}
+
+	return nil
+}
+
+// appleQuote makes s an AppleScript string
+func appleQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// paging is set while stdout is going to the pager
+// instead of the terminal
+var paging bool
+
+// startPager holds onto what's printed to stdout until done is
+// called; then, if it's taller than the terminal, it goes through
+// $PAGER (default less), and otherwise it's just printed
+func startPager() (done func()) {
+	if flagNoPager || !isTerminal(os.Stdout) {
+		return func() {}
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return func() {}
+	}
+
+	tty := os.Stdout
+	os.Stdout, paging = w, true
+
+	buf := &bytes.Buffer{}
+	copied := make(chan bool)
+
+	go func() {
+		io.Copy(buf, r)
+		close(copied)
+	}()
+
+	return func() {
+		w.Close()
+		<-copied
+		r.Close()
+
+		os.Stdout, paging = tty, false
+
+		if bytes.Count(buf.Bytes(), []byte("\n")) < terminalHeight() {
+			tty.Write(buf.Bytes())
+			return
+		}
+
+		page(tty, buf)
+	}
+}
+
+// page runs $PAGER on out, or prints it if that doesn't work
+func page(tty *os.File, out *bytes.Buffer) {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = bytes.NewReader(out.Bytes()), tty, os.Stderr
+
+	// like git: quit if it fits, pass colors through, don't clear
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			tty.Write(out.Bytes())
+		}
+	}
+}
+
+// terminalHeight is how many lines fit on the screen: $LINES,
+// or what the terminal says, or 24
+func terminalHeight() int {
+	if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+		return n
+	}
+
+	if n, _ := ttySize(os.Stdout); n > 0 {
+		return n
+	}
+
+	return 24
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pick lets the user choose some of items, fuzzily: with fzf,
+// if it's installed, and otherwise with pickBuiltin. Choosing
+// nothing (esc) isn't an error.
+func pick(items []string, prompt string) ([]string, error) {
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	fzf, err := exec.LookPath("fzf")
+	if err != nil {
+		return pickBuiltin(items, prompt)
+	}
+
+	cmd := exec.Command(fzf, "--multi", "--prompt", prompt)
+	cmd.Stdin = strings.NewReader(strings.Join(items, "\n") + "\n")
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		// 1 is no match, 130 is esc or ^C
+		if ee, ok := err.(*exec.ExitError); ok && (ee.ExitCode() == 1 || ee.ExitCode() == 130) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("fzf: %w", err)
+	}
+
+	picked := []string{}
+	for _, line := range strings.Split(strings.TrimRight(string(out), "\n"), "\n") {
+		if line != "" {
+			picked = append(picked, line)
+		}
+	}
+
+	return picked, nil
+}
+
+// pickBuiltin is pick without fzf: type to filter, tab to
+// select, enter to take what's selected (or what's under the
+// cursor), esc to give up
+func pickBuiltin(items []string, prompt string) ([]string, error) {
+	t, err := openTerminal()
+	if err != nil {
+		return nil, err
+	}
+	defer t.Close()
+
+	t.FullScreen()
+
+	filter := ""
+	cursor, top := 0, 0
+	selected := map[int]bool{}
+
+	for {
+		shown := []int{}
+		for i, item := range items {
+			if fuzzy(filter, item) {
+				shown = append(shown, i)
+			}
+		}
+
+		if cursor >= len(shown) {
+			cursor = len(shown) - 1
+		}
+
+		if cursor < 0 {
+			cursor = 0
+		}
+
+		rows, cols := t.Size()
+		listRows := rows - 1
+
+		if cursor < top {
+			top = cursor
+		}
+
+		if cursor >= top+listRows {
+			top = cursor - listRows + 1
+		}
+
+		on := colorful(t.f)
+
+		out := &bytes.Buffer{}
+		out.WriteString("\x1b[H\x1b[2J")
+
+		counts := fmt.Sprintf("  %d/%d", len(shown), len(items))
+		if len(selected) > 0 {
+			counts += fmt.Sprintf(" (%d)", len(selected))
+		}
+
+		fmt.Fprintf(out, "%s%s%s", prompt, filter, paint(on, colorCodes["dim"], counts))
+
+		for row := 0; row < listRows && top+row < len(shown); row++ {
+			i := shown[top+row]
+
+			mark := "  "
+			if top+row == cursor {
+				mark = paint(on, colorCodes["bold"], "> ")
+			}
+
+			sel := " "
+			if selected[i] {
+				sel = paint(on, colorCodes["green"], "*")
+			}
+
+			fmt.Fprintf(out, "\r\n%s%s %s", mark, sel, strings.TrimRight(fit(items[i], cols-4), " "))
+		}
+
+		fmt.Fprintf(out, "\x1b[1;%dH", len([]rune(prompt+filter))+1)
+		t.f.Write(out.Bytes())
+
+		key, err := t.ReadKey()
+		if err != nil {
+			return nil, err
+		}
+
+		switch key {
+		case "esc", "ctrl-c", "ctrl-q":
+			return nil, nil
+
+		case "up", "ctrl-k", "ctrl-p":
+			cursor--
+
+		case "down", "ctrl-j", "ctrl-n":
+			cursor++
+
+		case "pgup":
+			cursor -= listRows
+
+		case "pgdn":
+			cursor += listRows
+
+		case "backspace":
+			if r := []rune(filter); len(r) > 0 {
+				filter = string(r[:len(r)-1])
+			}
+
+		case "ctrl-w":
+			filter = ""
+
+		case "tab":
+			if cursor < len(shown) {
+				i := shown[cursor]
+				if selected[i] {
+					delete(selected, i)
+				} else {
+					selected[i] = true
+				}
+
+				cursor++
+			}
+
+		case "enter":
+			picked := []string{}
+			for i, item := range items {
+				if selected[i] {
+					picked = append(picked, item)
+				}
+			}
+
+			if len(picked) == 0 && cursor < len(shown) {
+				picked = append(picked, items[shown[cursor]])
+			}
+
+			return picked, nil
+
+		default:
+			if len([]rune(key)) == 1 {
+				filter += key
+				cursor = 0
+			}
+		}
+	}
+}
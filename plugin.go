@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// builtin reports whether mark has command itself
+func builtin(command string) bool {
+	if command == "" || command == "+" {
+		return true
+	}
+
+	for _, name := range commandNames() {
+		if name == command {
+			return true
+		}
+	}
+
+	return false
+}
+
+// plugin finds the program for a command mark doesn't have
+// itself: mark-<command>, on the PATH, like git does it
+func plugin(command string) (string, bool) {
+	if builtin(command) || strings.ContainsAny(command, `/\`) {
+		return "", false
+	}
+
+	path, err := exec.LookPath("mark-" + command)
+	return path, err == nil
+}
+
+// runPlugin runs a plugin on args, and exits with its status. It
+// gets the staging area in $MARK_STAGING (which mark itself
+// uses, if the plugin runs it), mark in $MARK, and the flags
+// mark was given as $MARK_FLAG_<NAME>, as in MARK_FLAG_DRY=true
+// or MARK_FLAG_GIT_DIFF=HEAD~1..
+func runPlugin(path string, args []string) {
+	env := append(os.Environ(), "MARK_STAGING="+flagStagingPath, "MARK_CONFIG="+configPath())
+
+	if self, err := os.Executable(); err == nil {
+		env = append(env, "MARK="+self)
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		name := strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		env = append(env, "MARK_FLAG_"+name+"="+f.Value.String())
+	})
+
+	cmd := exec.Command(path, args...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = env
+
+	err := cmd.Run()
+	if ee, ok := err.(*exec.ExitError); ok {
+		exit(ee.ExitCode())
+	}
+
+	hardfail(err)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// progress draws a status line on stderr while exec runs:
+// how many marks are done, how long it's been, and a guess at
+// how long is left. Command output has to go through it (see
+// wrap) so the line gets out of the way first. A nil *progress
+// does nothing, which is what you get with -q (or -i, which
+// has its own prompts to show) or when stderr isn't a terminal.
+type progress struct {
+	lock sync.Mutex
+
+	total, done int
+	start       time.Time
+
+	// the status line is on the screen
+	shown bool
+
+	// command output left the cursor partway through a line,
+	// so drawing now would clobber it
+	mid bool
+
+	stop chan bool
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func newProgress(total int) *progress {
+	if flagQuiet || flagDryRun || flagInteractive || !isTerminal(os.Stderr) {
+		return nil
+	}
+
+	p := &progress{
+		total: total,
+		start: time.Now(),
+		stop:  make(chan bool),
+	}
+
+	// keep the clock ticking during long commands
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				p.lock.Lock()
+				p.draw()
+				p.lock.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+
+	p.lock.Lock()
+	p.draw()
+	p.lock.Unlock()
+
+	return p
+}
+
+func roundSecond(d time.Duration) time.Duration {
+	return d.Round(time.Second)
+}
+
+// call with lock held
+func (p *progress) draw() {
+	if p.mid {
+		return
+	}
+
+	elapsed := time.Since(p.start)
+
+	line := fmt.Sprintf("[%d/%d] %s elapsed", p.done, p.total, roundSecond(elapsed))
+
+	if p.done > 0 && p.done < p.total {
+		left := elapsed / time.Duration(p.done) * time.Duration(p.total-p.done)
+		line += fmt.Sprintf(", ~%s left", roundSecond(left))
+	}
+
+	fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+	p.shown = true
+}
+
+// call with lock held
+func (p *progress) clear() {
+	if p.shown {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		p.shown = false
+	}
+}
+
+// Advance counts n more marks as finished
+func (p *progress) Advance(n int) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.done += n
+	p.draw()
+}
+
+// Finish takes the status line down for good
+func (p *progress) Finish() {
+	if p == nil {
+		return
+	}
+
+	close(p.stop)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.clear()
+}
+
+// wrap returns a writer that clears the status line before
+// writing to w
+func (p *progress) wrap(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+
+	return &progressWriter{p: p, w: w}
+}
+
+type progressWriter struct {
+	p *progress
+	w io.Writer
+}
+
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	pw.p.lock.Lock()
+	defer pw.p.lock.Unlock()
+
+	pw.p.clear()
+
+	if len(b) > 0 {
+		pw.p.mid = b[len(b)-1] != '\n'
+	}
+
+	return pw.w.Write(b)
+}
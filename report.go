@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// one line of a -report file
+type reportEntry struct {
+	Path     string   `json:"path"`
+	Tags     []string `json:"tags"`
+	Command  string   `json:"command"`
+	Exit     int      `json:"exit"`
+	Error    string   `json:"error,omitempty"`
+	Duration float64  `json:"duration"`
+	Stdout   int64    `json:"stdout_bytes"`
+	Stderr   int64    `json:"stderr_bytes"`
+}
+
+// writeReport writes a JSON line to w for each mark a job ran on;
+// marks in an -all batch share the numbers for the whole batch
+func writeReport(w io.Writer, job *staging.Job) {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+
+	for _, m := range job.Marks {
+		e := reportEntry{
+			Path: m.Path,
+			Tags: m.Tags,
+			Exit: -1,
+		}
+
+		if e.Tags == nil {
+			e.Tags = []string{}
+		}
+
+		if job.Inv != nil {
+			e.Command = strings.Join(job.Inv.Args, " ")
+			e.Exit = job.Inv.Exit
+			e.Duration = job.Inv.Duration.Seconds()
+			e.Stdout = job.Inv.Stdout
+			e.Stderr = job.Inv.Stderr
+		}
+
+		if job.Err != nil {
+			e.Error = job.Err.Error()
+		}
+
+		ok(enc.Encode(e))
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// sandbox is the Runner for -sandbox: commands can read what
+// they like, but can only write in their marks' directories (and
+// a $TMPDIR of their own), and can't reach the network. How
+// that's done is up to the platform (see sandboxed); where it
+// can't be, nothing runs.
+type sandbox struct{}
+
+func (sandbox) Run(ctx context.Context, c *staging.Command) staging.Result {
+	dirs := []string{}
+	seen := map[string]bool{}
+
+	writable := func(dir string) {
+		if dir != "" && !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, m := range c.Marks {
+		if m.Host() != "" {
+			return staging.Result{Exit: -1, Err: fmt.Errorf("%s is on %s, not here", m.Path, m.Host())}
+		}
+
+		writable(path.Dir(m.Path))
+	}
+
+	writable(c.Dir)
+
+	tmp, err := os.MkdirTemp("", "mark-sandbox-")
+	if err != nil {
+		return staging.Result{Exit: -1, Err: err}
+	}
+
+	defer os.RemoveAll(tmp)
+
+	writable(tmp)
+
+	sc := *c
+	sc.Env = append(append([]string{}, c.Env...), "TMPDIR="+tmp)
+
+	if err := sandboxed(&sc, dirs); err != nil {
+		return staging.Result{Exit: -1, Err: fmt.Errorf("can't sandbox: %w", err)}
+	}
+
+	return staging.Local{}.Run(ctx, &sc)
+}
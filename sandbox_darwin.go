@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// sandboxed sets c up to run under sandbox-exec, with a profile
+// that denies the network, and writing outside dirs
+func sandboxed(c *staging.Command, dirs []string) error {
+	profile := []string{
+		"(version 1)",
+		"(allow default)",
+		"(deny network*)",
+		"(deny file-write*)",
+		`(allow file-write* (literal "/dev/null"))`,
+	}
+
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+	for _, dir := range dirs {
+		profile = append(profile, `(allow file-write* (subpath "`+quote.Replace(dir)+`"))`)
+	}
+
+	c.Argv = append([]string{"sandbox-exec", "-p", strings.Join(profile, "\n")}, c.Argv...)
+
+	return nil
+}
+
+// sandboxExec is only for Linux
+func sandboxExec(dirs string, argv []string) {
+	eprintf("sandbox: not on this platform")
+	exit(exitFailed)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// sandboxed sets c up to run in the sandbox: it runs as mark
+// again, in new user and network namespaces (so there's no
+// network but loopback, and that's down), and that mark, in
+// sandboxExec, closes off writing outside dirs with landlock, and
+// unix sockets (a daemon's, docker's) with seccomp, and then
+// becomes the command
+func sandboxed(c *staging.Command, dirs []string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	c.Argv = append([]string{self}, c.Argv...)
+	c.Env = append(c.Env, "MARK_SANDBOX="+strings.Join(dirs, "\n"))
+
+	uid, gid := os.Getuid(), os.Getgid()
+
+	c.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: uid, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: gid, HostID: gid, Size: 1}},
+	}
+
+	return nil
+}
+
+// sandboxExec is the inside half of sandboxed: it runs argv, able
+// to write only in dirs (newline separated). It doesn't return.
+func sandboxExec(dirs string, argv []string) {
+	if len(argv) == 0 {
+		eprintf("sandbox: no command")
+		os.Exit(exitFailed)
+	}
+
+	prog, err := exec.LookPath(argv[0])
+	if err != nil {
+		eprintf("sandbox: %s", err)
+		os.Exit(exitFailed)
+	}
+
+	// landlock (like no_new_privs) is per thread, and has to be
+	// on the one that execs
+	runtime.LockOSThread()
+
+	if err := landlock(strings.Split(dirs, "\n")); err != nil {
+		eprintf("sandbox: %s", err)
+		os.Exit(exitFailed)
+	}
+
+	// landlock has set no_new_privs, which this needs
+	if err := noUnixSockets(); err != nil {
+		eprintf("sandbox: %s", err)
+		os.Exit(exitFailed)
+	}
+
+	// or a mark the command runs would take itself for this
+	os.Unsetenv("MARK_SANDBOX")
+
+	err = syscall.Exec(prog, argv, os.Environ())
+	eprintf("sandbox: %s", err)
+	os.Exit(exitFailed)
+}
+
+// the landlock system calls, which are numbered the same
+// everywhere, and the access rights they deal in
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	landlockWriteFile  = 1 << 1
+	landlockRemoveDir  = 1 << 4
+	landlockRemoveFile = 1 << 5
+	landlockMakeChar   = 1 << 6
+	landlockMakeDir    = 1 << 7
+	landlockMakeReg    = 1 << 8
+	landlockMakeSock   = 1 << 9
+	landlockMakeFifo   = 1 << 10
+	landlockMakeBlock  = 1 << 11
+	landlockMakeSym    = 1 << 12
+	landlockRefer      = 1 << 13
+	landlockTruncate   = 1 << 14
+)
+
+// landlock restricts this thread, and what it execs, to writing
+// under dirs (and to /dev/null); reading is left alone
+func landlock(dirs []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("no landlock: %w", errno)
+	}
+
+	var write, file uint64 = landlockWriteFile | landlockRemoveDir | landlockRemoveFile |
+		landlockMakeChar | landlockMakeDir | landlockMakeReg | landlockMakeSock |
+		landlockMakeFifo | landlockMakeBlock | landlockMakeSym, landlockWriteFile
+
+	if abi >= 2 {
+		write |= landlockRefer
+	}
+
+	if abi >= 3 {
+		write |= landlockTruncate
+		file |= landlockTruncate
+	}
+
+	attr := struct{ handledAccessFS uint64 }{write}
+
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock: %w", errno)
+	}
+
+	defer syscall.Close(int(fd))
+
+	allow := func(path string, access uint64) error {
+		f, err := syscall.Open(path, syscall.O_RDONLY|syscall.O_CLOEXEC, 0)
+		if err != nil {
+			return &os.PathError{Op: "open", Path: path, Err: err}
+		}
+
+		defer syscall.Close(f)
+
+		// struct landlock_path_beneath_attr, which is packed;
+		// the padding at the end here goes unread
+		rule := struct {
+			allowedAccess uint64
+			parentFD      int32
+		}{access, int32(f)}
+
+		_, _, errno := syscall.Syscall6(sysLandlockAddRule, fd, landlockRulePathBeneath, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		if errno != 0 {
+			return fmt.Errorf("landlock %s: %w", path, errno)
+		}
+
+		return nil
+	}
+
+	for _, dir := range dirs {
+		if err := allow(dir, write); err != nil {
+			return err
+		}
+	}
+
+	if err := allow(os.DevNull, file); err != nil {
+		return err
+	}
+
+	const prSetNoNewPrivs = 38
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("no_new_privs: %w", errno)
+	}
+
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock: %w", errno)
+	}
+
+	return nil
+}
+
+// for noUnixSockets' filter, what the kernel calls each
+// architecture, and its number for socket(2)
+var seccompArch = map[string]struct{ audit, socket uint32 }{
+	"amd64":   {0xc000003e, 41},
+	"arm64":   {0xc00000b7, 198},
+	"riscv64": {0xc00000f3, 198},
+}
+
+// struct sock_filter, a classic BPF instruction
+type sockFilter struct {
+	code   uint16
+	jt, jf uint8
+	k      uint32
+}
+
+// noUnixSockets has socket(AF_UNIX, ...) fail with EACCES for
+// this thread, and what it execs: connecting to one would get
+// around the sandbox, since landlock doesn't cover it and the
+// socket files are outside the network namespace
+func noUnixSockets() error {
+	arch, found := seccompArch[runtime.GOARCH]
+	if !found {
+		return fmt.Errorf("no seccomp filter for %s", runtime.GOARCH)
+	}
+
+	const (
+		ldAbs  = 0x20 // BPF_LD|BPF_W|BPF_ABS
+		jeq    = 0x15 // BPF_JMP|BPF_JEQ|BPF_K
+		jge    = 0x35 // BPF_JMP|BPF_JGE|BPF_K
+		ret    = 0x06 // BPF_RET|BPF_K
+		kill   = 0x80000000
+		eacces = 0x00050000 | uint32(syscall.EACCES)
+		allow  = 0x7fff0000
+
+		// offsets into struct seccomp_data
+		nr, audit, arg0 = 0, 4, 16
+
+		// x32 system calls, on amd64, have this bit set
+		x32 = 0x40000000
+	)
+
+	filter := []sockFilter{
+		{ldAbs, 0, 0, audit},
+		{jeq, 1, 0, arch.audit},
+		{ret, 0, 0, kill},
+		{ldAbs, 0, 0, nr},
+		{jge, 0, 1, x32},
+		{ret, 0, 0, kill},
+		{jeq, 0, 3, arch.socket},
+		{ldAbs, 0, 0, arg0},
+		{jeq, 0, 1, syscall.AF_UNIX},
+		{ret, 0, 0, eacces},
+		{ret, 0, 0, allow},
+	}
+
+	prog := struct {
+		len    uint16
+		filter *sockFilter
+	}{uint16(len(filter)), &filter[0]}
+
+	const prSetSeccomp, seccompModeFilter = 22, 2
+
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("seccomp: %w", errno)
+	}
+
+	return nil
+}
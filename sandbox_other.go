@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/tqbf/mark/staging"
+)
+
+func sandboxed(c *staging.Command, dirs []string) error {
+	return fmt.Errorf("no sandbox on %s", runtime.GOOS)
+}
+
+// sandboxExec is only for Linux
+func sandboxExec(dirs string, argv []string) {
+	eprintf("sandbox: not on this platform")
+	exit(exitFailed)
+}
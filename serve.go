@@ -0,0 +1,480 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// serve answers HTTP requests about the staging area on -listen,
+// for editor plugins and web UIs to drive mark with. Like the
+// daemon, it keeps the staging area loaded, rereading it when
+// something else changes it, and does one thing at a time:
+//
+//	GET    /marks              the marks (or the ones ?tag=, ?match= or ?status= select), like status -json
+//	POST   /marks              add {"paths": [...]}
+//	DELETE /marks?path=...     remove marks (or the ones ?tag=, ?match= or ?status= select)
+//	GET    /tags               the tags, like tags -json
+//	POST   /tags/<tag>         tag {"paths": [...]}, or everything
+//	DELETE /tags/<tag>?path=.. untag them, or everything
+//	POST   /exec               exec {"command": [...], "tag", "match", "status", "retain"}
+//
+// Every request needs "Authorization: Bearer <token>", with the
+// token mark serve writes when it starts (see serveToken), and
+// removes when it stops; a request from a browser page (one
+// with an Origin), for a name that isn't this machine's, or
+// POSTing anything but application/json, is turned away, so web
+// pages can't drive it.
+//
+// Paths are taken relative to wherever mark serve was started;
+// it's best to send absolute ones. Failures come back as
+// {"error": "..."}, with a 400 for a bad request, 409 if the
+// staging area can't be had, or 500. An exec streams back a line
+// of JSON as each thing happens (see apiEvent), and is done after
+// the one with "exit".
+func serve(s *StagingArea, config []configEntry) {
+	d := &daemonState{stage: s, config: config}
+
+	path := serveToken(s.Path)
+
+	// like the daemon's socket, where no one else can get at it
+	hardfail(os.MkdirAll(filepath.Dir(path), 0700))
+	hardfail(os.Chmod(filepath.Dir(path), 0700))
+
+	token, err := newToken(path)
+	hardfail(err)
+
+	srv := &http.Server{
+		Addr:    flagListen,
+		Handler: &apiGuard{token, d},
+
+		// an exec streams back for as long as it takes, so
+		// there's no WriteTimeout
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		<-sigs
+		srv.Close()
+	}()
+
+	go d.watch()
+
+	eprintf("serving %s on http://%s (token in %s)", s.Path, flagListen, path)
+
+	err = srv.ListenAndServe()
+	os.Remove(path)
+
+	if err != http.ErrServerClosed {
+		hardfail(err)
+	}
+}
+
+// serveToken is where mark serve keeps its token for the staging
+// file at path: in a directory only we can get into, named like
+// the daemon's socket (see daemonSocket)
+func serveToken(path string) string {
+	return filepath.Join(stateDir(), "serve", stateName(path)+".token")
+}
+
+// newToken makes a new random token for mark serve, and writes it
+// to path, for clients, where only we can read it
+func newToken(path string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	token := hex.EncodeToString(b)
+
+	// a file that's already there could be anyone's, with any
+	// permissions
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := f.WriteString(token + "\n"); err != nil {
+		f.Close()
+		return "", err
+	}
+
+	return token, f.Close()
+}
+
+// apiGuard lets through only requests with the token, and none
+// a web page could have made (see serve)
+type apiGuard struct {
+	token string
+	next  http.Handler
+}
+
+func (g *apiGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte(g.token)) != 1 {
+		apiError(w, http.StatusUnauthorized, "no token, or the wrong one")
+		return
+	}
+
+	if r.Header.Get("Origin") != "" {
+		apiError(w, http.StatusForbidden, "no requests from web pages")
+		return
+	}
+
+	if !loopbackHost(r.Host) {
+		apiError(w, http.StatusForbidden, "bad host "+r.Host)
+		return
+	}
+
+	if r.Method == "POST" {
+		if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+			apiError(w, http.StatusUnsupportedMediaType, "send application/json")
+			return
+		}
+	}
+
+	g.next.ServeHTTP(w, r)
+}
+
+// loopbackHost reports whether a request's Host is this machine,
+// by a name DNS can't rebind: localhost, a loopback address, or
+// just what -listen says
+func loopbackHost(host string) bool {
+	if host == flagListen {
+		return true
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// the body of a POST to /marks or /tags/<tag>
+type apiPaths struct {
+	Paths []string `json:"paths"`
+}
+
+// the body of a POST to /exec
+type apiExec struct {
+	Command []string `json:"command"`
+	Tag     string   `json:"tag"`
+	Match   string   `json:"match"`
+	Status  string   `json:"status"`
+	Retain  bool     `json:"retain"`
+}
+
+// apiEvent is a line of an exec's results: "output" from the
+// commands (on stdout or stderr), a "result" for each mark (as
+// with -report), the "summary" (as with -json), and finally
+// "exit", with the code mark exec would've exited with
+type apiEvent struct {
+	Event   string          `json:"event"`
+	Stream  string          `json:"stream,omitempty"`
+	Data    string          `json:"data,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Summary *jsonSummary    `json:"summary,omitempty"`
+	Exit    *int            `json:"exit,omitempty"`
+}
+
+func (d *daemonState) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	q := r.URL.Query()
+
+	// ?tag=, ?match= and ?status= are -tag, -match and -only
+	selecting := func() {
+		flagTagMatch, flagPathMatch, flagOnlyStatus = q.Get("tag"), q.Get("match"), q.Get("status")
+	}
+
+	switch {
+	case r.URL.Path == "/marks" && r.Method == "GET":
+		d.call(w, func(s *StagingArea) interface{} {
+			selecting()
+
+			index := map[*Mark]int{}
+			for i := range s.Marks {
+				index[&s.Marks[i]] = i
+			}
+
+			return listing(selectMarks(s), index)
+		})
+
+	case r.URL.Path == "/marks" && r.Method == "POST":
+		req := apiPaths{}
+		if !decode(w, r, &req) {
+			return
+		}
+
+		d.call(w, func(s *StagingArea) interface{} {
+			added := 0
+			for _, path := range req.Paths {
+				if add(s, path) {
+					added++
+				}
+			}
+
+			if added > 0 {
+				rewrite(s)
+			}
+
+			return map[string]int{"added": added}
+		})
+
+	case r.URL.Path == "/marks" && r.Method == "DELETE":
+		d.call(w, func(s *StagingArea) interface{} {
+			selecting()
+
+			kill := []*Mark{}
+
+			switch {
+			case len(q["path"]) > 0:
+				for _, path := range q["path"] {
+					kill = append(kill, matching(s, path)...)
+				}
+			case flagTagMatch != "" || flagPathMatch != "" || flagOnlyStatus != "":
+				kill = selectMarks(s)
+			default:
+				usage("which marks? (?path=, ?tag=, ?match= or ?status=)")
+			}
+
+			removed := s.Drop(kill)
+			if removed > 0 {
+				rewrite(s)
+			}
+
+			return map[string]int{"removed": removed}
+		})
+
+	case r.URL.Path == "/tags" && r.Method == "GET":
+		d.call(w, func(s *StagingArea) interface{} {
+			flagJSON = true
+
+			tags(s)
+			return nil
+		})
+
+	case strings.HasPrefix(r.URL.Path, "/tags/") && (r.Method == "POST" || r.Method == "DELETE"):
+		tag, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/tags/"))
+		if err != nil || tag == "" {
+			apiError(w, http.StatusBadRequest, "bad tag")
+			return
+		}
+
+		req := apiPaths{Paths: q["path"]}
+		if r.Method == "POST" && !decode(w, r, &req) {
+			return
+		}
+
+		d.call(w, func(s *StagingArea) interface{} {
+			marks := []*Mark{}
+
+			if len(req.Paths) == 0 {
+				for i := range s.Marks {
+					marks = append(marks, &s.Marks[i])
+				}
+			}
+
+			for _, path := range req.Paths {
+				marks = append(marks, matching(s, path)...)
+			}
+
+			changed := 0
+
+			for _, m := range marks {
+				if r.Method == "POST" && m.Tag(tag) || r.Method == "DELETE" && m.Untag(tag) {
+					changed++
+				}
+			}
+
+			if changed > 0 {
+				rewrite(s)
+			}
+
+			if r.Method == "DELETE" {
+				return map[string]int{"untagged": changed}
+			}
+
+			return map[string]int{"tagged": changed}
+		})
+
+	case r.URL.Path == "/exec" && r.Method == "POST":
+		req := apiExec{}
+		if !decode(w, r, &req) {
+			return
+		}
+
+		if len(req.Command) == 0 {
+			apiError(w, http.StatusBadRequest, "no command")
+			return
+		}
+
+		d.exec(w, req)
+
+	default:
+		apiError(w, http.StatusNotFound, "no such thing")
+	}
+}
+
+// call runs fn on the staging area (see daemonState.do), and
+// answers with what it returns, as JSON, or if it returns nil,
+// with what it wrote to stdout; if it exits nonzero, the answer
+// is what it wrote to stderr
+func (d *daemonState) call(w http.ResponseWriter, fn func(s *StagingArea) interface{}) {
+	var ret interface{}
+
+	out, errs := &strings.Builder{}, &strings.Builder{}
+
+	code, err := capture(
+		func(b string) { out.WriteString(b) },
+		func(b string) { errs.WriteString(b) },
+		func() int {
+			return d.do(func(s *StagingArea) int {
+				ret = fn(s)
+				return exitOK
+			})
+		})
+
+	if err != nil {
+		apiError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if code != exitOK {
+		status := http.StatusInternalServerError
+
+		switch code {
+		case exitUsage:
+			status = http.StatusBadRequest
+		case exitStaging:
+			status = http.StatusConflict
+		}
+
+		apiError(w, status, strings.TrimSpace(errs.String()))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if ret == nil {
+		w.Write([]byte(out.String()))
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.Encode(ret)
+}
+
+// exec runs a command, streaming back what happens (see apiEvent)
+func (d *daemonState) exec(w http.ResponseWriter, req apiExec) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	st := &apiStream{w: w, enc: json.NewEncoder(w)}
+	st.enc.SetEscapeHTML(false)
+
+	var summary *jsonSummary
+
+	code, err := capture(
+		func(b string) { st.send(apiEvent{Event: "output", Stream: "stdout", Data: b}) },
+		func(b string) { st.send(apiEvent{Event: "output", Stream: "stderr", Data: b}) },
+		func() int {
+			return d.do(func(s *StagingArea) int {
+				flagTagMatch, flagPathMatch, flagOnlyStatus = req.Tag, req.Match, req.Status
+				flagRetainMark = flagRetainMark || req.Retain
+
+				marks := selectMarks(s)
+				s.LastExec = req.Command
+
+				sum, err := runExec(s, req.Command, marks, st)
+				summary = &sum
+
+				return exitCode(err)
+			})
+		})
+
+	if err != nil {
+		st.send(apiEvent{Event: "output", Stream: "stderr", Data: err.Error() + "\n"})
+		code = exitFailed
+	}
+
+	if summary != nil {
+		st.send(apiEvent{Event: "summary", Summary: summary})
+	}
+
+	st.send(apiEvent{Event: "exit", Exit: &code})
+}
+
+// apiStream sends apiEvents as they happen; written to, it takes
+// each write for a line of -report (see writeReport)
+type apiStream struct {
+	lock sync.Mutex
+	w    http.ResponseWriter
+	enc  *json.Encoder
+}
+
+func (st *apiStream) send(e apiEvent) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	st.enc.Encode(e)
+
+	if f, ok := st.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (st *apiStream) Write(b []byte) (int, error) {
+	line := append(json.RawMessage{}, strings.TrimSpace(string(b))...)
+	st.send(apiEvent{Event: "result", Result: line})
+
+	return len(b), nil
+}
+
+// decode reads a request's JSON body, if it has one, into v,
+// answering with an error if it can't
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil && err != io.EOF {
+		apiError(w, http.StatusBadRequest, "bad request: "+err.Error())
+		return false
+	}
+
+	return true
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
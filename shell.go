@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// a command in availableCommands, and what it says about it
+type commandHelp struct {
+	name, about string
+}
+
+func commandList() []commandHelp {
+	ret := []commandHelp{}
+
+	for _, line := range strings.Split(availableCommands, "\n") {
+		if !strings.HasPrefix(line, "  ") {
+			continue
+		}
+
+		name, about, _ := strings.Cut(strings.TrimSpace(line), " ")
+		if !strings.HasPrefix(name, "-") {
+			ret = append(ret, commandHelp{name, about})
+		}
+	}
+
+	return ret
+}
+
+// commandNames is the commands in availableCommands
+func commandNames() []string {
+	names := []string{}
+	for _, c := range commandList() {
+		names = append(names, c.name)
+	}
+
+	return names
+}
+
+// commands whose arguments are files to find, rather than marks
+var fileCommands = map[string]bool{
+	"add": true, "pick": true, "import": true, "merge": true,
+	"intersect": true, "subtract": true, "refresh": true,
+}
+
+// saveFlags remembers every flag's value, returning a function
+// that puts them back
+func saveFlags() func() {
+	values := map[string]string{}
+	lists := map[string][]string{}
+	configured := map[string]bool{}
+
+	flag.VisitAll(func(f *flag.Flag) {
+		switch v := f.Value.(type) {
+		case listFlag:
+			lists[f.Name] = append([]string{}, *v.list...)
+			configured[f.Name] = *v.config
+		case tagFlag:
+			values[f.Name] = *v.expr
+			configured[f.Name] = *v.config
+		default:
+			values[f.Name] = f.Value.String()
+		}
+	})
+
+	return func() {
+		flag.VisitAll(func(f *flag.Flag) {
+			switch v := f.Value.(type) {
+			case listFlag:
+				*v.list = append([]string{}, lists[f.Name]...)
+				*v.config = configured[f.Name]
+			case tagFlag:
+				// setting -tag ands it onto what's there
+				*v.expr = values[f.Name]
+				*v.config = configured[f.Name]
+			default:
+				f.Value.Set(values[f.Name])
+			}
+		})
+	}
+}
+
+// resetFlags starts flag.CommandLine over, with the same flags
+// and values but none of them counted as set, so that what
+// parseCommandLine says a line set is just what it set
+func resetFlags() {
+	fresh := flag.NewFlagSet(flag.CommandLine.Name(), flag.CommandLine.ErrorHandling())
+	fresh.Usage = flag.CommandLine.Usage
+
+	flag.VisitAll(func(f *flag.Flag) {
+		fresh.Var(f.Value, f.Name, f.Usage)
+		fresh.Lookup(f.Name).DefValue = f.DefValue
+	})
+
+	flag.CommandLine = fresh
+}
+
+// shell reads commands, one per line, and runs them on the
+// staging area, which stays loaded (and locked) the whole time.
+// Flags on a line only last for that line.
+func shell(s *StagingArea, config []configEntry) {
+	restore := saveFlags()
+
+	// a bad flag or a failed command shouldn't end the shell
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	flag.CommandLine.Usage = func() {}
+	exit = func(code int) { panic(shellExit(code)) }
+
+	defer func() { exit = os.Exit }()
+
+	var read func() (string, error)
+
+	if isTerminal(os.Stdin) {
+		ed := &lineEditor{stage: s}
+		read = func() (string, error) { return ed.ReadLine("mark> ") }
+	} else {
+		scanner := bufio.NewScanner(os.Stdin)
+		read = func() (string, error) {
+			if !scanner.Scan() {
+				return "", errEOF
+			}
+
+			return scanner.Text(), nil
+		}
+	}
+
+	for {
+		line, err := read()
+		if err == errEOF {
+			return
+		}
+
+		if err != nil {
+			hardfail(err)
+		}
+
+		toks := staging.SplitTokens(line)
+		if len(toks) == 0 || strings.HasPrefix(toks[0], "#") {
+			continue
+		}
+
+		switch toks[0] {
+		case "exit", "quit":
+			return
+		case "help":
+			eprintf(availableCommands)
+			continue
+		case "shell", "areas", "daemon", "serve", "watch":
+			eprintf("not from the shell")
+			continue
+		}
+
+		shellCommand(s, config, toks)
+		restore()
+	}
+}
+
+// the code a command wanted to exit with, in the shell
+type shellExit int
+
+// shellCommand runs one line of the shell, returning the code
+// it exited with
+func shellCommand(s *StagingArea, config []configEntry, toks []string) (code int) {
+	defer func() {
+		if r := recover(); r != nil {
+			exited, isExit := r.(shellExit)
+			if !isExit {
+				panic(r)
+			}
+
+			code = int(exited)
+		}
+	}()
+
+	resetFlags()
+
+	command, args, set := parseCommandLine(toks)
+
+	if command == "run" && len(args) > 0 {
+		applyConfig(configPath(), args[0], config, set)
+	}
+
+	dispatch(s, config, command, args)
+	return exitOK
+}
+
+// a bare-bones readline: editing, history and tab completion
+type lineEditor struct {
+	stage   *StagingArea
+	history []string
+}
+
+var errEOF = errors.New("end of input")
+
+// ReadLine reads a line from the terminal, ^D on an empty line
+// being the end of input
+func (ed *lineEditor) ReadLine(prompt string) (string, error) {
+	t, err := openTerminal()
+	if err != nil {
+		return "", err
+	}
+	defer t.Close()
+
+	line := []rune{}
+	pos := 0
+	back := len(ed.history)
+
+	redraw := func() {
+		fmt.Fprintf(t.f, "\r\x1b[K%s%s", prompt, string(line))
+		if n := len(line) - pos; n > 0 {
+			fmt.Fprintf(t.f, "\x1b[%dD", n)
+		}
+	}
+
+	redraw()
+
+	for {
+		key, err := t.ReadKey()
+		if err != nil {
+			return "", err
+		}
+
+		switch key {
+		case "enter":
+			fmt.Fprintf(t.f, "\r\n")
+
+			if strings.TrimSpace(string(line)) != "" {
+				ed.history = append(ed.history, string(line))
+			}
+
+			return string(line), nil
+
+		case "ctrl-d":
+			if len(line) == 0 {
+				fmt.Fprintf(t.f, "\r\n")
+				return "", errEOF
+			}
+
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+
+		case "ctrl-c":
+			fmt.Fprintf(t.f, "^C\r\n")
+			line, pos = line[:0], 0
+
+		case "left", "ctrl-b":
+			if pos > 0 {
+				pos--
+			}
+
+		case "right", "ctrl-f":
+			if pos < len(line) {
+				pos++
+			}
+
+		case "home", "ctrl-a":
+			pos = 0
+
+		case "end", "ctrl-e":
+			pos = len(line)
+
+		case "backspace":
+			if pos > 0 {
+				line = append(line[:pos-1], line[pos:]...)
+				pos--
+			}
+
+		case "delete":
+			if pos < len(line) {
+				line = append(line[:pos], line[pos+1:]...)
+			}
+
+		case "ctrl-u":
+			line, pos = append([]rune{}, line[pos:]...), 0
+
+		case "ctrl-k":
+			line = line[:pos]
+
+		case "ctrl-w":
+			start := pos
+			for start > 0 && line[start-1] == ' ' {
+				start--
+			}
+
+			for start > 0 && line[start-1] != ' ' {
+				start--
+			}
+
+			line, pos = append(line[:start], line[pos:]...), start
+
+		case "up", "ctrl-p", "down", "ctrl-n":
+			if key == "up" || key == "ctrl-p" {
+				if back == 0 {
+					continue
+				}
+
+				back--
+			} else {
+				if back >= len(ed.history) {
+					continue
+				}
+
+				back++
+			}
+
+			line = []rune{}
+			if back < len(ed.history) {
+				line = []rune(ed.history[back])
+			}
+
+			pos = len(line)
+
+		case "tab":
+			head := string(line[:pos])
+			done, shown := ed.complete(head)
+
+			if len(shown) > 0 {
+				fmt.Fprintf(t.f, "\r\n%s\r\n", strings.Join(shown, "  "))
+			}
+
+			line = append([]rune(done), line[pos:]...)
+			pos = len([]rune(done))
+
+		default:
+			if r := []rune(key); len(r) == 1 {
+				line = append(line[:pos], append(r, line[pos:]...)...)
+				pos++
+			}
+		}
+
+		redraw()
+	}
+}
+
+// complete finishes the last word of head, as far as it can,
+// returning the new head and, if there's more than one way to
+// go, the choices
+func (ed *lineEditor) complete(head string) (string, []string) {
+	words := strings.Fields(head)
+	if len(words) == 0 || strings.HasSuffix(head, " ") {
+		words = append(words, "")
+	}
+
+	word := words[len(words)-1]
+	before := strings.TrimSuffix(head, word)
+
+	// the command is the first word that isn't a flag
+	command, position := "", 0
+	for _, w := range words[:len(words)-1] {
+		if strings.HasPrefix(w, "-") {
+			continue
+		}
+
+		if command == "" {
+			command = w
+		}
+
+		position++
+	}
+
+	candidates := []string{}
+
+	switch {
+	case strings.HasPrefix(word, "-"):
+		flag.VisitAll(func(f *flag.Flag) {
+			candidates = append(candidates, "-"+f.Name)
+		})
+
+	case command == "":
+		candidates = commandNames()
+
+	case strings.HasPrefix(word, "@"):
+		for _, tag := range ed.tags() {
+			candidates = append(candidates, "@"+tag)
+		}
+
+	case (command == "tag" || command == "untag" || command == "tag-rename" || command == "tag-rm") && position == 1:
+		candidates = ed.tags()
+
+	case fileCommands[command]:
+		candidates = completeFile(word)
+
+	default:
+		for _, m := range ed.stage.Marks {
+			candidates = append(candidates, m.Path)
+		}
+	}
+
+	matches := []string{}
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+
+	sort.Strings(matches)
+
+	switch len(matches) {
+	case 0:
+		return head, nil
+	case 1:
+		done := before + staging.QuoteToken(matches[0])
+		if !strings.HasSuffix(matches[0], "/") {
+			done += " "
+		}
+
+		return done, nil
+	}
+
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+
+	if len(common) > len(word) {
+		return before + common, nil
+	}
+
+	return head, matches
+}
+
+// tags is every tag in the staging area
+func (ed *lineEditor) tags() []string {
+	seen := map[string]bool{}
+	tags := []string{}
+
+	for _, m := range ed.stage.Marks {
+		for _, t := range m.Tags {
+			if !seen[t] {
+				seen[t] = true
+				tags = append(tags, t)
+			}
+		}
+	}
+
+	return tags
+}
+
+// completeFile is the files that start with word, with a slash
+// on the end of the directories
+func completeFile(word string) []string {
+	found, _ := filepath.Glob(word + "*")
+
+	ret := []string{}
+	for _, path := range found {
+		if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+			path += "/"
+		}
+
+		ret = append(ret, path)
+	}
+
+	return ret
+}
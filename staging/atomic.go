@@ -0,0 +1,92 @@
+package staging
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteAtomic replaces the file at path with whatever write
+// writes, so that anyone reading it sees either the old
+// contents or the new, never half of each. The new contents
+// go to a temporary file next to the old one (so the rename
+// can't cross filesystems), get synced, and are renamed over
+// it. If that can't be done (say, the directory isn't ours to
+// write), the file is overwritten in place instead.
+func WriteAtomic(path string, write func(io.Writer) error) error {
+	// keep symlinked staging files (dotfile managers) symlinked
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	dir := filepath.Dir(path)
+
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".")
+	if err != nil {
+		return writeInPlace(path, write)
+	}
+
+	tmp := f.Name()
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	os.Chmod(tmp, mode)
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return writeInPlace(path, write)
+	}
+
+	// make the rename itself durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// writeInPlace is the fallback for WriteAtomic: it builds the
+// new contents in memory first, so a failing write can't leave
+// the file truncated, then overwrites the file with them
+func writeInPlace(path string, write func(io.Writer) error) error {
+	buf := &bytes.Buffer{}
+	if err := write(buf); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = buf.WriteTo(f)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
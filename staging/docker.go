@@ -0,0 +1,99 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Docker is the Runner that runs commands in a container, one
+// per command, from Image. Each mark's file (or with Dir, the
+// directory it's in) is bind-mounted in at the same path, so the
+// command line works as it is; ReadOnly mounts them read-only.
+// Commands run as the user and group mark runs as, so what they
+// write isn't root's.
+type Docker struct {
+	Image string
+
+	// the docker command ("docker" if it's empty; podman works)
+	Command []string
+
+	Dir, ReadOnly bool
+}
+
+func (r Docker) Run(ctx context.Context, c *Command) Result {
+	docker := r.Command
+	if len(docker) == 0 {
+		docker = []string{"docker"}
+	}
+
+	argv := append(append([]string{}, docker...), "run", "--rm")
+
+	if c.Stdin != nil {
+		argv = append(argv, "-i")
+	}
+
+	if uid, gid := os.Getuid(), os.Getgid(); uid >= 0 && gid >= 0 {
+		argv = append(argv, "--user", strconv.Itoa(uid)+":"+strconv.Itoa(gid))
+	}
+
+	mounted := map[string]bool{}
+
+	for _, m := range c.Marks {
+		if m.Host() != "" {
+			return Result{Exit: -1, Err: fmt.Errorf("%s is on %s, not here", m.Path, m.Host())}
+		}
+
+		src := path.Clean(m.Path)
+		if r.Dir {
+			src = path.Dir(src)
+		}
+
+		if mounted[src] {
+			continue
+		}
+
+		mounted[src] = true
+
+		// unlike -v, --mount won't make up a directory for a
+		// file that's gone, or stop at a ":" in the path
+		mount := "type=bind," + mountField("source", src) + "," + mountField("target", src)
+		if r.ReadOnly {
+			mount += ",readonly"
+		}
+
+		argv = append(argv, "--mount", mount)
+	}
+
+	if c.Dir != "" {
+		argv = append(argv, "-w", c.Dir)
+	}
+
+	for _, kv := range c.Env {
+		argv = append(argv, "-e", kv)
+	}
+
+	argv = append(append(argv, r.Image), c.Argv...)
+
+	return Local{}.Run(ctx, &Command{
+		Marks:  c.Marks,
+		Argv:   argv,
+		Stdin:  c.Stdin,
+		Stdout: c.Stdout,
+		Stderr: c.Stderr,
+	})
+}
+
+// mountField is key=val for --mount, which is CSV, so it's quoted
+// if val has a comma or quote in it
+func mountField(key, val string) string {
+	field := key + "=" + val
+	if strings.ContainsAny(field, ",\"\n") {
+		field = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+	}
+
+	return field
+}
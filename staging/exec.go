@@ -0,0 +1,903 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInterrupted is returned by Exec when it's cut short by
+// Options.Interrupt
+var ErrInterrupted = errors.New("interrupted")
+
+// Linux caps any one argument at 128k (MAX_ARG_STRLEN), and
+// since the whole command goes to sh -c as one argument, that's
+// the limit for a batch, less some slack
+const argMax = 128*1024 - 4096
+
+// Options says how Exec, Probe and Capture run commands. The
+// zero value runs them one at a time, through sh, with their
+// output going to stdout and stderr.
+type Options struct {
+	// the shell commands run under ("sh" if it's empty), or with
+	// NoShell, none: the first argument is the program to run
+	Shell   string
+	NoShell bool
+
+	// how many commands run at once
+	Jobs int
+
+	// Batch runs the command once for groups of marks, of at
+	// most BatchSize (if it's set), rather than once per mark
+	// (see Exec); List runs it just once, with the paths on its
+	// stdin, NUL-delimited with NullDelim
+	Batch     bool
+	BatchSize int
+	List      bool
+	NullDelim bool
+
+	// Stdin feeds each command its mark's file; Chdir runs it in
+	// the mark's directory
+	Stdin bool
+	Chdir bool
+
+	// Halt stops starting commands after the first one fails;
+	// failures are tried again Retries times, Backoff apart (and
+	// twice that the next time, and so on); and commands running
+	// longer than Timeout, if it's set, are killed
+	Halt    bool
+	Retries int
+	Backoff time.Duration
+	Timeout time.Duration
+
+	// Prefix puts the mark's path at the start of every line a
+	// command writes, and Quickfix rewrites them as quickfix
+	// entries (see QuickfixLine); Print writes each command to
+	// Stdout before running it, and DryRun does that instead of
+	// running it
+	Prefix   bool
+	Quickfix bool
+	Print    bool
+	DryRun   bool
+
+	Stdout, Stderr io.Writer
+
+	// what runs the commands; Local, if it's nil
+	Runner Runner
+
+	// Confirm, if it's set, is asked before each command runs:
+	// 'y' to run it, 'n' to skip it, 'a' to run it and the rest
+	// without asking, or 'q' to stop there
+	Confirm func(job *Job) byte
+
+	// Done, if it's set, is told about each command once it's
+	// finished and its marks are updated
+	Done func(job *Job)
+
+	// on the first value from Interrupt, Exec starts no more
+	// commands and lets the ones running finish; on the second,
+	// it kills them
+	Interrupt <-chan os.Signal
+}
+
+// an executor runs commands with a set of Options
+type executor struct {
+	*Options
+
+	// canceled to kill whatever is running
+	ctx context.Context
+
+	outLock sync.Mutex
+}
+
+func newExecutor(opts *Options) *executor {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	o := *opts
+
+	if o.Shell == "" {
+		o.Shell = "sh"
+	}
+
+	if o.Jobs < 1 {
+		o.Jobs = 1
+	}
+
+	if o.Stdout == nil {
+		o.Stdout = os.Stdout
+	}
+
+	if o.Stderr == nil {
+		o.Stderr = os.Stderr
+	}
+
+	if o.Runner == nil {
+		o.Runner = Local{}
+	}
+
+	return &executor{Options: &o, ctx: context.Background()}
+}
+
+// output writes the buffered output of a completed command (see
+// run); all we have to do here is keep commands running in
+// parallel from writing over each other
+func (e *executor) output(out []byte) {
+	e.outLock.Lock()
+	defer e.outLock.Unlock()
+
+	e.Stdout.Write(out)
+}
+
+// ShellQuote quotes s for sh, if it needs it
+func ShellQuote(s string) string {
+	safe := s != ""
+
+	for _, c := range s {
+		if !strings.ContainsRune("-_./,:=+@%", c) &&
+			!(c >= 'a' && c <= 'z') &&
+			!(c >= 'A' && c <= 'Z') &&
+			!(c >= '0' && c <= '9') {
+			safe = false
+			break
+		}
+	}
+
+	if safe {
+		return s
+	}
+
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// expandArg expands placeholders in a command argument for m;
+// values substituted into a command for sh are quoted, so
+// paths with spaces and other junk in them survive
+func (e *executor) expandArg(m *Mark, arg string) (string, error) {
+	if e.NoShell {
+		return m.Expand(arg)
+	}
+
+	return m.ExpandQuoted(arg, ShellQuote)
+}
+
+// argv is the whole command line for fully expanded args: sh
+// -c (or the Shell's -c) with the args joined, or with NoShell,
+// the args as-is
+func (e *executor) argv(args []string) ([]string, error) {
+	if !e.NoShell {
+		return []string{e.Shell, "-c", strings.Join(args, " ")}, nil
+	}
+
+	if len(args) == 0 || args[0] == "" {
+		return nil, fmt.Errorf("no command to run")
+	}
+
+	return args, nil
+}
+
+// Invocation is a fully expanded command, ready to run
+type Invocation struct {
+	Args []string
+
+	// the marks it's for
+	Marks []*Mark
+
+	// added to the environment
+	Env []string
+
+	// where to run, if not here
+	Dir string
+
+	// what to prefix output lines with, for Options.Prefix
+	Label string
+
+	// files to feed the command on stdin, for Options.Stdin
+	Stdin []string
+
+	// or for Options.List, paths to write to the command's stdin
+	List []string
+
+	// where stdout goes, if not the usual place
+	Capture io.Writer
+
+	// filled in once it's run: how the command exited (-1 if it
+	// never did, say because it timed out), how long it took,
+	// and how much output it wrote
+	Exit           int
+	Duration       time.Duration
+	Stdout, Stderr int64
+
+	// how it runs
+	opts *Options
+}
+
+// String renders the command as a line of sh script, safe to
+// paste into a terminal or save and run later
+func (inv *Invocation) String() string {
+	line := ""
+
+	if inv.opts.NoShell {
+		quoted := []string{}
+		for _, arg := range inv.Args {
+			quoted = append(quoted, ShellQuote(arg))
+		}
+
+		line = strings.Join(quoted, " ")
+	} else if inv.opts.Shell == "sh" {
+		line = strings.Join(inv.Args, " ")
+	} else {
+		line = inv.opts.Shell + " -c " + ShellQuote(strings.Join(inv.Args, " "))
+	}
+
+	if len(inv.List) > 0 {
+		format := `'%s\n'`
+		if inv.opts.NullDelim {
+			format = `'%s\0'`
+		}
+
+		quoted := []string{}
+		for _, p := range inv.List {
+			quoted = append(quoted, ShellQuote(p))
+		}
+
+		line = "printf " + format + " " + strings.Join(quoted, " ") + " | " + line
+	}
+
+	if len(inv.Stdin) == 1 {
+		line += " < " + ShellQuote(inv.Stdin[0])
+	} else if len(inv.Stdin) > 1 {
+		quoted := []string{}
+		for _, p := range inv.Stdin {
+			quoted = append(quoted, ShellQuote(p))
+		}
+
+		line = "cat " + strings.Join(quoted, " ") + " | " + line
+	}
+
+	if inv.Dir != "" {
+		line = fmt.Sprintf("(cd %s && %s)", ShellQuote(inv.Dir), line)
+	}
+
+	return line
+}
+
+// run runs a command (see argv) with the Runner, unless DryRun
+// is set, in which case just print it. With a Timeout, commands
+// that run too long are killed and fail.
+func (e *executor) run(inv *Invocation) error {
+	if e.DryRun || e.Print {
+		fmt.Fprintln(e.Stdout, inv.String())
+
+		if e.DryRun {
+			return nil
+		}
+	}
+
+	// if something stops it before it starts, it has no exit
+	// code to go by
+	inv.Exit = -1
+
+	ctx := e.ctx
+
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+
+	argv, err := e.argv(inv.Args)
+	if err != nil {
+		return err
+	}
+
+	cmd := &Command{
+		Marks: inv.Marks,
+		Argv:  argv,
+		Env:   inv.Env,
+		Dir:   inv.Dir,
+	}
+
+	// one at a time, output can go straight to the terminal,
+	// but in parallel it has to be held until the command is
+	// done, or it'd be interleaved with everything else
+	out := &bytes.Buffer{}
+
+	if e.Jobs > 1 {
+		cmd.Stdout = out
+		cmd.Stderr = out
+	} else {
+		cmd.Stdout = e.Stdout
+		cmd.Stderr = e.Stderr
+	}
+
+	var qout, qerr *quickfixWriter
+
+	if e.Quickfix {
+		qout = &quickfixWriter{w: cmd.Stdout, file: inv.Label}
+		qerr = &quickfixWriter{w: cmd.Stderr, file: inv.Label}
+		cmd.Stdout, cmd.Stderr = qout, qerr
+	} else if e.Prefix && inv.Label != "" {
+		cmd.Stdout = &prefixWriter{w: cmd.Stdout, prefix: inv.Label + ":"}
+		cmd.Stderr = &prefixWriter{w: cmd.Stderr, prefix: inv.Label + ":"}
+	}
+
+	if inv.Capture != nil {
+		cmd.Stdout = inv.Capture
+	}
+
+	if len(inv.Stdin) > 0 {
+		readers := []io.Reader{}
+
+		for _, p := range inv.Stdin {
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+
+			defer f.Close()
+
+			readers = append(readers, f)
+		}
+
+		cmd.Stdin = io.MultiReader(readers...)
+	}
+
+	if len(inv.List) > 0 {
+		delim := "\n"
+		if e.NullDelim {
+			delim = "\x00"
+		}
+
+		cmd.Stdin = strings.NewReader(strings.Join(inv.List, delim) + delim)
+	}
+
+	stdout := &countWriter{w: cmd.Stdout}
+	stderr := &countWriter{w: cmd.Stderr}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	res := e.Runner.Run(ctx, cmd)
+
+	// a last line without a newline is still a line
+	if e.Quickfix {
+		qout.Flush()
+		qerr.Flush()
+	}
+
+	inv.Duration = res.Duration
+	inv.Exit = res.Exit
+	inv.Stdout = stdout.n
+	inv.Stderr = stderr.n
+
+	e.output(out.Bytes())
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", e.Timeout)
+	}
+
+	return res.Err
+}
+
+// countWriter counts what's written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// prefixWriter puts prefix at the start of every line written
+// through it, like grep -H
+type prefixWriter struct {
+	w      io.Writer
+	prefix string
+
+	// partway through a line
+	mid bool
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for len(b) > 0 {
+		if !p.mid {
+			if _, err := io.WriteString(p.w, p.prefix); err != nil {
+				return 0, err
+			}
+
+			p.mid = true
+		}
+
+		line := b
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line = b[:i+1]
+			p.mid = false
+		}
+
+		if _, err := p.w.Write(line); err != nil {
+			return 0, err
+		}
+
+		b = b[len(line):]
+	}
+
+	return n, nil
+}
+
+// invocation expands placeholders in args (see expandArg) into
+// the command to run for m
+func (e *executor) invocation(m *Mark, args []string) (*Invocation, error) {
+	nargs, err := e.expandArgs(m, args)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invocation{
+		Args:  nargs,
+		Marks: []*Mark{m},
+		Env:   m.Env(),
+		Dir:   e.workDir(m),
+		Label: m.Path,
+		opts:  e.Options,
+	}
+
+	if e.Stdin {
+		inv.Stdin = []string{m.Path}
+	}
+
+	return inv, nil
+}
+
+func (e *executor) expandArgs(m *Mark, args []string) ([]string, error) {
+	nargs := []string{}
+
+	for _, arg := range args {
+		narg, err := e.expandArg(m, arg)
+		if err != nil {
+			return nil, err
+		}
+
+		nargs = append(nargs, narg)
+	}
+
+	return nargs, nil
+}
+
+// workDir is where m's commands run: with Chdir, its directory,
+// otherwise wherever we are
+func (e *executor) workDir(m *Mark) string {
+	if e.Chdir {
+		return path.Dir(m.Path)
+	}
+
+	return ""
+}
+
+// Env is the mark's context, exported to the environment of the
+// commands it runs
+func (m *Mark) Env() []string {
+	return []string{
+		"MARK_PATH=" + m.Path,
+		"MARK_BASE=" + path.Base(m.Path),
+		"MARK_DIR=" + path.Dir(m.Path),
+		"MARK_TAGS=" + strings.Join(m.Tags, " "),
+		"MARK_INDEX=" + strconv.Itoa(m.index),
+		"MARK_TOTAL=" + strconv.Itoa(m.total),
+	}
+}
+
+// batchInvocation builds one command for a whole batch of marks
+// (see Batch): an argument containing placeholders is expanded
+// once for each mark, so "tar cf out.tar _" gets every path. Of
+// the per-mark environment, only MARK_TOTAL makes sense here.
+// With Stdin, the command reads all the files, one after the
+// other.
+func (e *executor) batchInvocation(args []string, marks []*Mark) (*Invocation, error) {
+	nargs, err := e.expandBatch(args, marks)
+	if err != nil {
+		return nil, err
+	}
+
+	inv := &Invocation{
+		Args:  nargs,
+		Marks: marks,
+		Env: []string{
+			"MARK_TOTAL=" + strconv.Itoa(marks[0].total),
+		},
+		Dir:  e.workDir(marks[0]),
+		opts: e.Options,
+	}
+
+	if e.Stdin {
+		for _, m := range marks {
+			inv.Stdin = append(inv.Stdin, m.Path)
+		}
+	}
+
+	return inv, nil
+}
+
+// listInvocation builds the command for List, which runs once,
+// reading every path on stdin
+func (e *executor) listInvocation(args []string, marks []*Mark) *Invocation {
+	inv := &Invocation{
+		Args:  args,
+		Marks: marks,
+		Env: []string{
+			"MARK_TOTAL=" + strconv.Itoa(len(marks)),
+		},
+		opts: e.Options,
+	}
+
+	for _, m := range marks {
+		inv.List = append(inv.List, m.Path)
+	}
+
+	return inv
+}
+
+func (e *executor) expandBatch(args []string, marks []*Mark) ([]string, error) {
+	nargs := []string{}
+
+	for _, arg := range args {
+		if !hasPlaceholder(arg) {
+			nargs = append(nargs, arg)
+			continue
+		}
+
+		for _, m := range marks {
+			narg, err := e.expandArg(m, arg)
+			if err != nil {
+				return nil, err
+			}
+
+			nargs = append(nargs, narg)
+		}
+	}
+
+	return nargs, nil
+}
+
+// batches splits marks into groups for Batch, of at most
+// BatchSize marks each (if it's set) and short enough to stay
+// under argMax. With Chdir, a group only holds marks from the
+// same directory.
+func (e *executor) batches(args []string, marks []*Mark) [][]*Mark {
+	ret := [][]*Mark{}
+
+	base := 0
+	for _, arg := range args {
+		if !hasPlaceholder(arg) {
+			base += len(arg) + 1
+		}
+	}
+
+	cur := []*Mark{}
+	size := base
+
+	for _, m := range marks {
+		cost := 0
+		for _, arg := range args {
+			if hasPlaceholder(arg) {
+				narg, _ := e.expandArg(m, arg)
+				cost += len(narg) + 1
+			}
+		}
+
+		full := e.BatchSize > 0 && len(cur) == e.BatchSize
+		moved := len(cur) > 0 && e.workDir(cur[0]) != e.workDir(m)
+
+		if len(cur) > 0 && (full || moved || size+cost > argMax) {
+			ret = append(ret, cur)
+			cur = []*Mark{}
+			size = base
+		}
+
+		cur = append(cur, m)
+		size += cost
+	}
+
+	if len(cur) > 0 {
+		ret = append(ret, cur)
+	}
+
+	return ret
+}
+
+// Job is a unit of work for Exec: the command for one mark, or
+// with Batch or List, for a group of them, and how running it
+// went
+type Job struct {
+	Marks []*Mark
+	Inv   *Invocation
+	Err   error
+}
+
+// Select returns the marks in the staging area that a command
+// should run on: if tag is nonempty, only files matching the tag
+// expression (see parseTagExpr), if pat is nonempty, only files
+// matching pat (see Matching), and if state is nonempty, only
+// files in that State
+func (s *Area) Select(tag, pat, state string) ([]*Mark, error) {
+	ret := []*Mark{}
+
+	var expr tagExpr
+
+	if tag != "" {
+		var err error
+
+		expr, err = parseTagExpr(tag)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrBadPattern, err)
+		}
+	}
+
+	var hits map[*Mark]bool
+
+	if pat != "" {
+		matched, err := s.Matching(pat)
+		if err != nil {
+			return nil, err
+		}
+
+		hits = map[*Mark]bool{}
+		for _, m := range matched {
+			hits[m] = true
+		}
+	}
+
+	for i, m := range s.Marks {
+		if state != "" && m.State() != state {
+			continue
+		}
+
+		if hits != nil && !hits[&s.Marks[i]] {
+			continue
+		}
+
+		if expr != nil && !expr(&s.Marks[i]) {
+			continue
+		}
+
+		ret = append(ret, &s.Marks[i])
+	}
+
+	return ret, nil
+}
+
+// retry runs fn, and with Retries, runs it again while it fails,
+// backing off exponentially, unless we're told to stop
+func (e *executor) retry(stop chan bool, fn func() error) error {
+	err := fn()
+
+	delay := e.Backoff
+
+	for i := 0; err != nil && i < e.Retries; i++ {
+		select {
+		case <-time.After(delay):
+		case <-stop:
+			return err
+		}
+
+		delay *= 2
+
+		err = fn()
+	}
+
+	return err
+}
+
+// Exec executes the command "args" across todo, marks from the
+// staging area (see Select). Up to Jobs commands run at once,
+// and if there's a Confirm, it's asked before each one.
+//
+// With Batch, the command runs once for batches of marks rather
+// than once per mark (see batchInvocation), and with List, just
+// once (see listInvocation). With Halt, no more commands start
+// after the first one fails.
+//
+// Each mark records how it went in its Status (see also
+// Unfinished): "done" or "failed" once its command runs, and
+// until then, "pending".
+//
+// On an Interrupt, no more commands start, and the ones running
+// are allowed to finish; a second one kills them. Either way,
+// Exec returns ErrInterrupted, and the marks that didn't get to
+// finish are left pending, to be picked up later.
+func (s *Area) Exec(args []string, todo []*Mark, opts *Options) (completed int, rerr error) {
+	for i, m := range todo {
+		m.index = i + 1
+		m.total = len(todo)
+		m.Status = "pending"
+		m.When = time.Time{}
+		m.Ran = false
+	}
+
+	e := newExecutor(opts)
+
+	var cancel context.CancelFunc
+
+	e.ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	groups := [][]*Mark{}
+
+	if e.List {
+		if len(todo) > 0 {
+			groups = append(groups, todo)
+		}
+	} else if e.Batch {
+		groups = e.batches(args, todo)
+	} else {
+		for _, m := range todo {
+			groups = append(groups, []*Mark{m})
+		}
+	}
+
+	work := make(chan *Job)
+	results := make(chan *Job)
+	stop := make(chan bool)
+
+	haltOnce := sync.Once{}
+	halt := func() {
+		haltOnce.Do(func() { close(stop) })
+	}
+
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < e.Jobs; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for job := range work {
+				// halted while it was on its way here; its
+				// marks stay pending
+				select {
+				case <-stop:
+					continue
+				default:
+				}
+
+				if job.Err == nil {
+					job.Err = e.retry(stop, func() error {
+						return e.run(job.Inv)
+					})
+				}
+
+				// before this worker, or another, can start
+				// the next one
+				if job.Err != nil && e.Halt {
+					halt()
+				}
+
+				results <- job
+			}
+		}()
+	}
+
+	go func() {
+		defer func() {
+			close(work)
+			wg.Wait()
+			close(results)
+		}()
+
+		prompt := e.Confirm != nil && !e.DryRun
+
+		for _, marks := range groups {
+			job := &Job{Marks: marks}
+
+			if e.List {
+				job.Inv = e.listInvocation(args, marks)
+			} else if e.Batch {
+				job.Inv, job.Err = e.batchInvocation(args, marks)
+			} else {
+				job.Inv, job.Err = e.invocation(marks[0], args)
+			}
+
+			if prompt && job.Err == nil {
+				switch e.Confirm(job) {
+				case 'n':
+					continue
+				case 'a':
+					prompt = false
+				case 'q':
+					return
+				}
+			}
+
+			select {
+			case work <- job:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	halted := false
+	interrupted := false
+
+	for results != nil {
+		var r *Job
+
+		select {
+		case <-e.Interrupt:
+			if !interrupted {
+				fmt.Fprintln(e.Stderr, "interrupted; waiting for running commands (^C again to kill them)")
+				interrupted = true
+				halt()
+			} else {
+				fmt.Fprintln(e.Stderr, "killing running commands")
+				cancel()
+			}
+
+			continue
+
+		case job, open := <-results:
+			if !open {
+				results = nil
+				continue
+			}
+
+			r = job
+		}
+
+		for _, m := range r.Marks {
+			m.Ran = true
+
+			if r.Err != nil && interrupted {
+				continue
+			}
+
+			m.Status = "done"
+			if r.Err != nil {
+				m.Status = "failed"
+			}
+
+			m.Exit = -1
+			if r.Inv != nil {
+				m.Exit = r.Inv.Exit
+			}
+
+			m.When = time.Now()
+		}
+
+		if e.Done != nil {
+			e.Done(r)
+		}
+
+		if r.Err != nil && e.Halt && !halted {
+			fmt.Fprintln(e.Stderr, "halting after first failure")
+			halted = true
+		}
+
+		if r.Err != nil {
+			rerr = r.Err
+		} else {
+			completed += len(r.Marks)
+		}
+	}
+
+	if interrupted {
+		rerr = ErrInterrupted
+	}
+
+	return completed, rerr
+}
@@ -0,0 +1,338 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRunner runs nothing: it records the commands it's given, and
+// they exit however exit says, for the try'th (from 1) time a
+// command runs for a mark. Marks with "slow" in their paths run
+// until they're canceled; the rest take delay.
+type fakeRunner struct {
+	exit  func(path string, try int) int
+	delay time.Duration
+
+	lock             sync.Mutex
+	calls            [][]string
+	tries            map[string]int
+	running, busiest int
+}
+
+func (r *fakeRunner) Run(ctx context.Context, c *Command) Result {
+	r.lock.Lock()
+	r.calls = append(r.calls, c.Argv)
+
+	if r.tries == nil {
+		r.tries = map[string]int{}
+	}
+
+	exit := 0
+	for _, m := range c.Marks {
+		r.tries[m.Path]++
+
+		if r.exit != nil {
+			if code := r.exit(m.Path, r.tries[m.Path]); code != 0 {
+				exit = code
+			}
+		}
+	}
+
+	slow := strings.Contains(c.Marks[0].Path, "slow")
+
+	r.running++
+	if r.running > r.busiest {
+		r.busiest = r.running
+	}
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		r.running--
+		r.lock.Unlock()
+	}()
+
+	if slow {
+		<-ctx.Done()
+		return Result{Exit: -1, Err: ctx.Err()}
+	}
+
+	time.Sleep(r.delay)
+
+	if exit != 0 {
+		return Result{Exit: exit, Duration: r.delay, Err: fmt.Errorf("exit status %d", exit)}
+	}
+
+	return Result{Duration: r.delay}
+}
+
+// failing is an exit func for a fakeRunner: paths with "bad" in
+// them fail, and ones with "flaky" fail the first two tries
+func failing(path string, try int) int {
+	switch {
+	case strings.Contains(path, "bad"):
+		return 1
+	case strings.Contains(path, "flaky") && try <= 2:
+		return 2
+	}
+
+	return 0
+}
+
+func TestExec(t *testing.T) {
+	tests := []struct {
+		name  string
+		paths []string
+		args  []string
+		opts  Options
+		delay time.Duration
+
+		// how many commands ran, how many marks completed, and
+		// how each mark ended up (status, exit code)
+		calls     int
+		completed int
+		status    []string
+		exits     []int
+
+		// if it's set, what the error has to say
+		err string
+
+		// the most commands running at once
+		busiest int
+
+		// the least time it all should take
+		took time.Duration
+	}{
+		{
+			name:      "one per mark",
+			paths:     []string{"/a", "/b", "/c"},
+			calls:     3,
+			completed: 3,
+			status:    []string{"done", "done", "done"},
+			exits:     []int{0, 0, 0},
+			busiest:   1,
+		},
+		{
+			name:      "failures",
+			paths:     []string{"/a", "/bad", "/c"},
+			calls:     3,
+			completed: 2,
+			status:    []string{"done", "failed", "done"},
+			exits:     []int{0, 1, 0},
+			err:       "exit status 1",
+		},
+		{
+			name:      "batches",
+			paths:     []string{"/a", "/b", "/c", "/d", "/e"},
+			opts:      Options{Batch: true, BatchSize: 2},
+			calls:     3,
+			completed: 5,
+			status:    []string{"done", "done", "done", "done", "done"},
+		},
+		{
+			name:      "a failed batch fails all its marks",
+			paths:     []string{"/a", "/bad", "/c"},
+			opts:      Options{Batch: true, BatchSize: 2},
+			calls:     2,
+			completed: 1,
+			status:    []string{"failed", "failed", "done"},
+			err:       "exit status 1",
+		},
+		{
+			name:      "list",
+			paths:     []string{"/a", "/b", "/c"},
+			opts:      Options{List: true},
+			calls:     1,
+			completed: 3,
+			status:    []string{"done", "done", "done"},
+		},
+		{
+			name:      "parallel",
+			paths:     []string{"/a", "/b", "/c", "/d", "/e", "/f"},
+			opts:      Options{Jobs: 3},
+			delay:     20 * time.Millisecond,
+			calls:     6,
+			completed: 6,
+			busiest:   3,
+		},
+		{
+			name:      "halt",
+			paths:     []string{"/a", "/bad", "/c"},
+			opts:      Options{Halt: true},
+			calls:     2,
+			completed: 1,
+			status:    []string{"done", "failed", "pending"},
+			err:       "exit status 1",
+		},
+		{
+			name:      "retries",
+			paths:     []string{"/flaky", "/bad"},
+			opts:      Options{Retries: 2, Backoff: 10 * time.Millisecond},
+			calls:     6,
+			completed: 1,
+			status:    []string{"done", "failed"},
+			exits:     []int{0, 1},
+			err:       "exit status 1",
+
+			// 10ms, then 20ms, for each
+			took: 30 * time.Millisecond,
+		},
+		{
+			name:      "not enough retries",
+			paths:     []string{"/flaky"},
+			opts:      Options{Retries: 1, Backoff: time.Millisecond},
+			calls:     2,
+			completed: 0,
+			status:    []string{"failed"},
+			exits:     []int{2},
+			err:       "exit status 2",
+		},
+		{
+			name:      "timeout",
+			paths:     []string{"/a", "/slow"},
+			opts:      Options{Timeout: 20 * time.Millisecond},
+			calls:     2,
+			completed: 1,
+			status:    []string{"done", "failed"},
+			exits:     []int{0, -1},
+			err:       "timed out after 20ms",
+			took:      20 * time.Millisecond,
+		},
+		{
+			name:      "stdin that isn't there",
+			paths:     []string{"/nonexistent/a"},
+			opts:      Options{Stdin: true},
+			calls:     0,
+			completed: 0,
+			status:    []string{"failed"},
+			exits:     []int{-1},
+			err:       "no such file",
+		},
+		{
+			name:      "dry run",
+			paths:     []string{"/a", "/b"},
+			opts:      Options{DryRun: true},
+			calls:     0,
+			completed: 2,
+			status:    []string{"done", "done"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := testMarks(tt.paths...)
+
+			// whatever they were before, Exec starts them over
+			for i := range s.Marks {
+				s.Marks[i].Status = "failed"
+				s.Marks[i].Exit = 9
+			}
+
+			todo := []*Mark{}
+			for i := range s.Marks {
+				todo = append(todo, &s.Marks[i])
+			}
+
+			runner := &fakeRunner{exit: failing, delay: tt.delay}
+
+			opts := tt.opts
+			opts.Runner = runner
+			opts.Stdout, opts.Stderr = io.Discard, io.Discard
+
+			args := tt.args
+			if args == nil {
+				args = []string{"echo", "_"}
+			}
+
+			start := time.Now()
+
+			completed, err := s.Exec(args, todo, &opts)
+
+			if took := time.Since(start); took < tt.took {
+				t.Errorf("took %s, want at least %s", took, tt.took)
+			}
+
+			if completed != tt.completed {
+				t.Errorf("completed %d, want %d", completed, tt.completed)
+			}
+
+			if len(runner.calls) != tt.calls {
+				t.Errorf("ran %d commands, want %d: %q", len(runner.calls), tt.calls, runner.calls)
+			}
+
+			switch {
+			case tt.err == "" && err != nil:
+				t.Errorf("Exec: %s", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Errorf("Exec: %v, want %q", err, tt.err)
+			}
+
+			if tt.status != nil {
+				got := []string{}
+				for _, m := range s.Marks {
+					got = append(got, m.Status)
+				}
+
+				if !reflect.DeepEqual(got, tt.status) {
+					t.Errorf("statuses %q, want %q", got, tt.status)
+				}
+			}
+
+			if tt.exits != nil {
+				got := []int{}
+				for _, m := range s.Marks {
+					got = append(got, m.Exit)
+				}
+
+				if !reflect.DeepEqual(got, tt.exits) {
+					t.Errorf("exit codes %v, want %v", got, tt.exits)
+				}
+			}
+
+			if tt.busiest > 0 && runner.busiest != tt.busiest {
+				t.Errorf("%d commands ran at once, want %d", runner.busiest, tt.busiest)
+			}
+
+			for _, m := range s.Marks {
+				if m.Status != "pending" && m.When.IsZero() {
+					t.Errorf("%s is %s, but has no time", m.Path, m.Status)
+				}
+			}
+		})
+	}
+}
+
+func TestExecCommand(t *testing.T) {
+	s := testMarks("/photos/beach day.jpg")
+	s.Marks[0].Tag("photos")
+
+	runner := &fakeRunner{}
+	opts := &Options{Runner: runner, Shell: "bash", Chdir: true, Stdout: io.Discard, Stderr: io.Discard}
+
+	if _, err := s.Exec([]string{"cp", "_", "/backup/_.stem.bak"}, []*Mark{&s.Marks[0]}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"bash", "-c", "cp '/photos/beach day.jpg' /backup/'beach day'.bak"}
+	if len(runner.calls) != 1 || !reflect.DeepEqual(runner.calls[0], want) {
+		t.Errorf("ran %q, want %q", runner.calls, want)
+	}
+
+	opts.NoShell = true
+	runner.calls = nil
+
+	if _, err := s.Exec([]string{"cp", "_", "/backup/"}, []*Mark{&s.Marks[0]}, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	want = []string{"cp", "/photos/beach day.jpg", "/backup/"}
+	if len(runner.calls) != 1 || !reflect.DeepEqual(runner.calls[0], want) {
+		t.Errorf("with NoShell, ran %q, want %q", runner.calls, want)
+	}
+}
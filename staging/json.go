@@ -0,0 +1,151 @@
+package staging
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// the JSON staging file: one document, so a
+// filename can hold anything, and other programs can read and
+// write it without knowing the line format
+type jsonStaging struct {
+	Version int        `json:"version"`
+	Exec    []string   `json:"exec,omitempty"`
+	Globs   []string   `json:"globs,omitempty"`
+	Marks   []JSONMark `json:"marks"`
+}
+
+// JSONMark is a mark in a JSON staging file
+type JSONMark struct {
+	Path   string            `json:"path"`
+	Tags   []string          `json:"tags,omitempty"`
+	Attrs  map[string]string `json:"attrs,omitempty"`
+	Status string            `json:"status,omitempty"`
+	Exit   int               `json:"exit,omitempty"`
+	When   *time.Time        `json:"when,omitempty"`
+	Size   int64             `json:"size,omitempty"`
+	Mtime  *time.Time        `json:"mtime,omitempty"`
+	Hash   string            `json:"hash,omitempty"`
+
+	Added     *time.Time `json:"added,omitempty"`
+	AddedBy   string     `json:"added_by,omitempty"`
+	AddedFrom string     `json:"added_from,omitempty"`
+}
+
+// IsJSON reports whether the staging file's contents are a JSON
+// document rather than lines
+func IsJSON(data []byte) bool {
+	for _, c := range data {
+		switch c {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
+
+	return false
+}
+
+func (s *Area) readJSON(data []byte) error {
+	doc := jsonStaging{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	s.LastExec = doc.Exec
+	s.Globs = doc.Globs
+
+	for _, jm := range doc.Marks {
+		m := Mark{
+			Stage:  s,
+			Path:   jm.Path,
+			Tags:   jm.Tags,
+			Status: jm.Status,
+			Exit:   jm.Exit,
+			Size:   jm.Size,
+			Hash:   jm.Hash,
+
+			AddedBy:   jm.AddedBy,
+			AddedFrom: jm.AddedFrom,
+		}
+
+		if jm.Added != nil {
+			m.Added = *jm.Added
+		}
+
+		if jm.When != nil {
+			m.When = *jm.When
+		}
+
+		if jm.Mtime != nil {
+			m.ModTime = *jm.Mtime
+		}
+
+		for k, v := range jm.Attrs {
+			m.SetAttr(k, v)
+		}
+
+		s.Marks = append(s.Marks, m)
+	}
+
+	return nil
+}
+
+func (s *Area) writeJSON(out io.Writer) error {
+	doc := jsonStaging{
+		Version: Version,
+		Exec:    s.LastExec,
+		Marks:   []JSONMark{},
+	}
+
+	if len(s.Marks) > 0 {
+		doc.Globs = s.Globs
+	}
+
+	for i := range s.Marks {
+		doc.Marks = append(doc.Marks, s.Marks[i].JSON())
+	}
+
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(doc)
+}
+
+// JSON is the mark as it goes in a JSON staging file
+func (m *Mark) JSON() JSONMark {
+	jm := JSONMark{
+		Path:   m.Path,
+		Tags:   m.Tags,
+		Attrs:  m.Attrs,
+		Status: m.Status,
+		Exit:   m.Exit,
+		Size:   m.Size,
+		Hash:   m.Hash,
+
+		AddedBy:   m.AddedBy,
+		AddedFrom: m.AddedFrom,
+	}
+
+	if !m.Added.IsZero() {
+		added := m.Added.UTC()
+		jm.Added = &added
+	}
+
+	if !m.When.IsZero() {
+		when := m.When.UTC()
+		jm.When = &when
+	}
+
+	if !m.ModTime.IsZero() {
+		mtime := m.ModTime
+		jm.Mtime = &mtime
+	}
+
+	return jm
+}
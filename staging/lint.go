@@ -0,0 +1,204 @@
+package staging
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Lint checks a hand-edited staging file, returning what's wrong
+// with it, by line. Paths are passed through clean, if it's not
+// nil, before looking for the same one twice.
+func Lint(data []byte, clean func(path string) string) []string {
+	if clean == nil {
+		clean = func(path string) string { return path }
+	}
+
+	if IsJSON(data) {
+		s, err := Parse("", data)
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		problems := []string{}
+		seen := map[string]int{}
+
+		for i, m := range s.Marks {
+			if m.Path == "" {
+				problems = append(problems, fmt.Sprintf("mark %d: no path", i))
+				continue
+			}
+
+			path := clean(m.Path)
+			if prev, dup := seen[path]; dup {
+				problems = append(problems, fmt.Sprintf("mark %d: %s is already mark %d", i, path, prev))
+			}
+
+			seen[path] = i
+		}
+
+		return problems
+	}
+
+	problems := []string{}
+	bad := func(line int, format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+
+	seen := map[string]int{}
+	version := 1
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(nil, 1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+
+		switch {
+		case strings.HasPrefix(line, formatDirective):
+			v, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, formatDirective)))
+			if err != nil || v < 1 || v > Version {
+				bad(n, "unknown format %q", strings.TrimSpace(line))
+			} else {
+				version = v
+			}
+
+			continue
+
+		case strings.HasPrefix(line, execDirective):
+			if _, err := unquoteArgs(strings.TrimPrefix(line, execDirective)); err != nil {
+				bad(n, "exec should be quoted strings, like %s\"cp\" \"_\" \"/tmp\"", execDirective)
+			}
+
+			continue
+
+		case strings.HasPrefix(line, globDirective):
+			if _, err := unquoteArgs(strings.TrimPrefix(line, globDirective)); err != nil {
+				bad(n, "globs should be quoted strings, like %s\"*.go\"", globDirective)
+			}
+
+			continue
+
+		case strings.TrimSpace(line) == "" || line[0] == '#':
+			continue
+
+		case line[0] == ' ' || line[0] == '\t':
+			bad(n, "starts with whitespace, so it would be ignored")
+			continue
+		}
+
+		toks := strings.Fields(line)
+		quoted := make([]bool, len(toks))
+		if version >= 2 {
+			if col := badQuote(line); col >= 0 {
+				bad(n, "unterminated quote at column %d", col+1)
+				continue
+			}
+
+			toks, quoted = splitQuoted(line)
+		}
+
+		path := clean(toks[0])
+		if prev, dup := seen[path]; dup {
+			bad(n, "%s is already on line %d", path, prev)
+		}
+
+		seen[path] = n
+
+		for i, tok := range toks[1:] {
+			key, val, isField := strings.Cut(tok, "=")
+			if !isField || quoted[i+1] {
+				continue
+			}
+
+			if msg := lintField(key, val); msg != "" {
+				bad(n, "%s", msg)
+			}
+		}
+	}
+
+	return problems
+}
+
+// badQuote finds a quote in a version 2 line that doesn't close,
+// returning where it starts, or -1
+func badQuote(line string) int {
+	i := 0
+
+	for i < len(line) {
+		switch {
+		case line[i] == ' ' || line[i] == '\t':
+			i++
+		case line[i] == '"':
+			q, err := strconv.QuotedPrefix(line[i:])
+			if err != nil {
+				return i
+			}
+
+			i += len(q)
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+		}
+	}
+
+	return -1
+}
+
+// lintField checks a key=value field on a mark's line, returning
+// what's wrong with it, if anything
+func lintField(key, val string) string {
+	parts := strings.Split(val, ",")
+
+	switch key {
+	case "status":
+		switch parts[0] {
+		case "pending", "done", "failed":
+		default:
+			return fmt.Sprintf("status %q should be pending, done or failed", parts[0])
+		}
+
+		if len(parts) == 1 {
+			return ""
+		}
+
+		if len(parts) != 3 {
+			return fmt.Sprintf("status %q should be state,exit,time", val)
+		}
+
+		if _, err := strconv.Atoi(parts[1]); err != nil {
+			return fmt.Sprintf("status exit code %q isn't a number", parts[1])
+		}
+
+		if _, err := time.Parse(time.RFC3339, parts[2]); err != nil {
+			return fmt.Sprintf("status time %q isn't like %s", parts[2], time.RFC3339)
+		}
+
+	case "sum":
+		if len(parts) != 3 {
+			return fmt.Sprintf("sum %q should be size,mtime,hash", val)
+		}
+
+		for _, p := range parts[:2] {
+			if _, err := strconv.ParseInt(p, 10, 64); err != nil {
+				return fmt.Sprintf("sum %q should be size,mtime,hash", val)
+			}
+		}
+
+	case "added":
+		if _, err := time.Parse(time.RFC3339, parts[0]); err != nil {
+			return fmt.Sprintf("added time %q isn't like %s", parts[0], time.RFC3339)
+		}
+
+	default:
+		if !ValidAttrKey(key) {
+			return fmt.Sprintf("%q can't be an attribute name", key)
+		}
+	}
+
+	return ""
+}
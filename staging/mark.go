@@ -0,0 +1,228 @@
+package staging
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mark is a path in the staging area, and what's known about it
+type Mark struct {
+	Path string
+	Tags []string
+
+	Stage *Area
+
+	// position in the current exec run, 1-based, and the
+	// number of marks in the run
+	index, total int
+
+	// where the mark stands: "pending" (or "", if nothing's
+	// been run on it at all), "done" or "failed"; for the
+	// last two, the exit code of the command and when it
+	// finished
+	Status string
+	Exit   int
+	When   time.Time
+
+	// what the file looked like when it was added (see Stamp)
+	Size    int64
+	ModTime time.Time
+	Hash    string
+
+	// named values attached to the mark (see SetAttr)
+	Attrs map[string]string
+
+	// when the mark was added, by whom, and from what
+	// directory, so you can tell later why it's there
+	Added     time.Time
+	AddedBy   string
+	AddedFrom string
+
+	// whether the mark's command ran in the last Exec
+	Ran bool
+}
+
+// in the staging file, a status is "status=pending", or once
+// the command has run, "status=failed,1,2017-09-17T12:00:00Z"
+func (m *Mark) formatStatus() string {
+	if m.When.IsZero() {
+		return m.Status
+	}
+
+	return fmt.Sprintf("%s,%d,%s", m.Status, m.Exit, m.When.UTC().Format(time.RFC3339))
+}
+
+// in the staging file, where a mark came from is
+// "added=2017-09-17T12:00:00Z,user,/the/directory", with the
+// directory escaped like an attribute value
+func (m *Mark) formatAdded() string {
+	return fmt.Sprintf("%s,%s,%s", m.Added.UTC().Format(time.RFC3339), escapeValue(m.AddedBy), escapeValue(m.AddedFrom))
+}
+
+func (m *Mark) parseAdded(val string) {
+	parts := strings.SplitN(val, ",", 3)
+
+	m.Added, _ = time.Parse(time.RFC3339, parts[0])
+
+	if len(parts) == 3 {
+		m.AddedBy = unescapeValue(parts[1])
+		m.AddedFrom = unescapeValue(parts[2])
+	}
+}
+
+func (m *Mark) parseStatus(val string) {
+	parts := strings.SplitN(val, ",", 3)
+
+	m.Status = parts[0]
+
+	if len(parts) == 3 {
+		m.Exit, _ = strconv.Atoi(parts[1])
+		m.When, _ = time.Parse(time.RFC3339, parts[2])
+	}
+}
+
+// ValidAttrKey reports whether key can name an attribute: it
+// has to work in a placeholder, and can't be "status", "sum"
+// or "added"
+func ValidAttrKey(key string) bool {
+	if key == "" || key == "status" || key == "sum" || key == "added" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if !isKeyByte(key[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SetAttr attaches a named value to the mark
+func (m *Mark) SetAttr(key, val string) {
+	if m.Attrs == nil {
+		m.Attrs = map[string]string{}
+	}
+
+	m.Attrs[key] = val
+}
+
+// Attr returns the mark's attribute named key, which it's an
+// error not to have
+func (m *Mark) Attr(key string) (string, error) {
+	val, ok := m.Attrs[key]
+	if !ok {
+		return "", fmt.Errorf("no attribute %q", key)
+	}
+
+	return val, nil
+}
+
+// AttrKeys returns the names of the mark's attributes, sorted
+func (m *Mark) AttrKeys() []string {
+	keys := []string{}
+	for k := range m.Attrs {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+// State is the mark's Status, with never-run marks counted as
+// pending
+func (m *Mark) State() string {
+	if m.Status == "" {
+		return "pending"
+	}
+
+	return m.Status
+}
+
+// tagUnder reports whether the tag t is tag itself or, since
+// tags nest like paths ("project/frontend/css"), falls under it
+func tagUnder(t, tag string) bool {
+	return t == tag || strings.HasPrefix(t, strings.TrimSuffix(tag, "/")+"/")
+}
+
+// Tag adds a tag to the mark, reporting whether it didn't have
+// it already.
+//
+// A tag's parents are implied, so tagging "project/css" replaces
+// a plain "project", and tagging "project" when there's already a
+// "project/css" does nothing.
+func (m *Mark) Tag(tag string) bool {
+	if m.HasTag(tag) {
+		return false
+	}
+
+	tags := []string{}
+	for _, t := range m.Tags {
+		if !tagUnder(tag, t) {
+			tags = append(tags, t)
+		}
+	}
+
+	m.Tags = append(tags, tag)
+	return true
+}
+
+// HasTag reports whether the mark is tagged tag, or anything
+// under it
+func (m *Mark) HasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if tagUnder(t, tag) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Untag removes a tag, and anything under it, from the mark,
+// reporting whether there was anything to remove
+func (m *Mark) Untag(tag string) bool {
+	tags := []string{}
+	for _, t := range m.Tags {
+		if !tagUnder(t, tag) {
+			tags = append(tags, t)
+		}
+	}
+
+	if len(tags) < len(m.Tags) {
+		m.Tags = tags
+		return true
+	}
+
+	return false
+}
+
+// RenameTag renames the mark's tag old, and anything under it,
+// to new, in place
+func (m *Mark) RenameTag(old, new string) bool {
+	if !m.HasTag(old) {
+		return false
+	}
+
+	tags := []string{}
+	seen := map[string]bool{}
+
+	for _, t := range m.Tags {
+		if tagUnder(t, old) {
+			t = new + strings.TrimPrefix(t, old)
+		}
+
+		if !seen[t] {
+			tags = append(tags, t)
+			seen[t] = true
+		}
+	}
+
+	m.Tags = tags
+
+	return true
+}
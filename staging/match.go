@@ -0,0 +1,302 @@
+package staging
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Matching returns the marks in the staging area matching pat,
+// which is usually a pattern for Match, but can also be "@tag",
+// for the marks tagged tag, or "#3", "#3-7" or "#-1", for marks
+// by their number in the status listing (negative numbers count
+// back from the end)
+func (s *Area) Matching(pat string) ([]*Mark, error) {
+	ret := []*Mark{}
+
+	lo, hi := 0, -1
+
+	if strings.HasPrefix(pat, "#") {
+		var err error
+
+		lo, hi, err = ParseIndexRange(pat[1:], len(s.Marks))
+		if err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrBadPattern, pat, err)
+		}
+	}
+
+	for i := range s.Marks {
+		m := &s.Marks[i]
+
+		hit := false
+
+		switch {
+		case strings.HasPrefix(pat, "#"):
+			hit = i >= lo && i <= hi
+		case strings.HasPrefix(pat, "@"):
+			hit = m.HasTag(pat[1:])
+		default:
+			var err error
+
+			hit, err = s.Match(pat, m.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if hit {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret, nil
+}
+
+// ParseIndexRange parses "3", "3-7", "-1" or "-3--1" into the
+// range of indexes (inclusive) it covers out of n
+func ParseIndexRange(spec string, n int) (int, int, error) {
+	num := func(s string) (int, error) {
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, fmt.Errorf("%q isn't a number", s)
+		}
+
+		if i < 0 {
+			i += n
+		}
+
+		return i, nil
+	}
+
+	// the dash between the numbers is the first one that isn't
+	// a minus sign
+	split := -1
+	for i := 1; i < len(spec); i++ {
+		if spec[i] == '-' {
+			split = i
+			break
+		}
+	}
+
+	if split < 0 {
+		i, err := num(spec)
+		return i, i, err
+	}
+
+	lo, err := num(spec[:split])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	hi, err := num(spec[split+1:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return lo, hi, nil
+}
+
+// Match reports whether the mark path p matches the glob
+// pattern pat. Patterns without a slash match against the
+// basename, like they always have. Patterns with a slash are
+// taken relative to the working directory and matched against
+// the full path, where a "**" component matches any number of
+// directories (including none).
+//
+// With Regexp set, pat is instead a Go regexp matched against
+// the full path.
+func (s *Area) Match(pat, p string) (bool, error) {
+	p = strings.TrimSuffix(p, "/")
+
+	if s.Regexp {
+		return s.matchRegexp(pat, p)
+	}
+
+	if !strings.Contains(pat, "/") {
+		hit, err := filepath.Match(pat, path.Base(p))
+		if err != nil {
+			return false, fmt.Errorf("%w %q: %w", ErrBadPattern, pat, err)
+		}
+
+		return hit, nil
+	}
+
+	abs, err := filepath.Abs(pat)
+	if err != nil {
+		return false, nil
+	}
+
+	hit, err := MatchSegments(strings.Split(abs, "/"), strings.Split(p, "/"))
+	if err != nil {
+		return false, fmt.Errorf("%w %q: %w", ErrBadPattern, pat, err)
+	}
+
+	return hit, nil
+}
+
+// MatchSegments reports whether the path segments segs match
+// the pattern segments pats, as in Match; the error is
+// filepath.ErrBadPattern, for a malformed segment
+func MatchSegments(pats, segs []string) (bool, error) {
+	for len(pats) > 0 {
+		if pats[0] == "**" {
+			// collapse runs of **
+			for len(pats) > 0 && pats[0] == "**" {
+				pats = pats[1:]
+			}
+
+			if len(pats) == 0 {
+				return true, nil
+			}
+
+			for i := range segs {
+				if hit, err := MatchSegments(pats, segs[i:]); hit || err != nil {
+					return hit, err
+				}
+			}
+
+			return false, nil
+		}
+
+		if len(segs) == 0 {
+			return false, nil
+		}
+
+		if hit, err := filepath.Match(pats[0], segs[0]); !hit || err != nil {
+			return false, err
+		}
+
+		pats = pats[1:]
+		segs = segs[1:]
+	}
+
+	return len(segs) == 0, nil
+}
+
+func (s *Area) matchRegexp(pat, p string) (bool, error) {
+	re, ok := s.regexps[pat]
+	if !ok {
+		var err error
+
+		re, err = regexp.Compile(pat)
+		if err != nil {
+			return false, fmt.Errorf("%w: %w", ErrBadPattern, err)
+		}
+
+		if s.regexps == nil {
+			s.regexps = map[string]*regexp.Regexp{}
+		}
+
+		s.regexps[pat] = re
+	}
+
+	return re.MatchString(p), nil
+}
+
+// HasGlob reports whether a path is really a pattern
+func HasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// ExpandGlob finds the paths matching pat, relative to the working
+// directory, where "**" matches any number of directories. As in
+// the shell, wildcards don't match names starting with a dot
+// unless the pattern does.
+func ExpandGlob(pat string) ([]string, error) {
+	abs, err := filepath.Abs(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	segs := strings.Split(abs, "/")
+
+	// start from the part without any wildcards
+	dir := "/"
+	for len(segs) > 0 && !HasGlob(segs[0]) {
+		dir = filepath.Join(dir, segs[0])
+		segs = segs[1:]
+	}
+
+	// collapse runs of **
+	pats := []string{}
+	for _, seg := range segs {
+		if seg == "**" && len(pats) > 0 && pats[len(pats)-1] == "**" {
+			continue
+		}
+
+		// there might be nothing to match it against, to
+		// find out it's bad
+		if _, err := filepath.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("%w %q: %w", ErrBadPattern, pat, err)
+		}
+
+		pats = append(pats, seg)
+	}
+
+	found := []string{}
+	seen := map[string]bool{}
+
+	var expand func(dir string, pats []string) error
+	expand = func(dir string, pats []string) error {
+		if len(pats) == 0 {
+			if !seen[dir] {
+				seen[dir] = true
+				found = append(found, dir)
+			}
+
+			return nil
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil
+		}
+
+		if pats[0] == "**" {
+			if err := expand(dir, pats[1:]); err != nil {
+				return err
+			}
+
+			for _, e := range entries {
+				if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+					if err := expand(filepath.Join(dir, e.Name()), pats); err != nil {
+						return err
+					}
+				}
+			}
+
+			return nil
+		}
+
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".") && !strings.HasPrefix(pats[0], ".") {
+				continue
+			}
+
+			hit, err := filepath.Match(pats[0], e.Name())
+			if err != nil {
+				return fmt.Errorf("%w %q: %w", ErrBadPattern, pat, err)
+			} else if !hit {
+				continue
+			}
+
+			if len(pats) == 1 || e.IsDir() {
+				if err := expand(filepath.Join(dir, e.Name()), pats[1:]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if err := expand(dir, pats); err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
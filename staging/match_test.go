@@ -0,0 +1,139 @@
+package staging
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pat, path string
+		regexp    bool
+		want      bool
+	}{
+		// without a slash, against the basename
+		{"*.jpg", "/photos/a.jpg", false, true},
+		{"*.jpg", "/photos/a.png", false, false},
+		{"a.*", "/photos/a.jpg", false, true},
+		{"photos", "/photos/", false, true},
+		{"photos", "/photos/a.jpg", false, false},
+
+		// with one, against the whole path
+		{"/photos/*.jpg", "/photos/a.jpg", false, true},
+		{"/photos/*.jpg", "/photos/2017/a.jpg", false, false},
+		{"/photos/**/*.jpg", "/photos/a.jpg", false, true},
+		{"/photos/**/*.jpg", "/photos/2017/09/a.jpg", false, true},
+		{"/photos/**", "/photos/2017/09/a.jpg", false, true},
+		{"/**/a.jpg", "/photos/2017/a.jpg", false, true},
+		{"/photos/**/*.jpg", "/docs/a.jpg", false, false},
+
+		{`\.jpg$`, "/photos/a.jpg", true, true},
+		{`^/photos/\d+/`, "/photos/2017/a.jpg", true, true},
+		{`^/photos/\d+/`, "/photos/a.jpg", true, false},
+	}
+
+	for _, tt := range tests {
+		s := &Area{Regexp: tt.regexp}
+
+		got, err := s.Match(tt.pat, tt.path)
+		if err != nil {
+			t.Errorf("Match(%q, %q): %s", tt.pat, tt.path, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tt.pat, tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestMatchBadPattern(t *testing.T) {
+	s := &Area{Regexp: true}
+
+	if _, err := s.Match("(", "/a"); !errors.Is(err, ErrBadPattern) {
+		t.Errorf("Match with a bad regexp: %v, want ErrBadPattern", err)
+	}
+
+	s.Regexp = false
+
+	for _, pat := range []string{"[a", "/photos/[a/*.jpg", "/**/[a"} {
+		if _, err := s.Match(pat, "/photos/a/b.jpg"); !errors.Is(err, ErrBadPattern) {
+			t.Errorf("Match(%q): %v, want ErrBadPattern", pat, err)
+		}
+	}
+
+	if _, err := ExpandGlob(t.TempDir() + "/[a"); err == nil {
+		t.Errorf("ExpandGlob with a bad pattern worked")
+	}
+}
+
+func TestMatching(t *testing.T) {
+	s := &Area{}
+	for _, p := range []string{"/a/one.txt", "/a/two.jpg", "/b/three.txt", "/b/four.jpg"} {
+		s.Marks = append(s.Marks, Mark{Path: p, Stage: s})
+	}
+
+	s.Marks[1].Tag("photos")
+	s.Marks[3].Tag("photos/2017")
+
+	tests := []struct {
+		pat  string
+		want []string
+	}{
+		{"*.txt", []string{"/a/one.txt", "/b/three.txt"}},
+		{"/b/*", []string{"/b/three.txt", "/b/four.jpg"}},
+		{"@photos", []string{"/a/two.jpg", "/b/four.jpg"}},
+		{"@photos/2017", []string{"/b/four.jpg"}},
+		{"@nothing", []string{}},
+		{"#0", []string{"/a/one.txt"}},
+		{"#1-2", []string{"/a/two.jpg", "/b/three.txt"}},
+		{"#-1", []string{"/b/four.jpg"}},
+		{"#-2--1", []string{"/b/three.txt", "/b/four.jpg"}},
+	}
+
+	for _, tt := range tests {
+		marks, err := s.Matching(tt.pat)
+		if err != nil {
+			t.Errorf("Matching(%q): %s", tt.pat, err)
+			continue
+		}
+
+		got := []string{}
+		for _, m := range marks {
+			got = append(got, m.Path)
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Matching(%q) = %q, want %q", tt.pat, got, tt.want)
+		}
+	}
+
+	if _, err := s.Matching("#x"); !errors.Is(err, ErrBadPattern) {
+		t.Errorf("Matching(#x): %v, want ErrBadPattern", err)
+	}
+}
+
+func TestParseIndexRange(t *testing.T) {
+	tests := []struct {
+		spec   string
+		lo, hi int
+	}{
+		{"3", 3, 3},
+		{"3-7", 3, 7},
+		{"-1", 9, 9},
+		{"-3--1", 7, 9},
+		{"0--1", 0, 9},
+	}
+
+	for _, tt := range tests {
+		lo, hi, err := ParseIndexRange(tt.spec, 10)
+		if err != nil || lo != tt.lo || hi != tt.hi {
+			t.Errorf("ParseIndexRange(%q, 10) = %d, %d, %v; want %d, %d", tt.spec, lo, hi, err, tt.lo, tt.hi)
+		}
+	}
+
+	if _, _, err := ParseIndexRange("one", 10); err == nil {
+		t.Errorf("ParseIndexRange took \"one\"")
+	}
+}
@@ -0,0 +1,125 @@
+package staging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Sort puts the marks in order by key (see OrderBy)
+func (s *Area) Sort(key string, reverse bool) error {
+	before, err := OrderBy(key, reverse)
+	if err != nil {
+		return err
+	}
+
+	sort.SliceStable(s.Marks, func(i, j int) bool {
+		return before(&s.Marks[i], &s.Marks[j])
+	})
+
+	return nil
+}
+
+// OrderBy returns a function saying whether one mark goes
+// before another, by key: "name" (the path), "size", "mtime" or
+// "ext", then by path; files that are gone go last when it's by
+// size or mtime
+func OrderBy(key string, reverse bool) (func(a, b *Mark) bool, error) {
+	stats := map[string]os.FileInfo{}
+
+	stat := func(path string) os.FileInfo {
+		if fi, found := stats[path]; found {
+			return fi
+		}
+
+		fi, err := os.Stat(path)
+		if err != nil {
+			fi = nil
+		}
+
+		stats[path] = fi
+		return fi
+	}
+
+	var less func(a, b *Mark) (bool, bool)
+
+	// less returns whether a goes first, and whether that's
+	// settled or it's down to their paths
+	switch key {
+	case "", "name":
+		less = func(a, b *Mark) (bool, bool) { return false, false }
+	case "ext":
+		less = func(a, b *Mark) (bool, bool) {
+			ea, eb := strings.ToLower(filepath.Ext(a.Path)), strings.ToLower(filepath.Ext(b.Path))
+			return ea < eb, ea != eb
+		}
+	case "size", "mtime":
+		less = func(a, b *Mark) (bool, bool) {
+			fa, fb := stat(a.Path), stat(b.Path)
+
+			switch {
+			case fa == nil || fb == nil:
+				return false, false
+			case key == "size":
+				return fa.Size() < fb.Size(), fa.Size() != fb.Size()
+			default:
+				return fa.ModTime().Before(fb.ModTime()), !fa.ModTime().Equal(fb.ModTime())
+			}
+		}
+	default:
+		return nil, fmt.Errorf("can't sort by %q (name, size, mtime or ext)", key)
+	}
+
+	return func(a, b *Mark) bool {
+		if key == "size" || key == "mtime" {
+			if gone := stat(b.Path) == nil; gone != (stat(a.Path) == nil) {
+				return gone
+			}
+		}
+
+		first, settled := less(a, b)
+		if !settled {
+			first, settled = a.Path < b.Path, a.Path != b.Path
+		}
+
+		return first != (reverse && settled)
+	}, nil
+}
+
+// Move moves the mark at index from to index to, shifting the
+// ones in between; indexes are as in the status listing, and
+// negative ones count back from the end
+func (s *Area) Move(from, to string) error {
+	index := func(spec string) (int, error) {
+		spec = strings.TrimPrefix(spec, "#")
+
+		i, j, err := ParseIndexRange(spec, len(s.Marks))
+		switch {
+		case err != nil:
+		case i != j:
+			err = fmt.Errorf("#%s is more than one mark", spec)
+		case i < 0 || i >= len(s.Marks):
+			err = fmt.Errorf("no mark #%s", spec)
+		}
+
+		return i, err
+	}
+
+	i, err := index(from)
+	if err != nil {
+		return err
+	}
+
+	j, err := index(to)
+	if err != nil {
+		return err
+	}
+
+	m := s.Marks[i]
+	s.Marks = append(s.Marks[:i], s.Marks[i+1:]...)
+	s.Marks = append(s.Marks[:j], append([]Mark{m}, s.Marks[j:]...)...)
+
+	return nil
+}
@@ -0,0 +1,43 @@
+package staging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMove(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     []string
+	}{
+		{"0", "2", []string{"/b", "/c", "/a", "/d"}},
+		{"#3", "#0", []string{"/d", "/a", "/b", "/c"}},
+		{"-1", "1", []string{"/a", "/d", "/b", "/c"}},
+		{"2-2", "0", []string{"/c", "/a", "/b", "/d"}},
+	}
+
+	for _, tt := range tests {
+		s := testMarks("/a", "/b", "/c", "/d")
+
+		if err := s.Move(tt.from, tt.to); err != nil {
+			t.Errorf("Move(%q, %q): %s", tt.from, tt.to, err)
+			continue
+		}
+
+		if got := paths(s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Move(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+
+	for _, bad := range [][2]string{{"1-3", "0"}, {"0", "1-2"}, {"4", "0"}, {"x", "0"}} {
+		s := testMarks("/a", "/b", "/c", "/d")
+
+		if err := s.Move(bad[0], bad[1]); err == nil {
+			t.Errorf("Move(%q, %q) worked", bad[0], bad[1])
+		}
+
+		if got, want := paths(s), []string{"/a", "/b", "/c", "/d"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("failed Move(%q, %q) moved marks: %q", bad[0], bad[1], got)
+		}
+	}
+}
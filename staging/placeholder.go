@@ -0,0 +1,241 @@
+package staging
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// placeholders maps each placeholder to what it expands to for
+// a given mark
+var placeholders = map[string]func(m *Mark) (string, error){
+	"_": func(m *Mark) (string, error) {
+		return m.Path, nil
+	},
+
+	"_.base": func(m *Mark) (string, error) {
+		return path.Base(m.Path), nil
+	},
+
+	"_.dir": func(m *Mark) (string, error) {
+		return path.Dir(m.Path), nil
+	},
+
+	"_.ext": func(m *Mark) (string, error) {
+		return strings.TrimPrefix(path.Ext(m.Path), "."), nil
+	},
+
+	"_.stem": func(m *Mark) (string, error) {
+		base := path.Base(m.Path)
+		return strings.TrimSuffix(base, path.Ext(base)), nil
+	},
+
+	"_.abs": func(m *Mark) (string, error) {
+		if m.Host() != "" {
+			return m.Path, nil
+		}
+
+		return filepath.Abs(m.Path)
+	},
+
+	"_.n": func(m *Mark) (string, error) {
+		return strconv.Itoa(m.index), nil
+	},
+
+	"_.total": func(m *Mark) (string, error) {
+		return strconv.Itoa(m.total), nil
+	},
+}
+
+// keyed placeholders are followed by a key naming what they
+// expand to, as in "_.get:sha1"
+var keyedPlaceholders = map[string]func(m *Mark, key string) (string, error){
+	"_.get:": func(m *Mark, key string) (string, error) {
+		return m.Attr(key)
+	},
+
+	"_.attr.": func(m *Mark, key string) (string, error) {
+		return m.Attr(key)
+	},
+}
+
+func isKeyByte(c byte) bool {
+	return isWordByte(c) || c == '-'
+}
+
+// placeholder names, longest first, so "_.base" wins over "_"
+var placeholderNames = func() []string {
+	names := []string{}
+	for name := range placeholders {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		return len(names[i]) > len(names[j])
+	})
+
+	return names
+}()
+
+// Expand substitutes placeholders anywhere in arg, so
+// "/backup/_.base.bak" works as well as a bare "_". A bare "_"
+// only counts when it isn't part of a word, so "my_file" and
+// "$MARK_PATH" are left alone, but anywhere else it is the path:
+// in "s/_/-/g" and "tr _ -" too. Write "__" there for a literal
+// underscore ("s/__/-/g"); in a word, as in "__init__.py", "__"
+// is just itself. A name followed by a letter isn't a
+// placeholder, so "_.new" is the path with ".new" on the end,
+// not "_.n". "_.n" takes an optional width to zero-pad to, so
+// "_.n03" gives "001", "002"... and "_.attr.key" (or "_.get:key")
+// gives the mark's attribute "key" (see Attr).
+func (m *Mark) Expand(arg string) (string, error) {
+	ret, _, err := expand(arg, m, nil)
+	return ret, err
+}
+
+// ExpandQuoted is Expand, but passes everything it substitutes
+// through quote first
+func (m *Mark) ExpandQuoted(arg string, quote func(string) string) (string, error) {
+	ret, _, err := expand(arg, m, quote)
+	return ret, err
+}
+
+// hasPlaceholder reports whether arg has anything for Expand
+// to substitute
+func hasPlaceholder(arg string) bool {
+	_, found, _ := expand(arg, nil, nil)
+	return found
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || isLetter(c) || (c >= '0' && c <= '9')
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// expand does the work for Expand; given a nil mark, it just
+// reports whether there's anything to substitute
+func expand(arg string, m *Mark, quote func(string) string) (string, bool, error) {
+	out := strings.Builder{}
+	found := false
+
+	for i := 0; i < len(arg); {
+		if arg[i] != '_' {
+			out.WriteByte(arg[i])
+			i++
+			continue
+		}
+
+		// "__" is only an escape where "_" would have
+		// been expanded
+		if strings.HasPrefix(arg[i:], "__") {
+			if (i > 0 && isWordByte(arg[i-1])) || (i+2 < len(arg) && isWordByte(arg[i+2])) {
+				out.WriteString("__")
+			} else {
+				out.WriteByte('_')
+			}
+
+			i += 2
+			continue
+		}
+
+		keyed := false
+
+		for prefix, fn := range keyedPlaceholders {
+			if !strings.HasPrefix(arg[i:], prefix) {
+				continue
+			}
+
+			j := i + len(prefix)
+			for j < len(arg) && isKeyByte(arg[j]) {
+				j++
+			}
+
+			key := arg[i+len(prefix) : j]
+			if key == "" {
+				continue
+			}
+
+			found = true
+			keyed = true
+			i = j
+
+			if m == nil {
+				break
+			}
+
+			val, err := fn(m, key)
+			if err != nil {
+				return "", found, err
+			}
+
+			if quote != nil {
+				val = quote(val)
+			}
+
+			out.WriteString(val)
+			break
+		}
+
+		if keyed {
+			continue
+		}
+
+		// "_" always matches, at least
+		name := ""
+		for _, n := range placeholderNames {
+			end := i + len(n)
+			if !strings.HasPrefix(arg[i:], n) || n != "_" && end < len(arg) && isLetter(arg[end]) {
+				continue
+			}
+
+			name = n
+			break
+		}
+
+		if name == "_" && ((i > 0 && isWordByte(arg[i-1])) ||
+			(i+1 < len(arg) && isWordByte(arg[i+1]))) {
+			out.WriteByte('_')
+			i++
+			continue
+		}
+
+		found = true
+		i += len(name)
+
+		if m == nil {
+			continue
+		}
+
+		val, err := placeholders[name](m)
+		if err != nil {
+			return "", found, err
+		}
+
+		if name == "_.n" {
+			w := 0
+			for i+w < len(arg) && arg[i+w] >= '0' && arg[i+w] <= '9' {
+				w++
+			}
+
+			if w > 0 {
+				width, _ := strconv.Atoi(arg[i : i+w])
+				val = fmt.Sprintf("%0*d", width, m.index)
+				i += w
+			}
+		}
+
+		if quote != nil {
+			val = quote(val)
+		}
+
+		out.WriteString(val)
+	}
+
+	return out.String(), found, nil
+}
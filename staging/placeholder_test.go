@@ -0,0 +1,92 @@
+package staging
+
+import "testing"
+
+func TestExpand(t *testing.T) {
+	m := &Mark{Path: "/photos/2017/beach day.jpg", index: 7, total: 12}
+	m.SetAttr("caption", "sunset")
+	m.SetAttr("sha-1", "abc")
+
+	tests := []struct {
+		arg, want string
+	}{
+		{"_", "/photos/2017/beach day.jpg"},
+		{"_.base", "beach day.jpg"},
+		{"_.dir", "/photos/2017"},
+		{"_.ext", "jpg"},
+		{"_.stem", "beach day"},
+		{"/backup/_.base.bak", "/backup/beach day.jpg.bak"},
+		{"_.dir/small/_.stem.png", "/photos/2017/small/beach day.png"},
+		{"_.n", "7"},
+		{"_.n03", "007"},
+		{"_.n-of-_.total", "7-of-12"},
+		{"_.attr.caption", "sunset"},
+		{"_.get:caption", "sunset"},
+		{"_.attr.sha-1.txt", "abc.txt"},
+
+		// a name followed by a letter is something else
+		{"_.name", "/photos/2017/beach day.jpg.name"},
+		{"_.new", "/photos/2017/beach day.jpg.new"},
+		{"_.based", "/photos/2017/beach day.jpg.based"},
+
+		// underscores in words are left alone
+		{"my_file", "my_file"},
+		{"$MARK_PATH", "$MARK_PATH"},
+		{"__init__.py", "__init__.py"},
+		{"__name__", "__name__"},
+		{"/src/__pycache__/", "/src/__pycache__/"},
+		{"nothing here", "nothing here"},
+
+		// and elsewhere, "__" is one
+		{"__", "_"},
+		{"s/__/-/g", "s/_/-/g"},
+		{"__.base", "_.base"},
+		{"s/_/-/g", "s//photos/2017/beach day.jpg/-/g"},
+	}
+
+	for _, tt := range tests {
+		got, err := m.Expand(tt.arg)
+		if err != nil {
+			t.Errorf("Expand(%q): %s", tt.arg, err)
+			continue
+		}
+
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.arg, got, tt.want)
+		}
+	}
+
+	if _, err := m.Expand("_.attr.nope"); err == nil {
+		t.Errorf("Expand of a missing attribute worked")
+	}
+}
+
+func TestExpandQuoted(t *testing.T) {
+	m := &Mark{Path: "/photos/it's.jpg"}
+
+	got, err := m.ExpandQuoted("cp _ /backup/", ShellQuote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `cp '/photos/it'\''s.jpg' /backup/`; got != want {
+		t.Errorf("ExpandQuoted = %q, want %q", got, want)
+	}
+}
+
+func TestHasPlaceholder(t *testing.T) {
+	for arg, want := range map[string]bool{
+		"_":           true,
+		"_.base.bak":  true,
+		"_.attr.key":  true,
+		"my_file":     false,
+		"__":          false,
+		"__init__.py": false,
+		"_.new":       true,
+		"plain words": false,
+	} {
+		if got := hasPlaceholder(arg); got != want {
+			t.Errorf("hasPlaceholder(%q) = %v, want %v", arg, got, want)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package staging
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Each calls fn for each of marks, up to jobs at once
+func Each(marks []*Mark, jobs int, fn func(m *Mark)) {
+	for i, m := range marks {
+		m.index = i + 1
+		m.total = len(marks)
+	}
+
+	work := make(chan *Mark)
+	wg := sync.WaitGroup{}
+
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for m := range work {
+				fn(m)
+			}
+		}()
+	}
+
+	for _, m := range marks {
+		work <- m
+	}
+
+	close(work)
+	wg.Wait()
+}
+
+// Probe runs a command on each of marks and reports which ones
+// it succeeded (exited 0) on. It's for asking questions about
+// marks (see "select" and "tagif"), so a failure isn't an error,
+// and nothing is recorded in the marks' status.
+func (s *Area) Probe(args []string, marks []*Mark, opts *Options) map[*Mark]bool {
+	ret := map[*Mark]bool{}
+	lock := sync.Mutex{}
+
+	e := newExecutor(opts)
+
+	Each(marks, e.Jobs, func(m *Mark) {
+		inv, err := e.invocation(m, args)
+		if err != nil {
+			fmt.Fprintf(e.Stderr, "%s: %s\n", m.Path, err)
+			return
+		}
+
+		if e.run(inv) == nil && !e.DryRun {
+			lock.Lock()
+			ret[m] = true
+			lock.Unlock()
+		}
+	})
+
+	return ret
+}
+
+// Capture runs a command on each of marks and returns what it
+// wrote to stdout, trimmed, for the ones it succeeded on
+func (s *Area) Capture(args []string, marks []*Mark, opts *Options) map[*Mark]string {
+	ret := map[*Mark]string{}
+	lock := sync.Mutex{}
+
+	e := newExecutor(opts)
+
+	Each(marks, e.Jobs, func(m *Mark) {
+		inv, err := e.invocation(m, args)
+		if err == nil {
+			out := &bytes.Buffer{}
+			inv.Capture = out
+
+			if err = e.run(inv); err == nil && !e.DryRun {
+				lock.Lock()
+				ret[m] = strings.TrimSpace(out.String())
+				lock.Unlock()
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(e.Stderr, "%s: %s\n", m.Path, err)
+		}
+	})
+
+	return ret
+}
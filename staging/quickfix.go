@@ -0,0 +1,93 @@
+package staging
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+// what a command's output lines can look like, as far as
+// Quickfix goes: grep -n, compilers and linters all say
+// file:line:col: message, or file:line: message, or without the
+// file, when it's the one they were given
+var (
+	quickfixFull   = regexp.MustCompile(`^([^:\s][^:]*):(\d+):(\d+):\s?(.*)$`)
+	quickfixNoCol  = regexp.MustCompile(`^([^:\s][^:]*):(\d+):\s?(.*)$`)
+	quickfixLine   = regexp.MustCompile(`^(\d+):(\d+):\s?(.*)$`)
+	quickfixLineNo = regexp.MustCompile(`^(\d+):\s?(.*)$`)
+)
+
+// QuickfixLine rewrites a line of a command's output on file as
+// file:line:col: message, for an editor's quickfix list; lines
+// that don't say where they're about are about line 1 of file.
+// Without a file (a batch's output, say), lines that don't name
+// one are left alone.
+func QuickfixLine(file, line string) string {
+	if m := quickfixLine.FindStringSubmatch(line); m != nil && file != "" {
+		return fmt.Sprintf("%s:%s:%s: %s", file, m[1], m[2], m[3])
+	}
+
+	if m := quickfixLineNo.FindStringSubmatch(line); m != nil && file != "" {
+		return fmt.Sprintf("%s:%s:1: %s", file, m[1], m[2])
+	}
+
+	if m := quickfixFull.FindStringSubmatch(line); m != nil {
+		return fmt.Sprintf("%s:%s:%s: %s", m[1], m[2], m[3], m[4])
+	}
+
+	if m := quickfixNoCol.FindStringSubmatch(line); m != nil {
+		return fmt.Sprintf("%s:%s:1: %s", m[1], m[2], m[3])
+	}
+
+	if file == "" {
+		return line
+	}
+
+	return fmt.Sprintf("%s:1:1: %s", file, line)
+}
+
+// quickfixWriter rewrites each line written through it with
+// QuickfixLine; since it has to see whole lines, the last one
+// waits for Flush if it doesn't end in a newline
+type quickfixWriter struct {
+	w    io.Writer
+	file string
+
+	// the line so far
+	buf []byte
+}
+
+func (q *quickfixWriter) Write(b []byte) (int, error) {
+	n := len(b)
+
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n')
+		if i < 0 {
+			q.buf = append(q.buf, b...)
+			break
+		}
+
+		q.buf = append(q.buf, b[:i]...)
+		b = b[i+1:]
+
+		if err := q.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// Flush writes out the line so far, if there is one
+func (q *quickfixWriter) Flush() error {
+	if len(q.buf) == 0 {
+		return nil
+	}
+
+	line := bytes.TrimRight(q.buf, "\r")
+	q.buf = q.buf[:0]
+
+	_, err := io.WriteString(q.w, QuickfixLine(q.file, string(line))+"\n")
+	return err
+}
@@ -0,0 +1,109 @@
+package staging
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// quoteArgs and unquoteArgs encode a command for execDirective
+func quoteArgs(args []string) string {
+	quoted := []string{}
+	for _, arg := range args {
+		quoted = append(quoted, strconv.Quote(arg))
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func unquoteArgs(line string) ([]string, error) {
+	args := []string{}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		q, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, err
+		}
+
+		arg, _ := strconv.Unquote(q)
+		args = append(args, arg)
+		line = line[len(q):]
+	}
+
+	return args, nil
+}
+
+// QuoteToken quotes a path or tag for a version 2 staging file,
+// if it has to be. A tag with an "=" in it is quoted so it
+// doesn't read back as an attribute.
+func QuoteToken(tok string) string {
+	if tok == "" || tok[0] == '#' {
+		return strconv.Quote(tok)
+	}
+
+	for _, r := range tok {
+		if r == '"' || r == '\\' || r == '=' || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(tok)
+		}
+	}
+
+	return tok
+}
+
+// SplitTokens splits a version 2 staging line into its tokens,
+// unquoting the quoted ones
+func SplitTokens(line string) []string {
+	toks, _ := splitQuoted(line)
+	return toks
+}
+
+// splitQuoted is SplitTokens, also saying which tokens were
+// quoted: those are never key=value fields
+func splitQuoted(line string) ([]string, []bool) {
+	toks := []string{}
+	quoted := []bool{}
+
+	for line = strings.TrimSpace(line); line != ""; line = strings.TrimSpace(line) {
+		if line[0] == '"' {
+			if q, err := strconv.QuotedPrefix(line); err == nil {
+				tok, _ := strconv.Unquote(q)
+				toks = append(toks, tok)
+				quoted = append(quoted, true)
+				line = line[len(q):]
+				continue
+			}
+		}
+
+		end := strings.IndexFunc(line, unicode.IsSpace)
+		if end < 0 {
+			end = len(line)
+		}
+
+		toks = append(toks, line[:end])
+		quoted = append(quoted, false)
+		line = line[end:]
+	}
+
+	return toks, quoted
+}
+
+// attribute values go in the staging file with whitespace
+// (and %, so we can tell) escaped
+func escapeValue(v string) string {
+	return strings.NewReplacer(
+		"%", "%25",
+		" ", "%20",
+		"\t", "%09",
+		"\n", "%0A",
+		"\r", "%0D",
+	).Replace(v)
+}
+
+func unescapeValue(v string) string {
+	if u, err := url.PathUnescape(v); err == nil {
+		return u
+	}
+
+	return v
+}
@@ -0,0 +1,235 @@
+package staging
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a remote mark's path says what host it's on, the way scp's do:
+// host:/path, or user@host:/path. The host has to be more than a
+// letter, so C:/ is still a drive.
+var remotePath = regexp.MustCompile(`^([A-Za-z0-9_.-]+@)?([A-Za-z0-9_.-]{2,}):(/.*)$`)
+
+// SplitRemote splits a remote path into its host (with the user,
+// if it has one) and the path there; for a local path, host is ""
+func SplitRemote(p string) (host, rest string) {
+	m := remotePath.FindStringSubmatch(p)
+	if m == nil {
+		return "", p
+	}
+
+	return m[1] + m[2], m[3]
+}
+
+// RemotePath is the path of file p on host, for a mark
+func RemotePath(host, p string) string {
+	return host + ":" + path.Clean(p)
+}
+
+// Host is the host the mark's file is on, or "" if it's here
+func (m *Mark) Host() string {
+	host, _ := SplitRemote(m.Path)
+	return host
+}
+
+// SSH is the Runner that runs the commands for remote marks on
+// the host their files are on, with ssh, and with the paths in
+// them as they are there. Marks that aren't remote run on Host,
+// if it's set, or here with Local. A command for marks on more
+// than one host (a batch, say) has nowhere to run.
+type SSH struct {
+	Host string
+
+	// the ssh command, and its options ("ssh -o BatchMode=yes"
+	// if it's empty: there's no one to type a password)
+	Command []string
+}
+
+func (r SSH) Run(ctx context.Context, c *Command) Result {
+	hosts := map[string]bool{}
+
+	for _, m := range c.Marks {
+		if host := m.Host(); host != "" {
+			hosts[host] = true
+		} else {
+			hosts[r.Host] = true
+		}
+	}
+
+	if len(hosts) == 0 {
+		hosts[r.Host] = true
+	}
+
+	if len(hosts) > 1 {
+		names := []string{}
+		for host := range hosts {
+			if host == "" {
+				host = "here"
+			}
+
+			names = append(names, host)
+		}
+
+		sort.Strings(names)
+
+		return Result{Exit: -1, Err: fmt.Errorf("marks on more than one host (%s)", strings.Join(names, ", "))}
+	}
+
+	var host string
+	for h := range hosts {
+		host = h
+	}
+
+	if host == "" {
+		return Local{}.Run(ctx, c)
+	}
+
+	ssh := r.Command
+	if len(ssh) == 0 {
+		ssh = []string{"ssh", "-o", "BatchMode=yes"}
+	}
+
+	argv := append(append([]string{}, ssh...), host, remoteCommand(host, c))
+
+	return Local{}.Run(ctx, &Command{
+		Marks:  c.Marks,
+		Argv:   argv,
+		Stdin:  c.Stdin,
+		Stdout: c.Stdout,
+		Stderr: c.Stderr,
+	})
+}
+
+// remoteCommand is the shell command line ssh runs on host for
+// c, with host's paths made local to it
+func remoteCommand(host string, c *Command) string {
+	local := func(s string) string {
+		return strings.ReplaceAll(s, host+":/", "/")
+	}
+
+	words := []string{}
+
+	if c.Dir != "" {
+		words = append(words, "cd", ShellQuote(local(c.Dir)), "&&")
+	}
+
+	if len(c.Env) > 0 {
+		words = append(words, "env")
+		for _, kv := range c.Env {
+			words = append(words, ShellQuote(local(kv)))
+		}
+	}
+
+	for _, arg := range c.Argv {
+		words = append(words, ShellQuote(local(arg)))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Hosts is the Runner that farms commands out to a pool of hosts,
+// over ssh, each to whichever is running the fewest (in turn,
+// when that's a tie); with Exec's Jobs, that's how many run at
+// once, across all of them. A mark's file has the same path on
+// every host: it's copied over first, with rsync, unless Shared
+// says it's there already, on a shared filesystem. Remote marks
+// run on their own hosts, as with SSH.
+type Hosts struct {
+	Hosts []string
+
+	// the ssh command (see SSH)
+	Command []string
+
+	Shared bool
+
+	lock sync.Mutex
+	busy map[string]int
+	next int
+}
+
+func (r *Hosts) Run(ctx context.Context, c *Command) Result {
+	for _, m := range c.Marks {
+		if m.Host() != "" {
+			return SSH{Command: r.Command}.Run(ctx, c)
+		}
+	}
+
+	host := r.take()
+	defer r.give(host)
+
+	start := time.Now()
+
+	if !r.Shared {
+		if err := r.copy(ctx, host, c); err != nil {
+			return Result{Exit: -1, Duration: time.Since(start), Err: err}
+		}
+	}
+
+	res := SSH{Host: host, Command: r.Command}.Run(ctx, c)
+	res.Duration = time.Since(start)
+
+	return res
+}
+
+// take picks the host for a command, and counts it as busy
+func (r *Hosts) take() string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.busy == nil {
+		r.busy = map[string]int{}
+	}
+
+	pick := ""
+
+	for i := range r.Hosts {
+		host := r.Hosts[(r.next+i)%len(r.Hosts)]
+		if pick == "" || r.busy[host] < r.busy[pick] {
+			pick = host
+		}
+	}
+
+	r.next++
+	r.busy[pick]++
+
+	return pick
+}
+
+func (r *Hosts) give(host string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.busy[host]--
+}
+
+// copy rsyncs the files for c's marks over to host, to the same
+// paths they have here
+func (r *Hosts) copy(ctx context.Context, host string, c *Command) error {
+	argv := []string{"rsync", "-aR"}
+
+	if len(r.Command) > 0 {
+		argv = append(argv, "-e", strings.Join(r.Command, " "))
+	}
+
+	for _, m := range c.Marks {
+		argv = append(argv, strings.TrimSuffix(m.Path, "/"))
+	}
+
+	res := Local{}.Run(ctx, &Command{
+		Argv:   append(argv, host+":/"),
+		Stdout: c.Stderr,
+		Stderr: c.Stderr,
+	})
+
+	if res.Err != nil {
+		return fmt.Errorf("copying to %s: %w", host, res.Err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package staging
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Command is a command for a Runner to run: the whole command
+// line, program first, with placeholders already expanded
+type Command struct {
+	// the marks it's for: one, or with Batch or List, a group
+	Marks []*Mark
+
+	Argv []string
+
+	// added to the environment
+	Env []string
+
+	// where to run, if not here
+	Dir string
+
+	Stdin          io.Reader
+	Stdout, Stderr io.Writer
+
+	// for Local, how to start the process, if it's special
+	SysProcAttr *syscall.SysProcAttr
+}
+
+// Result is how running a Command went: how it exited (-1 if it
+// never did, say because it was killed), how long it took, and
+// if it failed, why
+type Result struct {
+	Exit     int
+	Duration time.Duration
+	Err      error
+}
+
+// Runner runs commands for Exec, Probe and Capture, which work
+// out what to run; a Runner only decides where and how. It
+// should stop the command if ctx is canceled.
+type Runner interface {
+	Run(ctx context.Context, cmd *Command) Result
+}
+
+// Local is the Runner that runs commands here, as subprocesses
+type Local struct{}
+
+func (Local) Run(ctx context.Context, c *Command) Result {
+	cmd := exec.CommandContext(ctx, c.Argv[0], c.Argv[1:]...)
+	cmd.Env = append(os.Environ(), c.Env...)
+	cmd.Dir = c.Dir
+	cmd.Stdin = c.Stdin
+	cmd.Stdout = c.Stdout
+	cmd.Stderr = c.Stderr
+	cmd.SysProcAttr = c.SysProcAttr
+
+	// killing sh doesn't kill what it started, which can hold
+	// our output pipe open; don't wait forever on it
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+
+	res := Result{Err: cmd.Run(), Exit: -1}
+	res.Duration = time.Since(start)
+
+	if cmd.ProcessState != nil {
+		res.Exit = cmd.ProcessState.ExitCode()
+	}
+
+	return res
+}
+
+// Sudo is the Runner that runs commands as User (root, if it's
+// ""), with sudo, through Runner (Local, if it's nil). The command
+// stays a list of arguments all the way through, and since sudo
+// resets the environment, the command's own goes along with env.
+type Sudo struct {
+	User   string
+	Runner Runner
+}
+
+func (r Sudo) Run(ctx context.Context, c *Command) Result {
+	argv := []string{"sudo"}
+	if r.User != "" {
+		argv = append(argv, "-u", r.User)
+	}
+
+	argv = append(argv, "--")
+
+	if len(c.Env) > 0 {
+		argv = append(append(argv, "env"), c.Env...)
+	}
+
+	sc := *c
+	sc.Argv = append(argv, c.Argv...)
+	sc.Env = nil
+
+	if r.Runner == nil {
+		return Local{}.Run(ctx, &sc)
+	}
+
+	return r.Runner.Run(ctx, &sc)
+}
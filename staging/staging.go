@@ -0,0 +1,509 @@
+// Package staging is mark's staging area: a file listing marked
+// paths, with their tags, attributes and exec status, and the
+// machinery to run commands across them. The "mark" command is
+// a front end to it; anything else that wants to read, change or
+// exec a staging area the way mark does can use it too:
+//
+//	stage, err := staging.Load(path)
+//	...
+//	marks, err := stage.Select("photos and not done", "", "")
+//	...
+//	_, err = stage.Exec([]string{"convert", "_", "_.stem.png"}, marks, &staging.Options{Jobs: 4})
+//	...
+//	err = stage.Save()
+package staging
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Area is a staging area, as read from its staging file
+type Area struct {
+	Marks []Mark
+
+	// the staging file
+	Path string
+
+	// the last command exec'd, so "retry" can run it again
+	LastExec []string
+
+	// the patterns add has expanded, for the record
+	Globs []string
+
+	// the staging file is a JSON document, not lines; Write
+	// writes whichever this says
+	JSON bool
+
+	// Preserve keeps the marks under a directory when it's
+	// added, rather than letting it stand for them; Resolve
+	// resolves symlinks in added paths, so the same file can't
+	// be added twice by different paths; and Regexp makes
+	// patterns (see Matching) Go regexps rather than globs
+	Preserve bool
+	Resolve  bool
+	Regexp   bool
+
+	// for Resolve, the staged paths with symlinks resolved
+	canonical map[string]bool
+
+	// compiled Regexp patterns, so we don't recompile them per
+	// mark
+	regexps map[string]*regexp.Regexp
+
+	// checksum of the staging file as we read (or last wrote)
+	// it, to tell if someone else has changed it since
+	loaded string
+}
+
+// the line in the staging file recording the last command
+// exec'd; it's a comment as far as older marks are concerned
+const execDirective = "#exec: "
+
+// the lines in the staging file recording the patterns add
+// expanded to find its files
+const globDirective = "#glob: "
+
+// the line in the staging file saying which version of the
+// line format it's in. Version 1 (no directive) is whitespace
+// separated, so it can't hold a path with a space in it; version
+// 2 quotes tokens that need it, Go-style.
+const formatDirective = "#format: "
+
+// Version is the version of the line format Write writes
+const Version = 2
+
+var (
+	// ErrChanged is returned by Unchanged when the staging file
+	// isn't what was read
+	ErrChanged = errors.New("the staging file changed since it was read")
+
+	// ErrStagingMissing is returned by Load when there's no
+	// staging file
+	ErrStagingMissing = errors.New("no staging file")
+
+	// ErrBadPattern is returned for patterns, index ranges and
+	// tag expressions that don't parse
+	ErrBadPattern = errors.New("bad pattern")
+)
+
+// the crap we write at the top of every staging file
+func prefix(out io.Writer) {
+	cmd := strings.Trim(
+		filepath.Base(os.Args[0])+
+			" "+
+			strings.Join(os.Args[1:], " "), " ")
+
+	fmt.Fprintf(out, `
+# this file was automatically created by "%s"
+# you can edit it and mark will still work properly, but
+# mark will happily overwrite it as well.
+
+`, strings.Trim(cmd, " "))
+
+	fmt.Fprintf(out, "%s%d\n\n", formatDirective, Version)
+}
+
+// Create creates an empty staging file at path, as a JSON
+// document if json is set; it's an error for there to be
+// something there already
+func Create(path string, json bool) (*Area, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &Area{Path: path, JSON: json}
+
+	buf := &bytes.Buffer{}
+	err = ret.Write(buf)
+
+	if err == nil {
+		_, err = f.Write(buf.Bytes())
+	}
+
+	f.Close()
+
+	ret.loaded = contentSum(buf.Bytes())
+
+	return ret, err
+}
+
+// Load reads and parses the staging file at path; if there
+// isn't one, the error is ErrStagingMissing
+func Load(path string) (*Area, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %w", ErrStagingMissing, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	ret, err := Parse(path, data)
+	if ret != nil {
+		ret.loaded = contentSum(data)
+	}
+
+	return ret, err
+}
+
+// Parse reads a staging area from a staging file's contents, in
+// any of its formats; path is just for the record (and for
+// errors), and needn't exist
+func Parse(path string, data []byte) (*Area, error) {
+	s := &Area{Path: path}
+
+	if IsJSON(data) {
+		s.JSON = true
+		return s, s.readJSON(data)
+	}
+
+	return s, s.readText(data)
+}
+
+// readText reads marks from a staging file in the line format
+func (s *Area) readText(data []byte) error {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	// files without a format directive are version 1
+	version := 1
+
+	for {
+		line, eof := reader.ReadString('\n')
+		if eof != nil && line == "" {
+			break
+		}
+
+		if strings.HasPrefix(line, formatDirective) {
+			v, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, formatDirective)))
+			if err != nil || v > Version {
+				return fmt.Errorf("%s: unknown staging format %q", s.Path, strings.TrimSpace(line))
+			}
+
+			version = v
+		} else if strings.HasPrefix(line, execDirective) {
+			// a broken directive is as good as a comment
+			if args, err := unquoteArgs(strings.TrimPrefix(line, execDirective)); err == nil {
+				s.LastExec = args
+			}
+		} else if strings.HasPrefix(line, globDirective) {
+			if pats, err := unquoteArgs(strings.TrimPrefix(line, globDirective)); err == nil {
+				s.Globs = append(s.Globs, pats...)
+			}
+		} else if line[0] == '\n' || line[0] == ' ' || line[0] == '#' {
+			continue
+		} else {
+			toks := strings.Fields(line)
+			quoted := make([]bool, len(toks))
+			if version >= 2 {
+				toks, quoted = splitQuoted(line)
+			}
+
+			if len(toks) == 0 {
+				continue
+			}
+
+			m := Mark{
+				Stage: s,
+				Path:  toks[0],
+			}
+
+			// key=value fields are about the mark: its status
+			// or attributes; the rest, and anything quoted,
+			// are tags
+			for i, tok := range toks[1:] {
+				key, val, isField := strings.Cut(tok, "=")
+
+				switch {
+				case !isField || quoted[i+1]:
+					m.Tags = append(m.Tags, tok)
+				case key == "status":
+					m.parseStatus(val)
+				case key == "sum":
+					m.parseStamp(val)
+				case key == "added":
+					m.parseAdded(val)
+				default:
+					m.SetAttr(key, unescapeValue(val))
+				}
+			}
+
+			s.Marks = append(s.Marks, m)
+		}
+	}
+
+	return nil
+}
+
+// Write writes the staging area to out, as a staging file in
+// whichever format JSON says
+func (s *Area) Write(out io.Writer) error {
+	if s.JSON {
+		return s.writeJSON(out)
+	}
+
+	return s.writeText(out)
+}
+
+// writeText writes the staging area as lines, one per mark
+func (s *Area) writeText(out io.Writer) error {
+	f := bufio.NewWriter(out)
+
+	prefix(f)
+
+	// once the marks they found are gone, so are the patterns
+	if len(s.Marks) > 0 {
+		for _, pat := range s.Globs {
+			io.WriteString(f, globDirective+quoteArgs([]string{pat})+"\n")
+		}
+	}
+
+	if len(s.LastExec) > 0 {
+		io.WriteString(f, execDirective+quoteArgs(s.LastExec)+"\n\n")
+	}
+
+	for _, m := range s.Marks {
+		io.WriteString(f, QuoteToken(m.Path))
+
+		for _, t := range m.Tags {
+			io.WriteString(f, " "+QuoteToken(t))
+		}
+
+		for _, k := range m.AttrKeys() {
+			io.WriteString(f, " "+k+"="+escapeValue(m.Attrs[k]))
+		}
+
+		if !m.ModTime.IsZero() {
+			io.WriteString(f, " sum="+m.formatStamp())
+		}
+
+		if !m.Added.IsZero() {
+			io.WriteString(f, " added="+m.formatAdded())
+		}
+
+		if m.Status != "" {
+			io.WriteString(f, " status="+m.formatStatus())
+		}
+
+		io.WriteString(f, "\n")
+	}
+
+	return f.Flush()
+}
+
+// Unchanged makes sure the staging file is still what we read
+// (or last saved), returning ErrChanged if it isn't, so Save
+// doesn't throw away somebody else's changes
+func (s *Area) Unchanged() error {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return ErrChanged
+	} else if err != nil {
+		return err
+	}
+
+	if contentSum(data) != s.loaded {
+		return ErrChanged
+	}
+
+	return nil
+}
+
+// Save writes the staging area back to its staging file (see
+// WriteAtomic). It doesn't check that the file is unchanged
+// first; that's what Unchanged is for.
+func (s *Area) Save() error {
+	buf := &bytes.Buffer{}
+	if err := s.Write(buf); err != nil {
+		return err
+	}
+
+	err := WriteAtomic(s.Path, func(out io.Writer) error {
+		_, err := out.Write(buf.Bytes())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	s.loaded = contentSum(buf.Bytes())
+
+	return nil
+}
+
+// Remove removes all files from the staging area matching pat
+// (see Matching)
+func (s *Area) Remove(pat string) (int, error) {
+	marks, err := s.Matching(pat)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Drop(marks), nil
+}
+
+// Drop removes marks (which point into s.Marks) from the
+// staging area
+func (s *Area) Drop(marks []*Mark) int {
+	drop := map[*Mark]bool{}
+	for _, m := range marks {
+		drop[m] = true
+	}
+
+	newMarks := []Mark{}
+
+	for i := range s.Marks {
+		if !drop[&s.Marks[i]] {
+			newMarks = append(newMarks, s.Marks[i])
+		}
+	}
+
+	killed := len(s.Marks) - len(newMarks)
+	s.Marks = newMarks
+
+	return killed
+}
+
+// Add adds a path to the staging area, reporting whether it
+// wasn't there already; the path can be remote (see
+// SplitRemote). Unless Preserve is set, adding a directory that
+// is a parent to other files already in the staging area
+// replaces those files with the directory itself.
+func (s *Area) Add(path string) (bool, error) {
+	var err error
+
+	// a remote path is already absolute, and what it resolves
+	// to is the remote host's business
+	host, rest := SplitRemote(path)
+	if host != "" {
+		path = RemotePath(host, rest)
+	} else if path, err = filepath.Abs(path); err != nil {
+		return false, err
+	}
+
+	if s.Resolve && host == "" {
+		path = CanonicalPath(path)
+
+		if s.canonical == nil {
+			s.canonical = map[string]bool{}
+			for _, m := range s.Marks {
+				s.canonical[CanonicalPath(m.Path)] = true
+			}
+		}
+
+		// the same file, by some other path
+		if s.canonical[path] {
+			return false, nil
+		}
+
+		s.canonical[path] = true
+	}
+
+	newDir := strings.HasSuffix(path, "/")
+	kill := map[int]bool{}
+
+	for i, m := range s.Marks {
+		// same as staged path, do nothing
+		if m.Path == path {
+			return false, nil
+		}
+
+		oldDir := strings.HasSuffix(m.Path, "/")
+
+		// file already referenced by staged dir, do nothing
+		if oldDir && strings.HasPrefix(path, m.Path) {
+			return false, nil
+		}
+
+		// path contained under new directory, no longer
+		// need specific mark
+		if newDir && strings.HasPrefix(m.Path, path) {
+			if !s.Preserve {
+				kill[i] = true
+			}
+		}
+	}
+
+	newMark := []Mark{}
+
+	for i, m := range s.Marks {
+		if !kill[i] {
+			newMark = append(newMark, m)
+		}
+	}
+
+	m := Mark{
+		Stage:   s,
+		Path:    path,
+		Added:   time.Now(),
+		AddedBy: currentUser(),
+	}
+
+	m.AddedFrom, _ = os.Getwd()
+
+	// it's fine to stage files that don't exist yet
+	if err = m.Stamp(); os.IsNotExist(err) {
+		err = nil
+	}
+
+	newMark = append(newMark, m)
+
+	s.Marks = newMark
+
+	return true, err
+}
+
+// currentUser is who's adding marks, for the record
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
+
+// CanonicalPath is path with any symlinks in it resolved, if
+// there's anything there to resolve
+func CanonicalPath(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		return real
+	}
+
+	return path
+}
+
+// AddGlob records a pattern add expanded
+func (s *Area) AddGlob(pat string) {
+	for _, g := range s.Globs {
+		if g == pat {
+			return
+		}
+	}
+
+	s.Globs = append(s.Globs, pat)
+}
+
+// Unfinished returns the marks that haven't run successfully,
+// either because their command failed or because it never ran
+func (s *Area) Unfinished() []Mark {
+	ret := []Mark{}
+
+	for _, m := range s.Marks {
+		if m.Status != "done" {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret
+}
@@ -0,0 +1,161 @@
+package staging
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testArea is a staging area with a bit of everything in it
+func testArea() *Area {
+	when := time.Date(2017, 9, 17, 12, 0, 0, 0, time.UTC)
+
+	s := &Area{
+		Path:     "/tmp/staging",
+		LastExec: []string{"convert", "_", "_.stem.png"},
+		Globs:    []string{"/photos/**/*.jpg"},
+	}
+
+	s.Marks = []Mark{
+		{Path: "/photos/a.jpg", Tags: []string{"photos", "trip/2017", "looks=like an attribute"}},
+		{
+			Path:   "/photos/with space.jpg",
+			Tags:   []string{"has space"},
+			Status: "failed",
+			Exit:   2,
+			When:   when,
+		},
+		{
+			Path:      "/docs/#notes.txt",
+			Status:    "done",
+			When:      when,
+			Size:      12,
+			ModTime:   time.Unix(0, 1505649600123456789),
+			Hash:      "abc123",
+			Added:     when,
+			AddedBy:   "tqbf",
+			AddedFrom: "/home/tqbf/my docs",
+		},
+		{Path: "/docs/\"quoted\"\tand\\slashed"},
+	}
+
+	s.Marks[0].SetAttr("caption", "a day, at the beach")
+	s.Marks[0].SetAttr("rating", "5")
+	s.Marks[1].SetAttr("empty", "")
+
+	for i := range s.Marks {
+		s.Marks[i].Stage = s
+	}
+
+	return s
+}
+
+// roundTrip writes s in whichever format it's in, and parses it
+// back
+func roundTrip(t *testing.T, s *Area) *Area {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	if err := s.Write(buf); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	back, err := Parse(s.Path, buf.Bytes())
+	if err != nil {
+		t.Fatalf("Parse: %s\n%s", err, buf)
+	}
+
+	return back
+}
+
+// sameMarks checks that got has the marks want does, as far as
+// the staging file records them
+func sameMarks(t *testing.T, got, want []Mark) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d marks, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		g, w := got[i], want[i]
+		g.Stage, w.Stage = nil, nil
+
+		if !g.When.Equal(w.When) || !g.ModTime.Equal(w.ModTime) || !g.Added.Equal(w.Added) {
+			t.Errorf("mark %d: times %v %v %v, want %v %v %v", i, g.When, g.ModTime, g.Added, w.When, w.ModTime, w.Added)
+		}
+
+		g.When, g.ModTime, g.Added = time.Time{}, time.Time{}, time.Time{}
+		w.When, w.ModTime, w.Added = time.Time{}, time.Time{}, time.Time{}
+
+		if !reflect.DeepEqual(g, w) {
+			t.Errorf("mark %d:\n got %+v\nwant %+v", i, g, w)
+		}
+	}
+}
+
+func TestRoundTripText(t *testing.T) {
+	s := testArea()
+	back := roundTrip(t, s)
+
+	if back.JSON {
+		t.Errorf("text staging file read back as JSON")
+	}
+
+	if !reflect.DeepEqual(back.LastExec, s.LastExec) {
+		t.Errorf("LastExec = %q, want %q", back.LastExec, s.LastExec)
+	}
+
+	if !reflect.DeepEqual(back.Globs, s.Globs) {
+		t.Errorf("Globs = %q, want %q", back.Globs, s.Globs)
+	}
+
+	sameMarks(t, back.Marks, s.Marks)
+}
+
+func TestRoundTripJSON(t *testing.T) {
+	s := testArea()
+	s.JSON = true
+
+	back := roundTrip(t, s)
+
+	if !back.JSON {
+		t.Errorf("JSON staging file read back as text")
+	}
+
+	if !reflect.DeepEqual(back.LastExec, s.LastExec) {
+		t.Errorf("LastExec = %q, want %q", back.LastExec, s.LastExec)
+	}
+
+	sameMarks(t, back.Marks, s.Marks)
+}
+
+func TestParseVersion1(t *testing.T) {
+	// no format directive, no quoting: just paths and tags
+	s, err := Parse("old", []byte("/a/b.txt one two\n# a comment\n\n/c/d.txt status=done\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.Marks) != 2 {
+		t.Fatalf("got %d marks, want 2", len(s.Marks))
+	}
+
+	if got := s.Marks[0].Tags; !reflect.DeepEqual(got, []string{"one", "two"}) {
+		t.Errorf("tags = %q", got)
+	}
+
+	if got := s.Marks[1].Status; got != "done" {
+		t.Errorf("status = %q, want done", got)
+	}
+}
+
+func TestParseUnknownVersion(t *testing.T) {
+	data := fmt.Sprintf("%s%d\n/a/b.txt\n", formatDirective, Version+1)
+
+	if _, err := Parse("new", []byte(data)); err == nil {
+		t.Errorf("Parse took a staging file from the future")
+	}
+}
@@ -0,0 +1,269 @@
+package staging
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// contentSum returns the hex SHA-256 of some bytes
+func contentSum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashFile returns the hex SHA-256 of a file's contents
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Stamp records the size, modification time and (for regular
+// files) content hash of the mark's file, so Verify can tell
+// later if it's changed. Remote marks go unstamped.
+func (m *Mark) Stamp() error {
+	if m.Host() != "" {
+		return nil
+	}
+
+	fi, err := os.Lstat(m.Path)
+	if err != nil {
+		return err
+	}
+
+	m.Size = fi.Size()
+	m.ModTime = fi.ModTime()
+	m.Hash = ""
+
+	if fi.Mode().IsRegular() {
+		m.Hash, err = hashFile(m.Path)
+	}
+
+	return err
+}
+
+// Verify checks the mark's file against what Stamp recorded,
+// returning "" if it looks the same, otherwise "missing",
+// "changed", or "unstamped" if there's nothing to check against
+func (m *Mark) Verify() (string, error) {
+	if m.ModTime.IsZero() {
+		return "unstamped", nil
+	}
+
+	fi, err := os.Lstat(m.Path)
+	if os.IsNotExist(err) {
+		return "missing", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if !fi.Mode().IsRegular() || m.Hash == "" {
+		if fi.Size() != m.Size || !fi.ModTime().Equal(m.ModTime) {
+			return "changed", nil
+		}
+
+		return "", nil
+	}
+
+	if fi.Size() != m.Size {
+		return "changed", nil
+	}
+
+	// same size and time is good enough; otherwise, it's down
+	// to the contents
+	if fi.ModTime().Equal(m.ModTime) {
+		return "", nil
+	}
+
+	hash, err := hashFile(m.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if hash != m.Hash {
+		return "changed", nil
+	}
+
+	return "", nil
+}
+
+// in the staging file, the stamp is "sum=size,mtime,sha256",
+// with the mtime in Unix nanoseconds
+func (m *Mark) formatStamp() string {
+	return fmt.Sprintf("%d,%d,%s", m.Size, m.ModTime.UnixNano(), m.Hash)
+}
+
+func (m *Mark) parseStamp(val string) {
+	parts := strings.SplitN(val, ",", 3)
+	if len(parts) != 3 {
+		return
+	}
+
+	m.Size, _ = strconv.ParseInt(parts[0], 10, 64)
+
+	if ns, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+		m.ModTime = time.Unix(0, ns)
+	}
+
+	m.Hash = parts[2]
+}
+
+// nearestDir returns the closest directory to path that still
+// exists, starting with its parent
+func nearestDir(path string) string {
+	dir := filepath.Dir(path)
+
+	for {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return dir
+		}
+
+		dir = parent
+	}
+}
+
+// Refresh looks for the files of marks that have gone missing,
+// by their stamped content hash, under root (or if root is
+// empty, under the closest directory to where each one was that
+// still exists), and points the marks at them. It returns the
+// marks it found new homes for, and where each of them was.
+func (s *Area) Refresh(root string) map[*Mark]string {
+	staged := map[string]bool{}
+	for _, m := range s.Marks {
+		staged[m.Path] = true
+	}
+
+	// missing marks by the directory to look for them in
+	lost := map[string][]*Mark{}
+
+	for i := range s.Marks {
+		m := &s.Marks[i]
+
+		if m.Hash == "" {
+			continue
+		}
+
+		if _, err := os.Lstat(m.Path); !os.IsNotExist(err) {
+			continue
+		}
+
+		dir := root
+		if dir == "" {
+			dir = nearestDir(m.Path)
+		}
+
+		lost[dir] = append(lost[dir], m)
+	}
+
+	found := map[*Mark]string{}
+
+	for dir, marks := range lost {
+		// only hash files whose size could be a match
+		sizes := map[int64]bool{}
+		for _, m := range marks {
+			sizes[m.Size] = true
+		}
+
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || staged[path] {
+				return nil
+			}
+
+			fi, err := d.Info()
+			if err != nil || !sizes[fi.Size()] {
+				return nil
+			}
+
+			hash, err := hashFile(path)
+			if err != nil {
+				return nil
+			}
+
+			for j, m := range marks {
+				if m.Hash != hash {
+					continue
+				}
+
+				found[m] = m.Path
+
+				staged[path] = true
+				m.Path = path
+				m.Stamp()
+
+				marks = append(marks[:j], marks[j+1:]...)
+				break
+			}
+
+			if len(marks) == 0 {
+				return filepath.SkipAll
+			}
+
+			return nil
+		})
+	}
+
+	return found
+}
+
+// Duplicates hashes the files of marks, up to jobs at once, and
+// groups the ones with the same contents, in staging order; each
+// group is keyed by its hash, and marks whose files can't be
+// read are left out
+func (s *Area) Duplicates(marks []*Mark, jobs int) map[string][]*Mark {
+	hashes := map[*Mark]string{}
+	lock := sync.Mutex{}
+
+	Each(marks, jobs, func(m *Mark) {
+		if fi, err := os.Stat(m.Path); err != nil || !fi.Mode().IsRegular() {
+			return
+		}
+
+		hash, err := hashFile(m.Path)
+		if err != nil {
+			return
+		}
+
+		lock.Lock()
+		hashes[m] = hash
+		lock.Unlock()
+	})
+
+	groups := map[string][]*Mark{}
+	for _, m := range marks {
+		if hash, found := hashes[m]; found {
+			groups[hash] = append(groups[hash], m)
+		}
+	}
+
+	for hash, group := range groups {
+		if len(group) < 2 {
+			delete(groups, hash)
+		}
+	}
+
+	return groups
+}
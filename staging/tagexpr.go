@@ -0,0 +1,168 @@
+package staging
+
+import (
+	"fmt"
+	"strings"
+)
+
+// a compiled tag expression, true for the marks it selects
+type tagExpr func(m *Mark) bool
+
+// parseTagExpr compiles a tag expression: tag names combined
+// with "and", "or", "not" (or "!") and parentheses, as in
+// "photos and not (done or skip)" or "photos and !done". "not"
+// binds tightest, then "and", then "or". A plain tag name
+// selects marks with that tag, like it always has, or with any
+// tag under it (see HasTag).
+func parseTagExpr(s string) (tagExpr, error) {
+	p := &tagParser{toks: tokenizeTagExpr(s)}
+
+	if len(p.toks) == 0 {
+		return nil, fmt.Errorf("empty tag expression")
+	}
+
+	e, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.pos < len(p.toks) {
+		return nil, fmt.Errorf("unexpected %q in tag expression", p.toks[p.pos])
+	}
+
+	return e, nil
+}
+
+func tokenizeTagExpr(s string) []string {
+	toks := []string{}
+	cur := ""
+
+	flush := func() {
+		if cur != "" {
+			toks = append(toks, cur)
+			cur = ""
+		}
+	}
+
+	for _, c := range s {
+		switch {
+		case c == '(' || c == ')':
+			flush()
+			toks = append(toks, string(c))
+		case c == '!' && cur == "":
+			toks = append(toks, "!")
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		default:
+			cur += string(c)
+		}
+	}
+
+	flush()
+
+	return toks
+}
+
+type tagParser struct {
+	toks []string
+	pos  int
+}
+
+func (p *tagParser) peek() string {
+	if p.pos < len(p.toks) {
+		return p.toks[p.pos]
+	}
+
+	return ""
+}
+
+func (p *tagParser) or() (tagExpr, error) {
+	l, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.ToLower(p.peek()) == "or" {
+		p.pos++
+
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+
+		l = func(l, r tagExpr) tagExpr {
+			return func(m *Mark) bool { return l(m) || r(m) }
+		}(l, r)
+	}
+
+	return l, nil
+}
+
+func (p *tagParser) and() (tagExpr, error) {
+	l, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+
+	for strings.ToLower(p.peek()) == "and" {
+		p.pos++
+
+		r, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		l = func(l, r tagExpr) tagExpr {
+			return func(m *Mark) bool { return l(m) && r(m) }
+		}(l, r)
+	}
+
+	return l, nil
+}
+
+func (p *tagParser) not() (tagExpr, error) {
+	if tok := strings.ToLower(p.peek()); tok == "not" || tok == "!" {
+		p.pos++
+
+		e, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+
+		return func(m *Mark) bool { return !e(m) }, nil
+	}
+
+	return p.term()
+}
+
+func (p *tagParser) term() (tagExpr, error) {
+	tok := p.peek()
+
+	switch strings.ToLower(tok) {
+	case "":
+		return nil, fmt.Errorf("tag expression ends too soon")
+
+	case ")", "and", "or":
+		return nil, fmt.Errorf("unexpected %q in tag expression", tok)
+
+	case "(":
+		p.pos++
+
+		e, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ) in tag expression")
+		}
+
+		p.pos++
+
+		return e, nil
+	}
+
+	p.pos++
+
+	return func(m *Mark) bool { return m.HasTag(tok) }, nil
+}
@@ -0,0 +1,60 @@
+package staging
+
+import "testing"
+
+func TestTagExpr(t *testing.T) {
+	marks := map[string]*Mark{
+		"a": {Tags: []string{"photos", "done"}},
+		"b": {Tags: []string{"photos"}},
+		"c": {Tags: []string{"photos/2017", "skip"}},
+		"d": {},
+	}
+
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"photos", "abc"},
+		{"photos/2017", "c"},
+		{"done", "a"},
+		{"not photos", "d"},
+		{"!photos", "d"},
+		{"photos and not done", "bc"},
+		{"photos and !done", "bc"},
+		{"photos AND NOT done", "bc"},
+		{"done or skip", "ac"},
+		{"photos and not (done or skip)", "b"},
+		{"not done and not skip", "bd"},
+
+		// "and" binds tighter than "or"
+		{"done or photos and skip", "ac"},
+		{"(done or photos) and skip", "c"},
+	}
+
+	for _, tt := range tests {
+		e, err := parseTagExpr(tt.expr)
+		if err != nil {
+			t.Errorf("parseTagExpr(%q): %s", tt.expr, err)
+			continue
+		}
+
+		got := ""
+		for _, name := range []string{"a", "b", "c", "d"} {
+			if e(marks[name]) {
+				got += name
+			}
+		}
+
+		if got != tt.want {
+			t.Errorf("%q selects %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestTagExprErrors(t *testing.T) {
+	for _, expr := range []string{"", "photos and", "(photos", "photos)", "not", "and photos"} {
+		if _, err := parseTagExpr(expr); err == nil {
+			t.Errorf("parseTagExpr(%q) worked", expr)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package staging
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// isDirMark reports whether a staged path is a directory
+func isDirMark(path string) bool {
+	if strings.HasSuffix(path, "/") {
+		return true
+	}
+
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// Under reports whether path is inside the directory dir
+func Under(path, dir string) bool {
+	return strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// Merge brings the marks of another staging area into this one.
+// A path that's already staged picks up the other's tags, and
+// whichever of its attributes it doesn't already have. As with
+// Add, a staged directory covers the files under it: those are
+// left out, and a directory coming in replaces the marks under it
+// (unless Preserve is set). It returns how many marks are new.
+func (s *Area) Merge(other *Area) int {
+	staged := map[string]int{}
+	dirs := []string{}
+
+	for i, m := range s.Marks {
+		staged[m.Path] = i
+
+		if isDirMark(m.Path) {
+			dirs = append(dirs, m.Path)
+		}
+	}
+
+	covered := func(path string) bool {
+		for _, dir := range dirs {
+			if Under(path, dir) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	kill := map[string]bool{}
+	added := 0
+
+	for _, om := range other.Marks {
+		if i, ok := staged[om.Path]; ok {
+			m := &s.Marks[i]
+
+			for _, t := range om.Tags {
+				m.Tag(t)
+			}
+
+			for _, k := range om.AttrKeys() {
+				if _, has := m.Attrs[k]; !has {
+					m.SetAttr(k, om.Attrs[k])
+				}
+			}
+
+			continue
+		}
+
+		if covered(om.Path) {
+			continue
+		}
+
+		if isDirMark(om.Path) {
+			if !s.Preserve {
+				for path := range staged {
+					if Under(path, om.Path) {
+						kill[path] = true
+					}
+				}
+			}
+
+			dirs = append(dirs, om.Path)
+		}
+
+		m := om
+		m.Stage = s
+		m.Tags = append([]string{}, om.Tags...)
+		m.Attrs = nil
+
+		for _, k := range om.AttrKeys() {
+			m.SetAttr(k, om.Attrs[k])
+		}
+
+		staged[m.Path] = len(s.Marks)
+		s.Marks = append(s.Marks, m)
+		added++
+	}
+
+	if len(kill) > 0 {
+		marks := []Mark{}
+		for _, m := range s.Marks {
+			if !kill[m.Path] {
+				marks = append(marks, m)
+			}
+		}
+
+		s.Marks = marks
+	}
+
+	return added
+}
+
+// Export writes the staging area to out as a JSON document (see
+// JSONMark), which Parse reads back
+func (s *Area) Export(out io.Writer) error {
+	return s.writeJSON(out)
+}
+
+// Filter keeps the marks whose paths are in set (or with
+// keep false, the ones that aren't), returning how many it drops
+func (s *Area) Filter(set map[string]bool, keep bool) int {
+	drop := []*Mark{}
+
+	for i := range s.Marks {
+		if set[s.Marks[i].Path] != keep {
+			drop = append(drop, &s.Marks[i])
+		}
+	}
+
+	return s.Drop(drop)
+}
@@ -0,0 +1,86 @@
+package staging
+
+import (
+	"reflect"
+	"testing"
+)
+
+func testMarks(paths ...string) *Area {
+	s := &Area{}
+	for _, p := range paths {
+		s.Marks = append(s.Marks, Mark{Path: p, Stage: s})
+	}
+
+	return s
+}
+
+func paths(s *Area) []string {
+	ret := []string{}
+	for _, m := range s.Marks {
+		ret = append(ret, m.Path)
+	}
+
+	return ret
+}
+
+func TestMerge(t *testing.T) {
+	s := testMarks("/a/one.txt", "/b/")
+	s.Marks[0].Tag("old")
+	s.Marks[0].SetAttr("keep", "mine")
+
+	other := testMarks("/a/one.txt", "/a/two.txt", "/b/three.txt")
+	other.Marks[0].Tag("new")
+	other.Marks[0].SetAttr("keep", "theirs")
+	other.Marks[0].SetAttr("extra", "x")
+	other.Marks[1].Tag("two")
+
+	if added := s.Merge(other); added != 1 {
+		t.Errorf("Merge added %d, want 1", added)
+	}
+
+	// three.txt is under the staged /b/
+	if got, want := paths(s), []string{"/a/one.txt", "/b/", "/a/two.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paths = %q, want %q", got, want)
+	}
+
+	one := s.Marks[0]
+	if want := []string{"old", "new"}; !reflect.DeepEqual(one.Tags, want) {
+		t.Errorf("tags = %q, want %q", one.Tags, want)
+	}
+
+	if one.Attrs["keep"] != "mine" || one.Attrs["extra"] != "x" {
+		t.Errorf("attrs = %v", one.Attrs)
+	}
+
+	two := &s.Marks[2]
+	if two.Stage != s {
+		t.Errorf("merged mark belongs to the other staging area")
+	}
+
+	// and doesn't share its tags with it
+	two.Tag("more")
+	if len(other.Marks[1].Tags) != 1 {
+		t.Errorf("tagging a merged mark tagged the original")
+	}
+}
+
+func TestMergeDirectory(t *testing.T) {
+	s := testMarks("/a/one.txt", "/a/sub/two.txt", "/b/three.txt")
+	other := testMarks("/a/")
+
+	if added := s.Merge(other); added != 1 {
+		t.Errorf("Merge added %d, want 1", added)
+	}
+
+	if got, want := paths(s), []string{"/b/three.txt", "/a/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("paths = %q, want %q", got, want)
+	}
+
+	s = testMarks("/a/one.txt")
+	s.Preserve = true
+	s.Merge(testMarks("/a/"))
+
+	if got, want := paths(s), []string{"/a/one.txt", "/a/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("with Preserve, paths = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// a count of marks and the bytes they add up to
+type tally struct {
+	Marks int   `json:"marks"`
+	Bytes int64 `json:"bytes"`
+}
+
+// what "mark stats" reports
+type markStats struct {
+	tally
+	Missing int              `json:"missing"`
+	ByExt   map[string]tally `json:"by_ext"`
+	ByTag   map[string]tally `json:"by_tag"`
+}
+
+// diskSize is how much data is at path: a file's size, or
+// everything in a directory
+func diskSize(path string) (int64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if !fi.IsDir() {
+		return fi.Size(), nil
+	}
+
+	total := int64(0)
+
+	filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+
+		return nil
+	})
+
+	return total, nil
+}
+
+// stats adds up marks, overall, by extension and by tag
+func stats(marks []*Mark) markStats {
+	st := markStats{
+		ByExt: map[string]tally{},
+		ByTag: map[string]tally{},
+	}
+
+	add := func(t map[string]tally, key string, size int64) {
+		cur := t[key]
+		cur.Marks++
+		cur.Bytes += size
+		t[key] = cur
+	}
+
+	for _, m := range marks {
+		size, err := diskSize(m.Path)
+		if err != nil {
+			st.Missing++
+		}
+
+		st.Marks++
+		st.Bytes += size
+
+		add(st.ByExt, strings.ToLower(filepath.Ext(m.Path)), size)
+
+		for _, t := range m.Tags {
+			add(st.ByTag, t, size)
+		}
+	}
+
+	return st
+}
+
+// printStats shows stats, biggest first in each breakdown
+func printStats(st markStats) {
+	fmt.Printf("%d marks, %s (%d bytes)", st.Marks, humanSize(st.Bytes), st.Bytes)
+	if st.Missing > 0 {
+		fmt.Printf(", %d missing", st.Missing)
+	}
+
+	fmt.Printf("\n")
+
+	breakdown := func(title string, t map[string]tally, none string) {
+		if len(t) == 0 {
+			return
+		}
+
+		keys := []string{}
+		for k := range t {
+			keys = append(keys, k)
+		}
+
+		sort.Slice(keys, func(i, j int) bool {
+			if t[keys[i]].Bytes != t[keys[j]].Bytes {
+				return t[keys[i]].Bytes > t[keys[j]].Bytes
+			}
+
+			return keys[i] < keys[j]
+		})
+
+		fmt.Printf("\nby %s:\n", title)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, k := range keys {
+			name := k
+			if name == "" {
+				name = none
+			}
+
+			fmt.Fprintf(w, "  %s\t%d\t%s\t\n", name, t[k].Marks, humanSize(t[k].Bytes))
+		}
+
+		w.Flush()
+	}
+
+	breakdown("extension", st.ByExt, "(none)")
+	breakdown("tag", st.ByTag, "")
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// a terminal in raw mode, for full-screen things like "mark ui";
+// there's no termios in the standard library, so this leans on
+// stty
+type terminal struct {
+	f     *os.File
+	saved string
+
+	// read, but not yet returned by ReadKey
+	pending []byte
+
+	// on the alternate screen
+	full bool
+}
+
+func openTerminal() (*terminal, error) {
+	f, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("no terminal: %w", err)
+	}
+
+	t := &terminal{f: f}
+
+	saved, err := t.stty("-g")
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stty: %w", err)
+	}
+
+	t.saved = strings.TrimSpace(saved)
+
+	if _, err = t.stty("raw", "-echo"); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("stty: %w", err)
+	}
+
+	return t, nil
+}
+
+// FullScreen switches to the alternate screen, so what was
+// there comes back after
+func (t *terminal) FullScreen() {
+	fmt.Fprintf(t.f, "\x1b[?1049h")
+	t.full = true
+}
+
+func (t *terminal) stty(args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = t.f
+
+	out, err := cmd.Output()
+	return string(out), err
+}
+
+// Close puts the terminal back how it was
+func (t *terminal) Close() {
+	if t.full {
+		fmt.Fprintf(t.f, "\x1b[?1049l")
+	}
+
+	t.stty(t.saved)
+	t.f.Close()
+}
+
+// Size is the terminal's rows and columns, or a guess
+func (t *terminal) Size() (rows, cols int) {
+	rows, cols = ttySize(t.f)
+
+	if rows <= 0 {
+		rows = 24
+		if n, err := strconv.Atoi(os.Getenv("LINES")); err == nil && n > 0 {
+			rows = n
+		}
+	}
+
+	if cols <= 0 {
+		cols = 80
+		if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+			cols = n
+		}
+	}
+
+	return rows, cols
+}
+
+// the escape sequences ReadKey knows
+var keySequences = map[string]string{
+	"\x1b[A":  "up",
+	"\x1bOA":  "up",
+	"\x1b[B":  "down",
+	"\x1bOB":  "down",
+	"\x1b[5~": "pgup",
+	"\x1b[6~": "pgdn",
+	"\x1b[C":  "right",
+	"\x1bOC":  "right",
+	"\x1b[D":  "left",
+	"\x1bOD":  "left",
+	"\x1b[H":  "home",
+	"\x1bOH":  "home",
+	"\x1b[F":  "end",
+	"\x1bOF":  "end",
+	"\x1b[3~": "delete",
+}
+
+// ReadKey waits for a keypress: a single character, or one of
+// "up", "down", "left", "right", "home", "end", "pgup", "pgdn",
+// "delete", "enter", "tab", "backspace" or
+// "esc", or "ctrl-" and a letter
+func (t *terminal) ReadKey() (string, error) {
+	if len(t.pending) == 0 {
+		buf := make([]byte, 256)
+
+		n, err := t.f.Read(buf)
+		if err != nil {
+			return "", err
+		}
+
+		t.pending = buf[:n]
+	}
+
+	in := string(t.pending)
+
+	for seq, key := range keySequences {
+		if strings.HasPrefix(in, seq) {
+			t.pending = t.pending[len(seq):]
+			return key, nil
+		}
+	}
+
+	r, size := utf8.DecodeRuneInString(in)
+	t.pending = t.pending[size:]
+
+	switch r {
+	case '\r', '\n':
+		return "enter", nil
+	case '\t':
+		return "tab", nil
+	case 0x7f, '\b':
+		return "backspace", nil
+	case 0x1b:
+		// esc on its own, or some sequence we don't do
+		if len(t.pending) > 0 && t.pending[0] == '[' {
+			t.pending = nil
+		}
+
+		return "esc", nil
+	}
+
+	if r < ' ' {
+		return "ctrl-" + string('a'+r-1), nil
+	}
+
+	return string(r), nil
+}
+
+// fit chops s (or pads it with spaces) to be n columns wide
+func fit(s string, n int) string {
+	rs := []rune(s)
+	if len(rs) > n {
+		if n < 1 {
+			return ""
+		}
+
+		return string(rs[:n-1]) + "…"
+	}
+
+	return s + strings.Repeat(" ", n-len(rs))
+}
+
+// fuzzy reports whether the letters of pat show up in s, in
+// order, ignoring case
+func fuzzy(pat, s string) bool {
+	s = strings.ToLower(s)
+
+	for _, r := range strings.ToLower(pat) {
+		i := strings.IndexRune(s, r)
+		if i < 0 {
+			return false
+		}
+
+		s = s[i+utf8.RuneLen(r):]
+	}
+
+	return true
+}
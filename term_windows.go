@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// no TIOCGWINSZ here; callers fall back to $LINES and $COLUMNS
+func ttySize(f *os.File) (rows, cols int) {
+	return 0, 0
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// pathSet reads the paths in a staging file, or in a plain list
+// of them, one per line (or NUL-delimited, with -0), from a file
+// or stdin ("-"). It's a staging file if it's JSON or has any
+// comments, which find's output won't.
+func pathSet(path string) (map[string]bool, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(expandHome(path))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	set := map[string]bool{}
+
+	if staging.IsJSON(data) || bytes.HasPrefix(data, []byte("#")) || bytes.Contains(data, []byte("\n#")) {
+		other, err := staging.Parse(path, data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range other.Marks {
+			set[m.Path] = true
+		}
+
+		return set, nil
+	}
+
+	for _, p := range readPaths(bytes.NewReader(data)) {
+		if abs, err := filepath.Abs(p); err == nil {
+			set[abs] = true
+		}
+	}
+
+	return set, nil
+}
+
+// readStaging reads a staging area from a file, or from stdin if
+// path is "-", in any format mark writes, without creating or
+// locking anything
+func readStaging(path string) (*StagingArea, error) {
+	var (
+		data []byte
+		err  error
+	)
+
+	if path == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(expandHome(path))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return staging.Parse(path, data)
+}
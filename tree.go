@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// a directory (or file) in status -tree
+type treeNode struct {
+	name     string
+	children []*treeNode
+	byName   map[string]*treeNode
+
+	// the mark for this path, if it's staged itself
+	mark  *Mark
+	index int
+}
+
+func (n *treeNode) child(name string) *treeNode {
+	if c, found := n.byName[name]; found {
+		return c
+	}
+
+	c := &treeNode{name: name, byName: map[string]*treeNode{}}
+	n.byName[name] = c
+	n.children = append(n.children, c)
+
+	return c
+}
+
+// compact folds directories with nothing staged in them but one
+// other directory into it, so "/home/me/src/project" is one line
+func (n *treeNode) compact() {
+	for len(n.children) == 1 && n.mark == nil && len(n.children[0].children) > 0 {
+		only := n.children[0]
+		n.name = strings.TrimSuffix(n.name, "/") + "/" + only.name
+		n.children, n.byName, n.mark, n.index = only.children, only.byName, only.mark, only.index
+	}
+
+	for _, c := range n.children {
+		c.compact()
+	}
+}
+
+func (n *treeNode) print(depth int, on bool) {
+	name := n.name
+	if len(n.children) > 0 {
+		name = strings.TrimSuffix(name, "/") + "/"
+	}
+
+	if m := n.mark; m != nil {
+		name = paint(on, pathColor(m.Path), name)
+	}
+
+	fmt.Printf("%s%s", strings.Repeat("  ", depth), name)
+
+	if m := n.mark; m != nil {
+		fmt.Printf(" #%d", n.index)
+
+		if len(m.Tags) > 0 {
+			fmt.Printf(" %s", paintTags(on, m.Tags))
+		}
+
+		if state := describeStatus(m); state != "" {
+			fmt.Printf(" %s", paint(on, statusColor(m.Status), state))
+		}
+	}
+
+	fmt.Printf("\n")
+
+	for _, c := range n.children {
+		c.print(depth+1, on)
+	}
+}
+
+// statusTree is status -tree: the marks as a tree of the
+// directories they're in
+func statusTree(order []*Mark, index map[*Mark]int) {
+	root := &treeNode{name: "/", byName: map[string]*treeNode{}}
+
+	for _, m := range order {
+		n := root
+		for _, seg := range strings.Split(strings.Trim(m.Path, "/"), "/") {
+			n = n.child(seg)
+		}
+
+		n.mark, n.index = m, index[m]
+	}
+
+	root.compact()
+
+	if len(root.children) > 0 || root.mark != nil {
+		root.print(0, colorful(os.Stdout))
+	}
+}
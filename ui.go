@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// the state of "mark ui": a filtered list of marks, some of
+// them selected, with a preview of the one under the cursor
+type ui struct {
+	stage *StagingArea
+	term  *terminal
+
+	filter   string
+	cursor   int
+	top      int
+	selected map[string]bool
+	preview  bool
+	message  string
+
+	// changed since the staging file was read
+	dirty bool
+
+	// what to exec on the way out, and on what
+	exec  []string
+	marks []*Mark
+}
+
+const uiHelp = "tab select  ^a all  ^t tag  ^u untag  ^d remove  ^x exec  ^p preview  ^w clear  esc quit"
+
+// runUI runs the interactive interface on the staging area,
+// writing it back (and running an exec, if one was asked for) on
+// the way out
+func runUI(s *StagingArea) error {
+	t, err := openTerminal()
+	if err != nil {
+		return err
+	}
+
+	t.FullScreen()
+
+	u := &ui{
+		stage:    s,
+		term:     t,
+		selected: map[string]bool{},
+		preview:  true,
+	}
+
+	err = u.loop()
+	t.Close()
+
+	if err != nil {
+		return err
+	}
+
+	if u.dirty {
+		rewrite(s)
+	}
+
+	if len(u.exec) > 0 {
+		s.LastExec = u.exec
+		execMarks(s, u.exec, u.marks)
+	}
+
+	return nil
+}
+
+// visible is the marks that match the filter, fuzzily, by path
+// or tag
+func (u *ui) visible() []*Mark {
+	ret := []*Mark{}
+
+	for i := range u.stage.Marks {
+		m := &u.stage.Marks[i]
+
+		if fuzzy(u.filter, m.Path) || fuzzy(u.filter, strings.Join(m.Tags, " ")) {
+			ret = append(ret, m)
+		}
+	}
+
+	return ret
+}
+
+// targets is what an action applies to: everything selected,
+// or just what's under the cursor
+func (u *ui) targets(shown []*Mark) []*Mark {
+	ret := []*Mark{}
+
+	for i := range u.stage.Marks {
+		if u.selected[u.stage.Marks[i].Path] {
+			ret = append(ret, &u.stage.Marks[i])
+		}
+	}
+
+	if len(ret) == 0 && u.cursor < len(shown) {
+		ret = append(ret, shown[u.cursor])
+	}
+
+	return ret
+}
+
+func (u *ui) loop() error {
+	for {
+		shown := u.visible()
+
+		if u.cursor >= len(shown) {
+			u.cursor = len(shown) - 1
+		}
+
+		if u.cursor < 0 {
+			u.cursor = 0
+		}
+
+		u.draw(shown)
+
+		key, err := u.term.ReadKey()
+		if err != nil {
+			return err
+		}
+
+		u.message = ""
+		rows, _ := u.term.Size()
+
+		switch key {
+		case "esc", "ctrl-c", "ctrl-q":
+			return nil
+
+		case "up", "ctrl-k":
+			u.cursor--
+
+		case "down", "ctrl-j", "ctrl-n":
+			u.cursor++
+
+		case "pgup":
+			u.cursor -= rows / 2
+
+		case "pgdn":
+			u.cursor += rows / 2
+
+		case "backspace":
+			if r := []rune(u.filter); len(r) > 0 {
+				u.filter = string(r[:len(r)-1])
+			}
+
+		case "ctrl-w":
+			u.filter = ""
+
+		case "ctrl-p":
+			u.preview = !u.preview
+
+		case "tab":
+			if u.cursor < len(shown) {
+				path := shown[u.cursor].Path
+				u.selected[path] = !u.selected[path]
+				u.cursor++
+			}
+
+		case "ctrl-a":
+			all := true
+			for _, m := range shown {
+				all = all && u.selected[m.Path]
+			}
+
+			for _, m := range shown {
+				u.selected[m.Path] = !all
+			}
+
+		case "ctrl-d":
+			n := u.stage.Drop(u.targets(shown))
+			u.selected = map[string]bool{}
+			u.dirty = u.dirty || n > 0
+			u.message = fmt.Sprintf("removed %d", n)
+
+		case "ctrl-t", "ctrl-u":
+			what := "tag"
+			if key == "ctrl-u" {
+				what = "untag"
+			}
+
+			tag, ok := u.prompt(what + ": ")
+			if !ok || tag == "" {
+				continue
+			}
+
+			n := 0
+			for _, m := range u.targets(shown) {
+				if what == "tag" && m.Tag(tag) || what == "untag" && m.Untag(tag) {
+					n++
+				}
+			}
+
+			u.dirty = u.dirty || n > 0
+			u.message = fmt.Sprintf("%sged %d", what, n)
+
+		case "ctrl-x":
+			marks := u.targets(shown)
+			if len(marks) == 0 {
+				continue
+			}
+
+			line, ok := u.prompt(fmt.Sprintf("exec on %d: ", len(marks)))
+			if !ok {
+				continue
+			}
+
+			if args := staging.SplitTokens(line); len(args) > 0 {
+				u.exec, u.marks = args, marks
+				return nil
+			}
+
+		case "enter":
+			// nothing yet; enter is for prompts
+
+		default:
+			if len([]rune(key)) == 1 {
+				u.filter += key
+				u.cursor = 0
+			}
+		}
+	}
+}
+
+// prompt reads a line on the bottom row; ok is false if it was
+// abandoned with esc
+func (u *ui) prompt(label string) (line string, ok bool) {
+	for {
+		rows, cols := u.term.Size()
+		fmt.Fprintf(u.term.f, "\x1b[%d;1H\x1b[K%s", rows, fit(label+line, cols-1))
+
+		key, err := u.term.ReadKey()
+		if err != nil {
+			return "", false
+		}
+
+		switch key {
+		case "enter":
+			return strings.TrimSpace(line), true
+		case "esc", "ctrl-c":
+			return "", false
+		case "backspace":
+			if r := []rune(line); len(r) > 0 {
+				line = string(r[:len(r)-1])
+			}
+		default:
+			if len([]rune(key)) == 1 {
+				line += key
+			}
+		}
+	}
+}
+
+func (u *ui) draw(shown []*Mark) {
+	rows, cols := u.term.Size()
+	on := colorful(u.term.f)
+
+	// filter on top, help on the bottom, and the list (and
+	// preview) in between
+	listRows := rows - 2
+	previewRows := 0
+
+	if u.preview {
+		previewRows = listRows / 2
+		listRows -= previewRows
+	}
+
+	if u.cursor < u.top {
+		u.top = u.cursor
+	}
+
+	if u.cursor >= u.top+listRows {
+		u.top = u.cursor - listRows + 1
+	}
+
+	index := map[*Mark]int{}
+	for i := range u.stage.Marks {
+		index[&u.stage.Marks[i]] = i
+	}
+
+	out := &bytes.Buffer{}
+	out.WriteString("\x1b[H\x1b[2J")
+
+	nsel := 0
+	for _, v := range u.selected {
+		if v {
+			nsel++
+		}
+	}
+
+	counts := fmt.Sprintf("  %d/%d", len(shown), len(u.stage.Marks))
+	if nsel > 0 {
+		counts += fmt.Sprintf(", %d selected", nsel)
+	}
+
+	fmt.Fprintf(out, "> %s%s\r\n", u.filter, paint(on, colorCodes["dim"], counts))
+
+	for row := 0; row < listRows; row++ {
+		i := u.top + row
+		if i >= len(shown) {
+			out.WriteString("\r\n")
+			continue
+		}
+
+		m := shown[i]
+
+		cursor, sel := "  ", " "
+		if i == u.cursor {
+			cursor = paint(on, colorCodes["bold"], "> ")
+		}
+
+		if u.selected[m.Path] {
+			sel = paint(on, colorCodes["green"], "*")
+		}
+
+		label := fmt.Sprintf("%d. ", index[m])
+		tags := ""
+		if len(m.Tags) > 0 {
+			tags = " " + strings.Join(m.Tags, ",")
+		}
+
+		// chop the plain text to fit, then color what's left
+		room := cols - 4 - len(label)
+		path := fit(m.Path, room)
+		if len([]rune(m.Path)) < room {
+			path = m.Path
+			tags = strings.TrimRight(fit(tags, room-len([]rune(path))), " ")
+		} else {
+			tags = ""
+		}
+
+		fmt.Fprintf(out, "%s%s %s%s%s\r\n", cursor, sel, label, paint(on, pathColor(m.Path), path), paint(on, colorCodes["yellow"], tags))
+	}
+
+	if previewRows > 0 {
+		fmt.Fprintf(out, "%s\r\n", paint(on, colorCodes["dim"], strings.Repeat("─", cols)))
+
+		lines := []string{}
+		if u.cursor < len(shown) {
+			lines = previewLines(shown[u.cursor].Path, previewRows-1)
+		}
+
+		for row := 0; row < previewRows-1; row++ {
+			if row < len(lines) {
+				out.WriteString(strings.TrimRight(fit(lines[row], cols), " "))
+			}
+
+			out.WriteString("\r\n")
+		}
+	}
+
+	help := uiHelp
+	if u.message != "" {
+		help = u.message
+	}
+
+	fmt.Fprintf(out, "%s", paint(on, colorCodes["dim"], strings.TrimRight(fit(help, cols-1), " ")))
+
+	// leave the cursor where the typing goes
+	fmt.Fprintf(out, "\x1b[1;%dH", len([]rune(u.filter))+3)
+
+	u.term.f.Write(out.Bytes())
+}
+
+// previewLines is the first n lines of a file, or what's in a
+// directory
+func previewLines(path string, n int) []string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return []string{"(gone)"}
+	}
+
+	if fi.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return []string{err.Error()}
+		}
+
+		lines := []string{}
+		for _, e := range entries {
+			name := e.Name()
+			if e.IsDir() {
+				name += "/"
+			}
+
+			lines = append(lines, name)
+		}
+
+		return lines
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	defer f.Close()
+
+	buf := make([]byte, 64*1024)
+	k, _ := f.Read(buf)
+	buf = buf[:k]
+
+	if bytes.IndexByte(buf, 0) >= 0 {
+		return []string{fmt.Sprintf("(binary, %s)", humanSize(fi.Size()))}
+	}
+
+	lines := []string{}
+	for _, line := range strings.SplitN(string(buf), "\n", n+1) {
+		if len(lines) == n {
+			break
+		}
+
+		line = strings.ReplaceAll(line, "\t", "    ")
+		line = strings.Map(func(r rune) rune {
+			if r < ' ' || r == 0x7f {
+				return -1
+			}
+
+			return r
+		}, line)
+
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// the file in a directory saying what recursive adds should
+// skip in it, in gitignore syntax
+const markIgnore = ".markignore"
+
+// listFlag is a flag.Value for flags that can be given more
+// than once, like -exclude. What the config file gives is a
+// default: the first time it's set after that, it starts over.
+type listFlag struct {
+	list *[]string
+
+	// the list came from the config
+	config *bool
+}
+
+func (l listFlag) String() string {
+	if l.list == nil {
+		return ""
+	}
+
+	return strings.Join(*l.list, ",")
+}
+
+func (l listFlag) Set(v string) error {
+	if *l.config {
+		*l.list, *l.config = nil, false
+	}
+
+	*l.list = append(*l.list, v)
+	return nil
+}
+
+func (l listFlag) configured() {
+	*l.config = true
+}
+
+// tagFlag is the flag.Value for -tag, which can be given more
+// than once: every expression given has to match. Like a
+// listFlag, it starts over from what the config file gave.
+type tagFlag struct {
+	expr *string
+
+	// the expression came from the config
+	config *bool
+}
+
+func (t tagFlag) String() string {
+	if t.expr == nil {
+		return ""
+	}
+
+	return *t.expr
+}
+
+func (t tagFlag) Set(v string) error {
+	if *t.config {
+		*t.expr, *t.config = "", false
+	}
+
+	if *t.expr == "" {
+		*t.expr = v
+	} else {
+		*t.expr = "(" + *t.expr + ") and (" + v + ")"
+	}
+
+	return nil
+}
+
+func (t tagFlag) configured() {
+	*t.config = true
+}
+
+// the -newer, -older, -min-size and -max-size limits, parsed
+type walkLimits struct {
+	newer, older     time.Time
+	minSize, maxSize int64
+	hasMin, hasMax   bool
+}
+
+var limits walkLimits
+
+// parseLimits parses the -newer, -older, -min-size and
+// -max-size flags
+func parseLimits() (walkLimits, error) {
+	l := walkLimits{}
+
+	var err error
+
+	if flagNewer != "" {
+		if l.newer, err = parseAge(flagNewer); err != nil {
+			return l, err
+		}
+	}
+
+	if flagOlder != "" {
+		if l.older, err = parseAge(flagOlder); err != nil {
+			return l, err
+		}
+	}
+
+	if flagMinSize != "" {
+		if l.minSize, err = parseSize(flagMinSize); err != nil {
+			return l, err
+		}
+
+		l.hasMin = true
+	}
+
+	if flagMaxSize != "" {
+		if l.maxSize, err = parseSize(flagMaxSize); err != nil {
+			return l, err
+		}
+
+		l.hasMax = true
+	}
+
+	return l, nil
+}
+
+// parseAge turns "90d", "2w", "36h" (ago) or a date, like
+// "2024-01-01" or an RFC 3339 time, into a time
+func parseAge(spec string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", spec, time.Local); err == nil {
+		return t, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, spec); err == nil {
+		return t, nil
+	}
+
+	units := map[byte]time.Duration{
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+	}
+
+	if unit, ok := units[spec[len(spec)-1]]; ok {
+		n, err := strconv.ParseFloat(spec[:len(spec)-1], 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad age %q", spec)
+		}
+
+		return time.Now().Add(-time.Duration(n * float64(unit))), nil
+	}
+
+	d, err := time.ParseDuration(spec)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad age %q (try 2d, 36h or 2024-01-01)", spec)
+	}
+
+	return time.Now().Add(-d), nil
+}
+
+// parseSize turns "512", "10K", "10M", "1.5G" (powers of 1024,
+// and a trailing "B" or "iB" is fine) into bytes
+func parseSize(spec string) (int64, error) {
+	s := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(spec), "B"), "I")
+
+	mult := 1.0
+
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			mult = math.Pow(1024, float64(i+1))
+			s = s[:len(s)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q (try 512, 10K, 10M or 1G)", spec)
+	}
+
+	return int64(n * mult), nil
+}
+
+// a recursive add in progress
+type walker struct {
+	// what -exclude leaves out
+	excludes ignoreRules
+
+	// the real directories of the symlinks followed to get
+	// where we are, to catch cycles
+	chain []string
+
+	paths []string
+}
+
+// humanSize is parseSize backwards: 512, 10K, 1.5M
+func humanSize(n int64) string {
+	if n < 1024 {
+		return strconv.FormatInt(n, 10)
+	}
+
+	f := float64(n)
+	unit := 0
+
+	for f >= 1024 && unit < 4 {
+		f /= 1024
+		unit++
+	}
+
+	if f < 10 {
+		return fmt.Sprintf("%.1f%c", f, " KMGT"[unit])
+	}
+
+	return fmt.Sprintf("%.0f%c", f, " KMGT"[unit])
+}
+
+// walk returns what a recursive add (-r) of the directory root
+// stages: everything under it that isn't a directory, less
+// whatever .markignore files, -exclude and -gitignore leave out,
+// down to -maxdepth, following symlinks with -follow
+func walk(root string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if limits, err = parseLimits(); err != nil {
+		return nil, err
+	}
+
+	w := &walker{
+		// -exclude patterns go last, so .gitignore files can't
+		// re-include what they leave out
+		excludes: parseIgnore(root, strings.NewReader(strings.Join(flagExclude, "\n"))),
+	}
+
+	outer := ignoreRules{}
+	if flagGitignore {
+		outer = gitIgnoresAbove(root)
+	}
+
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.walkDir(real, root, 0, outer)
+
+	return w.paths, err
+}
+
+// walkDir walks the directory real, which we got to as shown (the
+// two differ under a followed symlink), depth levels down from the
+// top of the walk, with the ignore rules from above it
+func (w *walker) walkDir(real, shown string, depth int, outer ignoreRules) error {
+	// the ignore rules in effect in each directory
+	rules := map[string]ignoreRules{filepath.Dir(shown): outer}
+
+	w.chain = append(w.chain, real)
+	defer func() { w.chain = w.chain[:len(w.chain)-1] }()
+
+	return filepath.WalkDir(real, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			ok(err)
+			return nil
+		}
+
+		rel, _ := filepath.Rel(real, path)
+		at := filepath.Join(shown, rel)
+
+		level := depth
+		if rel != "." {
+			level += strings.Count(rel, string(filepath.Separator)) + 1
+		}
+
+		inherited := rules[filepath.Dir(at)]
+
+		if at == shown {
+			rules[at] = append(inherited[:len(inherited):len(inherited)], dirIgnores(at)...)
+			return nil
+		}
+
+		// with -follow, a symlink is whatever it points to
+		if d.Type()&fs.ModeSymlink != 0 && flagFollow {
+			if fi, err := os.Stat(at); err == nil {
+				d = fs.FileInfoToDirEntry(fi)
+
+				if fi.IsDir() {
+					return w.follow(at, d, level, inherited)
+				}
+			}
+		}
+
+		if inherited.ignored(at, d.IsDir()) || w.excludes.ignored(at, d.IsDir()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if wanted(at, d) {
+			w.paths = append(w.paths, at)
+		}
+
+		if d.IsDir() {
+			if flagGitignore && d.Name() == ".git" || flagMaxDepth >= 0 && level >= flagMaxDepth {
+				return filepath.SkipDir
+			}
+
+			rules[at] = append(inherited[:len(inherited):len(inherited)], dirIgnores(at)...)
+		}
+
+		return nil
+	})
+}
+
+// follow walks into the directory the symlink at points to,
+// unless that would go around in circles
+func (w *walker) follow(at string, d fs.DirEntry, level int, inherited ignoreRules) error {
+	if inherited.ignored(at, true) || w.excludes.ignored(at, true) {
+		return nil
+	}
+
+	if wanted(at, d) {
+		w.paths = append(w.paths, at)
+	}
+
+	if flagMaxDepth >= 0 && level >= flagMaxDepth {
+		return nil
+	}
+
+	real, err := filepath.EvalSymlinks(at)
+	if !ok(err) {
+		return nil
+	}
+
+	// a cycle, if it points at (or above) anywhere we've been
+	here, _ := filepath.EvalSymlinks(filepath.Dir(at))
+	for _, been := range append(w.chain, here) {
+		if been == real || staging.Under(been, real) {
+			eprintf("not following %s: it loops back to %s", at, real)
+			return nil
+		}
+	}
+
+	return w.walkDir(real, at, level, inherited)
+}
+
+// wanted reports whether a walk stages what it found at path,
+// going by -type (without which it's anything but directories),
+// -ext and -glob
+func wanted(path string, d fs.DirEntry) bool {
+	kind := byte('f')
+
+	switch {
+	case d.IsDir():
+		kind = 'd'
+	case d.Type()&fs.ModeSymlink != 0:
+		kind = 'l'
+	case !d.Type().IsRegular():
+		kind = 'o'
+	}
+
+	if flagType == "" {
+		if kind == 'd' {
+			return false
+		}
+	} else if !strings.ContainsRune(flagType, rune(kind)) {
+		return false
+	}
+
+	if flagExt != "" {
+		ext := strings.TrimPrefix(filepath.Ext(path), ".")
+
+		hit := false
+		for _, want := range strings.Split(flagExt, ",") {
+			hit = hit || strings.EqualFold(ext, strings.TrimPrefix(strings.TrimSpace(want), "."))
+		}
+
+		if !hit {
+			return false
+		}
+	}
+
+	if flagGlob != "" {
+		if hit, _ := filepath.Match(flagGlob, d.Name()); !hit {
+			return false
+		}
+	}
+
+	return withinLimits(path, d.IsDir())
+}
+
+// withinLimits checks what's at path against -newer, -older,
+// -min-size and -max-size (sizes don't apply to directories)
+func withinLimits(path string, isDir bool) bool {
+	l := limits
+
+	if l.newer.IsZero() && l.older.IsZero() && !l.hasMin && !l.hasMax {
+		return true
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		// a dangling symlink
+		if fi, err = os.Lstat(path); err != nil {
+			return false
+		}
+	}
+
+	switch {
+	case !l.newer.IsZero() && !fi.ModTime().After(l.newer):
+		return false
+	case !l.older.IsZero() && !fi.ModTime().Before(l.older):
+		return false
+	case isDir:
+		return true
+	case l.hasMin && fi.Size() < l.minSize:
+		return false
+	case l.hasMax && fi.Size() > l.maxSize:
+		return false
+	}
+
+	return true
+}
+
+// dirIgnores reads the ignore files in dir that apply to what's
+// under it
+func dirIgnores(dir string) ignoreRules {
+	rules := ignoreRules{}
+
+	if flagGitignore {
+		rules = append(rules, readIgnoreFile(filepath.Join(dir, ".gitignore"))...)
+	}
+
+	return append(rules, readIgnoreFile(filepath.Join(dir, markIgnore))...)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		spec string
+		want int64
+	}{
+		{"512", 512},
+		{"0", 0},
+		{"10K", 10 << 10},
+		{"10k", 10 << 10},
+		{"10KB", 10 << 10},
+		{"10KiB", 10 << 10},
+		{"1.5M", 3 << 19},
+		{"2G", 2 << 30},
+		{"1T", 1 << 40},
+		{"100B", 100},
+	}
+
+	for _, tt := range tests {
+		got, err := parseSize(tt.spec)
+		if err != nil || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", tt.spec, got, err, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"", "K", "ten", "-1", "10X", "1.2.3M"} {
+		if n, err := parseSize(bad); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", bad, n)
+		}
+	}
+}
+
+func TestHumanSize(t *testing.T) {
+	for n, want := range map[int64]string{
+		512:        "512",
+		10 << 10:   "10K",
+		3 << 19:    "1.5M",
+		100 << 30:  "100G",
+		1023:       "1023",
+		1<<40 + 1:  "1.0T",
+		15<<20 + 1: "15M",
+	} {
+		if got := humanSize(n); got != want {
+			t.Errorf("humanSize(%d) = %q, want %q", n, got, want)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		spec string
+		ago  time.Duration
+	}{
+		{"2d", 48 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+		{"36h", 36 * time.Hour},
+		{"90m", 90 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		got, err := parseAge(tt.spec)
+		if err != nil {
+			t.Errorf("parseAge(%q): %s", tt.spec, err)
+			continue
+		}
+
+		// give or take however long the test takes
+		if off := time.Since(got) - tt.ago; off < 0 || off > time.Minute {
+			t.Errorf("parseAge(%q) is %s ago, want %s", tt.spec, time.Since(got), tt.ago)
+		}
+	}
+
+	if got, err := parseAge("2024-01-01"); err != nil || !got.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)) {
+		t.Errorf("parseAge(2024-01-01) = %s, %v", got, err)
+	}
+
+	if got, err := parseAge("2024-01-01T12:00:00Z"); err != nil || !got.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseAge(2024-01-01T12:00:00Z) = %s, %v", got, err)
+	}
+
+	for _, bad := range []string{"d", "twod", "2x", "2024-13-01"} {
+		if _, err := parseAge(bad); err == nil {
+			t.Errorf("parseAge(%q) worked", bad)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// how a file looked the last time watch looked at it
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// watch stages files as they show up under roots (or, without
+// any, under the directories that are staged), until it's killed.
+// It looks every -poll, with the same filters as add -r (-ext,
+// -glob, -exclude and the rest), and adds a file once it's held
+// still between looks, so a download isn't staged half done.
+// Files already there when it starts are left alone, unless
+// they're removed and show up again.
+func watch(s *StagingArea, roots []string) {
+	seen := scan(s, roots)
+	pending := map[string]fileState{}
+
+	for range time.Tick(flagPoll) {
+		if s.Unchanged() == staging.ErrChanged {
+			if fresh, err := GetStagingArea(s.Path); ok(err) {
+				s = fresh
+			}
+		}
+
+		cur := scan(s, roots)
+		ready := []string{}
+
+		for path, st := range cur {
+			if _, found := seen[path]; found {
+				continue
+			}
+
+			if last, found := pending[path]; found && last == st {
+				ready = append(ready, path)
+				seen[path] = st
+				delete(pending, path)
+			} else {
+				pending[path] = st
+			}
+		}
+
+		// gone before it settled
+		for path := range pending {
+			if _, found := cur[path]; !found {
+				delete(pending, path)
+			}
+		}
+
+		// or gone after; if it comes back, as it does when
+		// something's written and then renamed into place,
+		// it's new again
+		for path := range seen {
+			if _, found := cur[path]; !found {
+				delete(seen, path)
+			}
+		}
+
+		if len(ready) > 0 {
+			s = watchAdd(s, ready)
+		}
+	}
+}
+
+// watchAdd stages paths, tagging them with -autotag, and returns
+// the staging area as it is now
+func watchAdd(s *StagingArea, paths []string) *StagingArea {
+	if !flagNoLock {
+		unlock, err := Lock(s.Path, true)
+		hardfail(stagingErr(err))
+
+		defer unlock()
+	}
+
+	// it may have changed while we were waiting for it
+	if s.Unchanged() == staging.ErrChanged {
+		fresh, err := GetStagingArea(s.Path)
+		hardfail(err)
+
+		s = fresh
+	}
+
+	added := 0
+
+	for _, path := range paths {
+		if !add(s, path) {
+			continue
+		}
+
+		added++
+		fmt.Printf("added %s\n", path)
+
+		if flagAutoTag == "" {
+			continue
+		}
+
+		for i := range s.Marks {
+			if s.Marks[i].Path == path {
+				s.Marks[i].Tag(flagAutoTag)
+			}
+		}
+	}
+
+	if added > 0 {
+		rewrite(s)
+	}
+
+	return s
+}
+
+// scan finds the files under roots, or the staged directories,
+// as they are now
+func scan(s *StagingArea, roots []string) map[string]fileState {
+	if len(roots) == 0 {
+		for _, m := range s.Marks {
+			if fi, err := os.Stat(m.Path); err == nil && fi.IsDir() {
+				roots = append(roots, m.Path)
+			}
+		}
+	}
+
+	ret := map[string]fileState{}
+
+	for _, root := range roots {
+		paths, err := walk(root)
+		if err != nil {
+			eprintf("%s", err)
+			continue
+		}
+
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err != nil || fi.IsDir() {
+				continue
+			}
+
+			if abs, err := filepath.Abs(path); err == nil {
+				ret[abs] = fileState{fi.Size(), fi.ModTime()}
+			}
+		}
+	}
+
+	return ret
+}
+
+// watchExec runs a command on the marks -tag, -match and -only
+// select, like exec, then on each again whenever its file
+// changes (once it's held still for a -poll), until it's killed
+// or interrupted. Marks aren't cleared after, and ones staged
+// while it's watching are watched too, from when they show up.
+func watchExec(s *StagingArea, args []string) {
+	states := map[string]fileState{}
+	pending := map[string]fileState{}
+
+	stat := func(path string) fileState {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fileState{size: -1}
+		}
+
+		return fileState{fi.Size(), fi.ModTime()}
+	}
+
+	// run runs the command on the marks for paths, or all of
+	// them
+	run := func(paths map[string]bool) {
+		if !flagNoLock {
+			unlock, err := Lock(s.Path, true)
+			hardfail(stagingErr(err))
+
+			defer unlock()
+		}
+
+		if s.Unchanged() == staging.ErrChanged {
+			fresh, err := GetStagingArea(s.Path)
+			hardfail(err)
+
+			s = fresh
+		}
+
+		todo := []*Mark{}
+		for _, m := range selectMarks(s) {
+			if paths == nil || paths[m.Path] {
+				todo = append(todo, m)
+			}
+		}
+
+		if len(todo) == 0 {
+			return
+		}
+
+		s.LastExec = args
+
+		completed, err := execute(s, args, runOrder(todo), nil)
+
+		if !flagDryRun {
+			rewrite(s)
+		}
+
+		if !flagQuickfix {
+			fmt.Printf("%d of %d completed\n", completed, len(todo))
+		}
+
+		if err == staging.ErrInterrupted {
+			exit(exitInterrupted)
+		}
+
+		// what the command did to its own files doesn't count
+		for _, m := range todo {
+			states[m.Path] = stat(m.Path)
+		}
+	}
+
+	run(nil)
+
+	eprintf("watching for changes (^C to stop)")
+
+	for range time.Tick(flagPoll) {
+		if s.Unchanged() == staging.ErrChanged {
+			if fresh, err := GetStagingArea(s.Path); ok(err) {
+				s = fresh
+			}
+		}
+
+		ready := map[string]bool{}
+
+		for _, m := range selectMarks(s) {
+			st := stat(m.Path)
+
+			last, watched := states[m.Path]
+			if !watched {
+				states[m.Path] = st
+				continue
+			}
+
+			if st == last {
+				delete(pending, m.Path)
+				continue
+			}
+
+			if settling, found := pending[m.Path]; found && settling == st {
+				ready[m.Path] = true
+				delete(pending, m.Path)
+			} else {
+				pending[m.Path] = st
+			}
+		}
+
+		if len(ready) > 0 {
+			run(ready)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/tqbf/mark/staging"
+)
+
+// where mark used to keep things, before it kept to the XDG
+// base directory spec
+const (
+	legacyStaging = "~/.mark-staging"
+	legacyAreaDir = "~/.mark"
+)
+
+// stateDir is where mark keeps its staging areas and their
+// history: $XDG_STATE_HOME/mark, or ~/.local/state/mark
+func stateDir() string {
+	// the spec says to ignore relative paths
+	if dir := os.Getenv("XDG_STATE_HOME"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, "mark")
+	}
+
+	return filepath.Join(os.Getenv("HOME"), ".local", "state", "mark")
+}
+
+// stateName is what to call the things in stateDir that belong
+// to the staging file at path: a hash of where it really is, so
+// two staging files never share one
+func stateName(path string) string {
+	if real, err := filepath.EvalSymlinks(path); err == nil {
+		path = real
+	}
+
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+
+	sum := sha256.Sum256([]byte(path))
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// defaultStagingPath is the staging file to use when there's no
+// -staging, -name or -local
+func defaultStagingPath() string {
+	return filepath.Join(stateDir(), "staging")
+}
+
+// migrateLegacy moves the old ~/.mark-staging and named areas
+// in ~/.mark to where they go now, unless something's already
+// there
+func migrateLegacy() {
+	if _, err := os.Stat(stateDir()); err == nil {
+		return
+	}
+
+	old := expandHome(legacyStaging)
+	oldAreas := expandHome(legacyAreaDir)
+
+	_, errStaging := os.Stat(old)
+	_, errAreas := os.Stat(oldAreas)
+
+	if errStaging != nil && errAreas != nil {
+		return
+	}
+
+	hardfail(os.MkdirAll(stateDir(), 0700))
+
+	if errStaging == nil && ok(moveFile(old, defaultStagingPath())) {
+		eprintf("moved %s to %s", old, defaultStagingPath())
+	}
+
+	if errAreas == nil {
+		entries, err := ioutil.ReadDir(oldAreas)
+		if !ok(err) {
+			return
+		}
+
+		hardfail(os.MkdirAll(areaDir, 0700))
+
+		for _, e := range entries {
+			from := filepath.Join(oldAreas, e.Name())
+
+			to := filepath.Join(areaDir, e.Name())
+			if e.IsDir() {
+				// that's the history
+				to = filepath.Join(stateDir(), e.Name())
+			}
+
+			ok(moveFile(from, to))
+		}
+
+		if os.Remove(oldAreas) == nil {
+			eprintf("moved the staging areas in %s to %s", oldAreas, areaDir)
+		}
+	}
+}
+
+// moveFile renames from to to, copying (files only) if they're
+// on different filesystems
+func moveFile(from, to string) error {
+	err := os.Rename(from, to)
+	if err == nil {
+		return nil
+	}
+
+	fi, serr := os.Stat(from)
+	if serr != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	err = staging.WriteAtomic(to, func(out io.Writer) error {
+		_, err := io.Copy(out, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(from)
+}